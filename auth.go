@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// paths anyone can reach so probes and scrapers need no key
+var openPaths = map[string]bool{
+	"/health":  true,
+	"/ready":   true,
+	"/metrics": true,
+}
+
+// paths that take the admin key rather than a user key
+var adminPaths = map[string]bool{
+	"/_all":    true,
+	"/_users":  true,
+	"/_stats":  true,
+	"/_reset":  true,
+	"/_inject": true,
+	"/_clear":  true,
+}
+
+// isAdminPath also covers the profiles served with -pprof.
+func isAdminPath(path string) bool {
+	return adminPaths[path] || strings.HasPrefix(path, "/debug/pprof/")
+}
+
+// keyring holds the bearer keys requests are checked against.
+type keyring struct {
+	// each user key's tenant, "" for the default app
+	users map[string]string
+	admin string
+}
+
+// parseKey splits a "key [tenant]" entry, ok false when it is blank.
+func parseKey(entry string) (key, tenant string, ok bool) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return "", "", false
+	}
+	if len(fields) > 1 {
+		tenant = fields[1]
+	}
+	return fields[0], tenant, true
+}
+
+// loadKeys reads user keys one per line from path, skipping blanks and
+// # comments, or when path is empty from the comma separated env value.
+// A key may be followed by the tenant it is for.
+func loadKeys(path, env string) (map[string]string, error) {
+	keys := make(map[string]string)
+
+	if len(path) == 0 {
+		for _, entry := range strings.Split(env, ",") {
+			if key, tenant, ok := parseKey(entry); ok {
+				keys[key] = tenant
+			}
+		}
+		return keys, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(s.Text()), "#") {
+			continue
+		}
+		if key, tenant, ok := parseKey(s.Text()); ok {
+			keys[key] = tenant
+		}
+	}
+
+	return keys, s.Err()
+}
+
+// enabled is false when no keys are configured, leaving the api open.
+func (k *keyring) enabled() bool {
+	return len(k.users) > 0 || len(k.admin) > 0
+}
+
+// tenants returns every tenant a key is for, always with the default.
+func (k *keyring) tenants() map[string]bool {
+	tenants := map[string]bool{"": true}
+	for _, tenant := range k.users {
+		tenants[tenant] = true
+	}
+	return tenants
+}
+
+func (k *keyring) isAdmin(key string) bool {
+	return len(k.admin) > 0 && subtle.ConstantTimeCompare([]byte(key), []byte(k.admin)) == 1
+}
+
+// bearer returns the key from an "Authorization: Bearer <key>" header.
+func bearer(r *http.Request) (string, bool) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key = strings.TrimSpace(key)
+	return key, ok && len(key) > 0
+}
+
+// withAuth rejects requests without a valid key with a 401. Admin
+// paths need the admin key, which also works everywhere else and for
+// any tenant. A user key only reaches its own tenant, whatever the
+// request's X-Tenant-ID.
+func withAuth(k *keyring, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !k.enabled() || openPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := bearer(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized. Missing bearer key.", 401)
+			return
+		}
+
+		admin := k.isAdmin(key)
+		tenant, user := k.users[key]
+
+		if !admin && !user {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized. Unknown key.", 401)
+			return
+		}
+
+		if isAdminPath(r.URL.Path) && !admin {
+			http.Error(w, "Forbidden. Admin key required.", 403)
+			return
+		}
+
+		if !admin {
+			if id := r.Header.Get(tenantHeader); len(id) > 0 && id != tenant {
+				http.Error(w, "Forbidden. Key is not for this tenant.", 403)
+				return
+			}
+
+			r = r.Clone(r.Context())
+			r.Header.Set(tenantHeader, tenant)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
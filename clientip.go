@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// proxies are the networks whose X-Forwarded-For and X-Real-IP headers
+// are believed, read from -trusted-proxies as comma separated CIDRs or
+// single addresses.
+type proxies []*net.IPNet
+
+func (p proxies) contains(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p proxies) MarshalText() ([]byte, error) {
+	nets := make([]string, len(p))
+	for i, n := range p {
+		nets[i] = n.String()
+	}
+	return []byte(strings.Join(nets, ",")), nil
+}
+
+func (p *proxies) UnmarshalText(text []byte) error {
+	var nets proxies
+
+	for _, s := range strings.Split(string(text), ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return &net.ParseError{Type: "IP address", Text: s}
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+
+	*p = nets
+	return nil
+}
+
+// clientIP is the address a request came from. When the peer is a
+// trusted proxy it is the nearest address in X-Forwarded-For not itself
+// a trusted proxy, or X-Real-IP without one. Anyone else's headers are
+// ignored so a client can't claim to be someone else.
+func clientIP(r *http.Request, trusted proxies) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted.contains(ip) {
+		return host
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		// proxies append, so walk back from the nearest hop, stopping
+		// at one which can't be read
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !trusted.contains(hop) {
+				break
+			}
+		}
+		return ip.String()
+	}
+
+	if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+		return real.String()
+	}
+
+	return ip.String()
+}
+
+// clientIPFrom returns the client address withClientIP put in ctx.
+func clientIPFrom(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// withClientIP works out each request's client address, trusting the
+// forwarding headers of trusted proxies only, for logging and limits.
+func withClientIP(trusted proxies, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey, clientIP(r, trusted))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withIPLimit rate limits requests by client address, leaving out the
+// open probe and scrape paths. A limiter with no rate is no limit.
+func withIPLimit(l *limiter, h http.Handler) http.Handler {
+	if l.rate <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if openPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := l.allow(clientIPFrom(r.Context()))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too Many Requests. Slow down.", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// envelope is every JSON response from -api-version 2 on. One of data
+// and error is always null.
+type envelope struct {
+	Data  json.RawMessage        `json:"data"`
+	Error map[string]interface{} `json:"error"`
+}
+
+// envelopeWriter holds a response back until the handler is done so it
+// can be wrapped whole.
+type envelopeWriter struct {
+	http.ResponseWriter
+	buf  bytes.Buffer
+	code int
+}
+
+func (e *envelopeWriter) WriteHeader(code int) {
+	if e.code == 0 {
+		e.code = code
+	}
+}
+
+func (e *envelopeWriter) Write(b []byte) (int, error) {
+	if e.code == 0 {
+		e.code = http.StatusOK
+	}
+	return e.buf.Write(b)
+}
+
+// finish sends the held response in an envelope. A success which isn't
+// JSON, such as /metrics, goes out as it came.
+func (e *envelopeWriter) finish() {
+	h := e.Header()
+	if e.code == 0 {
+		e.code = http.StatusOK
+	}
+
+	isJSON := strings.HasPrefix(h.Get("Content-Type"), "application/json")
+
+	var env envelope
+	switch {
+	case e.code >= 400:
+		env.Error = envelopeError(e.code, e.buf.Bytes(), isJSON)
+	case !isJSON:
+		e.ResponseWriter.WriteHeader(e.code)
+		e.ResponseWriter.Write(e.buf.Bytes())
+		return
+	case len(bytes.TrimSpace(e.buf.Bytes())) > 0:
+		env.Data = e.buf.Bytes()
+	}
+
+	h.Set("Content-Type", "application/json")
+	h.Del("Content-Length")
+	writeJSONStatus(e.ResponseWriter, e.code, env)
+}
+
+// envelopeError turns an error response into an error object with its
+// status, a code and a message. A JSON error keeps its other fields,
+// its error or status string as the code. A plain text one's message
+// drops the leading status text.
+func envelopeError(code int, body []byte, isJSON bool) map[string]interface{} {
+	status := http.StatusText(code)
+	obj := map[string]interface{}{
+		"code":    strings.ToLower(strings.ReplaceAll(status, " ", "_")),
+		"message": status,
+	}
+
+	var fields map[string]interface{}
+	if isJSON && json.Unmarshal(body, &fields) == nil {
+		for k, v := range fields {
+			if s, ok := v.(string); ok && (k == "error" || k == "status") {
+				obj["code"] = s
+				continue
+			}
+			obj[k] = v
+		}
+	} else if msg := strings.TrimSpace(strings.TrimPrefix(string(body), status+".")); len(msg) > 0 {
+		obj["message"] = msg
+	}
+
+	obj["status"] = code
+	return obj
+}
+
+// withEnvelope wraps every response in {data, error} when version is 2
+// or later, leaving older clients the bare responses of version 1.
+// Anything long lived is untouched.
+func withEnvelope(version int, h http.Handler) http.Handler {
+	if version < 2 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if longLived(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		e := &envelopeWriter{ResponseWriter: w}
+		h.ServeHTTP(e, r)
+		e.finish()
+	})
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// first and longest wait between attempts to republish or reconnect
+var (
+	retryBase = 250 * time.Millisecond
+	retryMax  = 30 * time.Second
+)
+
+// backoff is how long to wait before retry attempt n, counting from 0.
+// It doubles each attempt up to retryMax, less up to a fifth at random
+// so instances which lost the broker together don't retry together.
+func backoff(n int) time.Duration {
+	d := retryMax
+	if n < 30 && retryBase<<n < retryMax {
+		d = retryBase << n
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// broker carries location updates between instances.
+type broker interface {
+	Publish(subject string, data []byte) error
+	Subscribe(subject string, fn func(data []byte)) (func(), error)
+}
+
+// changes of state shared with other instances, as remoteUpdate.State,
+// so a user hidden on one is hidden on all
+const (
+	stateDark    = "dark"
+	stateLive    = "live"
+	stateHidden  = "invisible"
+	stateVisible = "visible"
+	stateOffline = "offline"
+	stateRemoved = "removed"
+)
+
+// remoteUpdate is a ping as published to other instances. Origin names
+// the instance it came from so it can skip its own, Seq counts up from
+// 1 for each origin so a redelivered update is only applied once.
+// With State set it is that change rather than a ping.
+type remoteUpdate struct {
+	Origin   string  `json:"origin"`
+	Seq      uint64  `json:"seq"`
+	Tenant   string  `json:"tenant,omitempty"`
+	Id       string  `json:"id"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	Alt      float64 `json:"alt"`
+	Accuracy float64 `json:"accuracy"`
+
+	// when the ping was taken, absent for as received
+	Time *time.Time `json:"time,omitempty"`
+
+	State string `json:"state,omitempty"`
+}
+
+// fanout shares one tenant's pings with every other instance on the
+// same subject.
+type fanout struct {
+	broker  broker
+	subject string
+	origin  string
+	tenant  string
+
+	// shared by every tenant's fanout on the instance
+	out *outbox
+}
+
+// outbox numbers an instance's updates and holds those the broker
+// refused, republishing them in order with backoff. It keeps at most
+// fanoutBuffer, dropping the oldest.
+type outbox struct {
+	sync.Mutex
+	seq      uint64
+	pending  [][]byte
+	retrying bool
+}
+
+// publish sends local pings and changes of state to the other
+// instances. Each stands locally whether or not it could be sent yet.
+func (f *fanout) publish(updates ...locationUpdate) {
+	o := f.out
+	o.Lock()
+	defer o.Unlock()
+
+	for _, up := range updates {
+		o.seq++
+		ru := remoteUpdate{
+			Origin:   f.origin,
+			Seq:      o.seq,
+			Tenant:   f.tenant,
+			Id:       up.id,
+			Lat:      up.lat,
+			Lon:      up.lon,
+			Alt:      up.alt,
+			Accuracy: up.accuracy,
+			State:    up.state,
+		}
+		if !up.time.IsZero() {
+			ru.Time = &up.time
+		}
+
+		b, err := json.Marshal(ru)
+		if err != nil {
+			continue
+		}
+
+		// queue behind anything waiting so updates stay in order
+		if len(o.pending) == 0 {
+			err = f.broker.Publish(f.subject, b)
+			if err == nil {
+				continue
+			}
+		}
+
+		logger.Warn("could not publish update, will retry", "event", "fanout_error", "user_id", up.id, "error", err)
+		o.hold(b)
+
+		if !o.retrying {
+			o.retrying = true
+			go o.retry(f.broker, f.subject)
+		}
+	}
+}
+
+// hold queues an update for retry. Callers must hold the lock.
+func (o *outbox) hold(b []byte) {
+	if len(o.pending) >= fanoutBuffer {
+		if len(o.pending) == 0 {
+			defaultMetrics.fanout("dropped")
+			return
+		}
+		o.pending = o.pending[1:]
+		defaultMetrics.fanout("dropped")
+	}
+	o.pending = append(o.pending, b)
+	defaultMetrics.fanout("retried")
+}
+
+// retry republishes held updates with backoff until none are left.
+func (o *outbox) retry(b broker, subject string) {
+	for n := 0; ; n++ {
+		time.Sleep(backoff(n))
+
+		o.Lock()
+		for len(o.pending) > 0 {
+			if err := b.Publish(subject, o.pending[0]); err != nil {
+				break
+			}
+			o.pending = o.pending[1:]
+		}
+
+		if len(o.pending) == 0 {
+			o.retrying = false
+			o.Unlock()
+			return
+		}
+		o.Unlock()
+	}
+}
+
+// share publishes every tenant's pings to subject on b, as origin, and
+// applies other instances' pings to the matching tenant. The returned
+// func stops applying them.
+func (t *tenants) share(b broker, subject, origin string) (func(), error) {
+	t.Lock()
+	t.fanout = &fanout{broker: b, subject: subject, origin: origin, out: &outbox{}}
+	for id, m := range t.managers {
+		m.setFanout(t.fanoutFor(id))
+	}
+	t.Unlock()
+
+	// the last update applied from each other instance
+	var mu sync.Mutex
+	last := make(map[string]uint64)
+
+	return b.Subscribe(subject, func(data []byte) {
+		var ru remoteUpdate
+		if err := json.Unmarshal(data, &ru); err != nil {
+			logger.Warn("bad remote update", "event", "fanout_error", "error", err)
+			return
+		}
+
+		if ru.Origin == origin {
+			return
+		}
+
+		mu.Lock()
+		seen := ru.Seq > 0 && ru.Seq <= last[ru.Origin]
+		if !seen {
+			last[ru.Origin] = ru.Seq
+		}
+		mu.Unlock()
+
+		if seen {
+			defaultMetrics.fanout("duplicate")
+			return
+		}
+
+		m, _, err := t.get(ru.Tenant)
+		if err != nil {
+			logger.Warn("remote update dropped", "event", "fanout_error", "tenant", ru.Tenant, "error", err)
+			return
+		}
+
+		up := locationUpdate{id: ru.Id, lat: ru.Lat, lon: ru.Lon, alt: ru.Alt, accuracy: ru.Accuracy, state: ru.State}
+		if ru.Time != nil {
+			up.time = *ru.Time
+		}
+		m.applyRemote(up)
+	})
+}
+
+// fanoutFor returns the fanout for one tenant, nil when not sharing.
+// Callers must hold the lock.
+func (t *tenants) fanoutFor(id string) *fanout {
+	if t.fanout == nil {
+		return nil
+	}
+	f := *t.fanout
+	f.tenant = id
+	return &f
+}
+
+func (m *manager) setFanout(f *fanout) {
+	m.Lock()
+	defer m.Unlock()
+	m.fanout = f
+}
+
+// applyRemote records a ping from another instance without publishing
+// it again. While the world is being rebuilt the ping is held, up to
+// fanoutBuffer of them, and applied once it is done.
+func (m *manager) applyRemote(up locationUpdate) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.rebuilding {
+		if len(m.held) >= fanoutBuffer {
+			if len(m.held) == 0 {
+				defaultMetrics.fanout("dropped")
+				return
+			}
+			m.held = m.held[1:]
+			defaultMetrics.fanout("dropped")
+		}
+		m.held = append(m.held, up)
+		defaultMetrics.fanout("buffered")
+		return
+	}
+
+	m.moveRemote(up)
+}
+
+// holdRemote starts holding pings from other instances while the world
+// is rebuilt, until releaseRemote.
+func (m *manager) holdRemote() {
+	m.Lock()
+	m.rebuilding = true
+	m.Unlock()
+}
+
+// releaseRemote applies the pings held since holdRemote in the order
+// they came.
+func (m *manager) releaseRemote() {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, up := range m.held {
+		m.moveRemote(up)
+	}
+	m.held = nil
+	m.rebuilding = false
+}
+
+// moveRemote applies a ping or change of state from another instance.
+// Callers must hold the write lock.
+func (m *manager) moveRemote(up locationUpdate) {
+	defaultMetrics.fanout("applied")
+
+	// not part of any request here
+	ctx := context.Background()
+
+	if len(up.state) > 0 {
+		m.changeRemote(ctx, up)
+		return
+	}
+
+	if _, err := m.move(ctx, up); err != nil {
+		logger.WarnContext(ctx, "could not apply remote update", "event", "fanout_error", "user_id", up.id, "error", err)
+		return
+	}
+
+	persist(ctx, saveLocation(m.store, m.users[up.id]))
+}
+
+// changeRemote applies another instance's change of state. A user yet
+// to be seen here is still marked dark or hidden so their first ping
+// here isn't shared. Callers must hold the write lock.
+func (m *manager) changeRemote(ctx context.Context, up locationUpdate) {
+	u, ok := m.users[up.id]
+	if !ok {
+		if up.state != stateDark && up.state != stateHidden {
+			return
+		}
+		u = newUser(up.id)
+		m.users[up.id] = u
+	}
+
+	switch up.state {
+	case stateDark:
+		m.darken(ctx, u)
+	case stateLive:
+		u.dark = false
+		persist(ctx, saveState(m.store, u))
+	case stateHidden:
+		m.setVisible(ctx, u, false)
+	case stateVisible:
+		m.setVisible(ctx, u, true)
+	case stateOffline:
+		m.offline(ctx, u)
+	case stateRemoved:
+		m.forget(ctx, u)
+	default:
+		logger.WarnContext(ctx, "unknown remote state", "event", "fanout_error", "user_id", up.id, "state", up.state)
+	}
+}
+
+// memBroker is an in process broker, used when instances share one
+// process and in tests.
+type memBroker struct {
+	sync.RWMutex
+	subs map[string]map[int]func([]byte)
+	next int
+}
+
+func newMemBroker() *memBroker {
+	return &memBroker{subs: make(map[string]map[int]func([]byte))}
+}
+
+func (b *memBroker) Publish(subject string, data []byte) error {
+	b.RLock()
+	fns := make([]func([]byte), 0, len(b.subs[subject]))
+	for _, fn := range b.subs[subject] {
+		fns = append(fns, fn)
+	}
+	b.RUnlock()
+
+	for _, fn := range fns {
+		fn(data)
+	}
+
+	return nil
+}
+
+func (b *memBroker) Subscribe(subject string, fn func([]byte)) (func(), error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.subs[subject] == nil {
+		b.subs[subject] = make(map[int]func([]byte))
+	}
+
+	id := b.next
+	b.next++
+	b.subs[subject][id] = fn
+
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.subs[subject], id)
+	}, nil
+}
+
+// natsBroker carries updates over a NATS connection.
+type natsBroker struct {
+	conn *nats.Conn
+}
+
+// newNATSBroker connects to url, reconnecting with backoff for as long
+// as it takes when the connection drops. Subscriptions carry over and
+// publishes meanwhile are buffered by the client.
+func newNATSBroker(url string) (*natsBroker, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("remindme"),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(backoff),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn("lost NATS connection", "event", "fanout_disconnect", "error", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			defaultMetrics.reconnect()
+			logger.Info("reconnected to NATS", "event", "fanout_reconnect", "url", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsBroker{conn: conn}, nil
+}
+
+func (b *natsBroker) Publish(subject string, data []byte) error {
+	return b.conn.Publish(subject, data)
+}
+
+func (b *natsBroker) Subscribe(subject string, fn func([]byte)) (func(), error) {
+	sub, err := b.conn.Subscribe(subject, func(msg *nats.Msg) {
+		fn(msg.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { sub.Unsubscribe() }, nil
+}
+
+func (b *natsBroker) Close() {
+	b.conn.Drain()
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+var errTooManyFences = errors.New("too many geofences")
+
+var (
+	// most fences a user may have
+	maxFences = 50
+
+	// entries kept per user until polled, the oldest are dropped
+	maxFenceEvents = 100
+
+	// most vertices a polygon fence may have
+	maxFenceVertices = 100
+)
+
+// geofence is a region a user is told about entering, a circle of
+// radius metres around lat/lon or, when polygon is set, the polygon
+// with lat/lon at the mean of its vertices.
+type geofence struct {
+	label    string
+	lat, lon float64
+	radius   float64 // metres
+
+	// lat, lon vertices in order, not repeating the first
+	polygon [][2]float64
+
+	// whether the user's last ping was within the fence
+	inside bool
+}
+
+func (f *geofence) contains(lat, lon float64) bool {
+	if f.polygon != nil {
+		return inPolygon(f.polygon, lat, lon)
+	}
+	return haversine(f.lat, f.lon, lat, lon) <= f.radius
+}
+
+// inPolygon reports whether lat/lon is inside the polygon by counting
+// the edges a ray east from it crosses, an odd count being inside.
+// Coordinates are treated as flat, fine for a campus or a venue.
+func inPolygon(polygon [][2]float64, lat, lon float64) bool {
+	var inside bool
+
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a[0] > lat) == (b[0] > lat) {
+			continue
+		}
+		if lon < a[1]+(lat-a[0])*(b[1]-a[1])/(b[0]-a[0]) {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// checkPolygon returns the polygon without a closing vertex repeating
+// the first, failing unless it is simple: at least 3 vertices, an area
+// and no edge crossing or touching another.
+func checkPolygon(polygon [][2]float64) ([][2]float64, error) {
+	if n := len(polygon); n > 1 && polygon[0] == polygon[n-1] {
+		polygon = polygon[:n-1]
+	}
+
+	n := len(polygon)
+	if n < 3 {
+		return nil, errors.New("needs at least 3 vertices")
+	}
+	if n > maxFenceVertices {
+		return nil, fmt.Errorf("has more than %d vertices", maxFenceVertices)
+	}
+
+	for i := range polygon {
+		if polygon[i] == polygon[(i+1)%n] {
+			return nil, errors.New("repeats a vertex")
+		}
+	}
+
+	// every pair of edges not sharing a vertex
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 {
+				continue
+			}
+			if crosses(polygon[i], polygon[i+1], polygon[j], polygon[(j+1)%n]) {
+				return nil, errors.New("must not cross itself")
+			}
+		}
+	}
+
+	// a simple polygon with no area lies on a line
+	var area float64
+	for i := range polygon {
+		a, b := polygon[i], polygon[(i+1)%n]
+		area += a[1]*b[0] - b[1]*a[0]
+	}
+	if area == 0 {
+		return nil, errors.New("must enclose an area")
+	}
+
+	return polygon, nil
+}
+
+// crosses reports whether segments p1-p2 and q1-q2 meet, touching
+// included.
+func crosses(p1, p2, q1, q2 [2]float64) bool {
+	d1, d2 := turn(q1, q2, p1), turn(q1, q2, p2)
+	d3, d4 := turn(p1, p2, q1), turn(p1, p2, q2)
+
+	if d1*d2 < 0 && d3*d4 < 0 {
+		return true
+	}
+
+	return d1 == 0 && between(q1, q2, p1) ||
+		d2 == 0 && between(q1, q2, p2) ||
+		d3 == 0 && between(p1, p2, q1) ||
+		d4 == 0 && between(p1, p2, q2)
+}
+
+// turn is positive if a, b, c turn left, negative if right and 0 if
+// they lie on a line.
+func turn(a, b, c [2]float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// between reports whether c, on the line through a and b, lies within
+// the segment.
+func between(a, b, c [2]float64) bool {
+	return math.Min(a[0], b[0]) <= c[0] && c[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= c[1] && c[1] <= math.Max(a[1], b[1])
+}
+
+// fenceEvent records a user entering a fence.
+type fenceEvent struct {
+	Type  string    `json:"type"`
+	Label string    `json:"label"`
+	Lat   float64   `json:"lat"`
+	Lon   float64   `json:"lon"`
+	Time  time.Time `json:"time"`
+}
+
+// addGeofence gives id a fence of radius metres around lat/lon, replacing
+// any with the same label. A user already inside is not told they entered.
+func (m *manager) addGeofence(ctx context.Context, id string, lat, lon, radius float64, label string) error {
+	if err := validateCoords(lat, lon); err != nil {
+		return err
+	}
+
+	if radius <= 0 {
+		return errors.New("radius must be positive")
+	}
+
+	if len(label) == 0 {
+		return errors.New("label is required")
+	}
+
+	return m.putFence(ctx, id, &geofence{label: label, lat: lat, lon: lon, radius: radius})
+}
+
+// addPolygonFence gives id a fence bounded by polygon, lat, lon vertices
+// in order which may repeat the first at the end, replacing any with
+// the same label. The polygon must not cross itself.
+func (m *manager) addPolygonFence(ctx context.Context, id string, polygon [][2]float64, label string) error {
+	for _, v := range polygon {
+		if err := validateCoords(v[0], v[1]); err != nil {
+			return err
+		}
+	}
+
+	polygon, err := checkPolygon(polygon)
+	if err != nil {
+		return fmt.Errorf("polygon %v", err)
+	}
+
+	if len(label) == 0 {
+		return errors.New("label is required")
+	}
+
+	f := &geofence{label: label, polygon: polygon}
+	for _, v := range polygon {
+		f.lat += v[0] / float64(len(polygon))
+		f.lon += v[1] / float64(len(polygon))
+	}
+
+	return m.putFence(ctx, id, f)
+}
+
+// putFence adds f to the user's fences, replacing any with its label.
+func (m *manager) putFence(ctx context.Context, id string, f *geofence) error {
+	m.Lock()
+	defer m.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		logger.InfoContext(ctx, "new user", "event", "new_user", "user_id", id)
+		u = newUser(id)
+		m.users[id] = u
+	}
+
+	if u.location != nil {
+		f.inside = f.contains(u.location.Coordinates())
+	}
+
+	for i, g := range u.fences {
+		if g.label == f.label {
+			u.fences[i] = f
+			return nil
+		}
+	}
+
+	if len(u.fences) >= maxFences {
+		return errTooManyFences
+	}
+
+	logger.InfoContext(ctx, "added geofence", "event", "add_geofence", "user_id", id, "label", f.label)
+	u.fences = append(u.fences, f)
+
+	return nil
+}
+
+// checkFences records an event for each fence u has just entered by
+// pinging lat/lon, and pushes it to u's subscribers. Callers must hold
+// the write lock.
+func (m *manager) checkFences(ctx context.Context, u *user, lat, lon float64, now time.Time) {
+	for _, f := range u.fences {
+		inside := f.contains(lat, lon)
+		entered := inside && !f.inside
+		f.inside = inside
+
+		if !entered {
+			continue
+		}
+
+		logger.InfoContext(ctx, "entered geofence", "event", "geofence_enter", "user_id", u.id, "label", f.label)
+
+		u.fenceEvents = append(u.fenceEvents, fenceEvent{
+			Type:  "enter",
+			Label: f.label,
+			Lat:   lat,
+			Lon:   lon,
+			Time:  now,
+		})
+		if n := len(u.fenceEvents); n > maxFenceEvents {
+			u.fenceEvents = u.fenceEvents[n-maxFenceEvents:]
+		}
+
+		publish(m.subscribers[u.id], event{
+			Type:     "enter",
+			Fence:    f.label,
+			Distance: haversine(f.lat, f.lon, lat, lon),
+		})
+	}
+}
+
+// pollFenceEvents returns and forgets the fence events recorded for id.
+// Returns false for an unknown user.
+func (m *manager) pollFenceEvents(id string) ([]fenceEvent, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, false
+	}
+
+	events := u.fenceEvents
+	u.fenceEvents = nil
+
+	if events == nil {
+		events = []fenceEvent{}
+	}
+
+	return events, true
+}
+
+func (m *manager) geofenceHandler(w http.ResponseWriter, r *http.Request) {
+	var req geofenceRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	var err error
+	if req.Polygon != nil {
+		err = m.addPolygonFence(r.Context(), req.Id, req.vertices(), req.Label)
+	} else {
+		lat, lon, ok := coordinates(w, req.Location)
+		if !ok {
+			return
+		}
+		err = m.addGeofence(r.Context(), req.Id, lat, lon, *req.Radius, req.Label)
+	}
+	if err == errTooManyFences {
+		http.Error(w, fmt.Sprintf("Bad Request. At most %d geofences per user.", maxFences), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad Request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ack(w)
+}
+
+func (m *manager) geofenceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	events, ok := m.pollFenceEvents(id)
+	if !ok {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"events": events})
+}
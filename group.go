@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+)
+
+type groupRequest struct {
+	Id       string   `json:"id"`
+	Group    string   `json:"group"`
+	Contacts []string `json:"contacts"`
+}
+
+func (req *groupRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.required("group", req.Group)
+	errs.ids("contacts", req.Contacts)
+	return errs
+}
+
+func (req *groupRequest) normalize() {
+	req.Contacts, _ = normalizeIDs(req.Contacts)
+}
+
+// addToGroup puts contacts in the user's named group, creating it if
+// need be. Members need not be contacts yet but only contacts are ever
+// found through the group.
+func (m *manager) addToGroup(ctx context.Context, id, group string, contacts []string) error {
+	contacts, err := normalizeIDs(contacts)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		logger.InfoContext(ctx, "new user", "event", "new_user", "user_id", id)
+		u = newUser(id)
+		m.users[id] = u
+	}
+
+	members, ok := u.groups[group]
+	if !ok {
+		members = make(map[string]bool)
+		u.groups[group] = members
+	}
+
+	logger.InfoContext(ctx, "adding to group", "event", "add_to_group", "user_id", id, "group", group, "contacts", contacts)
+	for _, contact := range contacts {
+		if contact != id {
+			members[contact] = true
+		}
+	}
+	persist(ctx, saveState(m.store, u))
+
+	return nil
+}
+
+// groupsOf returns the user's groups with their members sorted, or
+// false for an unknown user.
+func (m *manager) groupsOf(id string) (map[string][]string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, false
+	}
+
+	groups := make(map[string][]string, len(u.groups))
+	for name, members := range u.groups {
+		list := make([]string, 0, len(members))
+		for member := range members {
+			list = append(list, member)
+		}
+		sort.Strings(list)
+		groups[name] = list
+	}
+
+	return groups, true
+}
+
+// groupsWith returns the names of the user's groups contact is in,
+// sorted, or nil if none.
+func (u *user) groupsWith(contact string) []string {
+	var names []string
+	for name, members := range u.groups {
+		if members[contact] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasGroup reports whether the user has a group by that name.
+func (m *manager) hasGroup(id, group string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return false
+	}
+
+	_, ok = u.groups[group]
+	return ok
+}
+
+func (m *manager) groupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		id := r.URL.Query().Get("id")
+		if len(id) == 0 {
+			http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+			return
+		}
+
+		groups, ok := m.groupsOf(id)
+		if !ok {
+			http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{"groups": groups})
+		return
+	}
+
+	if r.Method != "POST" {
+		methodNotAllowed(w, "GET", "POST")
+		return
+	}
+
+	var req groupRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	if err := m.addToGroup(r.Context(), req.Id, req.Group, req.Contacts); err != nil {
+		http.Error(w, "Bad Request. Contact ids must not be empty.", http.StatusBadRequest)
+		return
+	}
+
+	ack(w)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip reports whether the request lists gzip in Accept-Encoding
+// without turning it off with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+
+	return false
+}
+
+// gzipWriter holds a response back until the handler is done so its
+// size is known before choosing whether to compress it.
+type gzipWriter struct {
+	http.ResponseWriter
+	buf  bytes.Buffer
+	code int
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.code == 0 {
+		g.code = code
+	}
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if g.code == 0 {
+		g.code = http.StatusOK
+	}
+	return g.buf.Write(b)
+}
+
+// finish sends the held response, gzipped if it is JSON of at least
+// min bytes.
+func (g *gzipWriter) finish(min int) {
+	h := g.Header()
+	if g.code == 0 {
+		g.code = http.StatusOK
+	}
+
+	if g.buf.Len() < min || !strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+		g.ResponseWriter.WriteHeader(g.code)
+		g.ResponseWriter.Write(g.buf.Bytes())
+		return
+	}
+
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.code)
+
+	zw := gzip.NewWriter(g.ResponseWriter)
+	zw.Write(g.buf.Bytes())
+	zw.Close()
+}
+
+// withGzip compresses JSON responses of at least min bytes for clients
+// which accept gzip. Smaller responses and other clients are untouched,
+// as is anything long lived. A min of 0 or less never compresses.
+func withGzip(min int, h http.Handler) http.Handler {
+	if min <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if longLived(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		g := &gzipWriter{ResponseWriter: w}
+		h.ServeHTTP(g, r)
+		g.finish(min)
+	})
+}
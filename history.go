@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// trail is a ring buffer of a user's most recent pings.
+type trail struct {
+	fixes []fix
+	next  int // where the next fix goes once full
+}
+
+// push records f, evicting the oldest fix once size are held.
+func (t *trail) push(f fix, size int) {
+	if size <= 0 {
+		return
+	}
+
+	if len(t.fixes) < size {
+		t.fixes = append(t.fixes, f)
+		return
+	}
+
+	t.fixes[t.next] = f
+	t.next = (t.next + 1) % len(t.fixes)
+}
+
+// add records f in time order, so a late fix is slotted in behind
+// newer ones. Once full, one older than every fix held is dropped.
+func (t *trail) add(f fix, size int) {
+	fixes := t.list()
+	n := len(fixes)
+	if n == 0 || !f.time.Before(fixes[n-1].time) {
+		t.push(f, size)
+		return
+	}
+
+	i := sort.Search(n, func(i int) bool { return fixes[i].time.After(f.time) })
+	fixes = append(fixes[:i], append([]fix{f}, fixes[i:]...)...)
+	if len(fixes) > size {
+		fixes = fixes[len(fixes)-size:]
+	}
+
+	t.fixes, t.next = fixes, 0
+}
+
+// list returns the fixes oldest first.
+func (t *trail) list() []fix {
+	out := make([]fix, 0, len(t.fixes))
+	out = append(out, t.fixes[t.next:]...)
+	return append(out, t.fixes[:t.next]...)
+}
+
+// history returns the user's recent pings oldest first, or false for
+// an unknown user.
+func (m *manager) history(id string) ([]fix, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, false
+	}
+
+	return u.trail.list(), true
+}
+
+func (m *manager) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	fixes, ok := m.history(id)
+	if !ok {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
+	}
+
+	trail := make([]map[string]interface{}, len(fixes))
+	for i, f := range fixes {
+		trail[i] = map[string]interface{}{
+			"lat":  f.lat,
+			"lon":  f.lon,
+			"time": f.time.Format(time.RFC3339),
+		}
+		if f.accuracy > 0 {
+			trail[i]["accuracy_m"] = f.accuracy
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{"history": trail})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// header a client sets to make retrying a POST safe
+const idempotencyHeader = "Idempotency-Key"
+
+// longest idempotency key accepted, each one is held for the ttl
+const maxIdempotencyKey = 255
+
+// replay is the response to the first request with a key, kept to
+// answer any retry of it. Sum is the hash of that request's body, a
+// retry must send the same.
+type replay struct {
+	key         string
+	sum         [sha256.Size]byte
+	done        bool
+	code        int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// replays holds responses by idempotency key for ttl. A ttl of 0 or
+// less ignores keys. Past max keys the least recently used response is
+// dropped, one still running never is; max 0 is no limit.
+type replays struct {
+	sync.Mutex
+	ttl time.Duration
+	max int
+	now func() time.Time
+
+	// of *replay, most recently used at the front
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newReplays(ttl time.Duration, max int) *replays {
+	return &replays{
+		ttl:     ttl,
+		max:     max,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// put keeps rp as the most recently used, replacing any for its key,
+// and drops the least recently used responses past max, never rp.
+func (s *replays) put(rp *replay) {
+	if e, ok := s.entries[rp.key]; ok {
+		e.Value = rp
+		s.order.MoveToFront(e)
+	} else {
+		s.entries[rp.key] = s.order.PushFront(rp)
+	}
+
+	for e := s.order.Back(); e != s.order.Front() && s.max > 0 && s.order.Len() > s.max; {
+		prev := e.Prev()
+		if old := e.Value.(*replay); old.done {
+			s.remove(e)
+		}
+		e = prev
+	}
+}
+
+func (s *replays) remove(e *list.Element) {
+	delete(s.entries, e.Value.(*replay).key)
+	s.order.Remove(e)
+}
+
+// begin claims key for a new request whose body hashes to sum,
+// returning true. When the key is already claimed it returns the
+// earlier request's replay instead, which is not done while that
+// request is still running.
+func (s *replays) begin(key string, sum [sha256.Size]byte) (*replay, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		if rp := e.Value.(*replay); !rp.done || s.now().Before(rp.expires) {
+			s.order.MoveToFront(e)
+			return rp, false
+		}
+	}
+
+	s.put(&replay{key: key, sum: sum})
+	return nil, true
+}
+
+// finish keeps the response for key. Responses a retry should not get,
+// a 429 or a server error, free the key instead.
+func (s *replays) finish(key string, code int, contentType string, body []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.entries[key]
+	if code == http.StatusTooManyRequests || code >= 500 {
+		if ok {
+			s.remove(e)
+		}
+		return
+	}
+
+	var sum [sha256.Size]byte
+	if ok {
+		sum = e.Value.(*replay).sum
+	}
+
+	s.put(&replay{
+		key:         key,
+		sum:         sum,
+		done:        true,
+		code:        code,
+		contentType: contentType,
+		body:        body,
+		expires:     s.now().Add(s.ttl),
+	})
+}
+
+// sweep drops responses past their ttl. Returns how many were dropped.
+func (s *replays) sweep() int {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+
+	var n int
+	for _, e := range s.entries {
+		if rp := e.Value.(*replay); rp.done && !now.Before(rp.expires) {
+			s.remove(e)
+			n++
+		}
+	}
+
+	return n
+}
+
+// replayWriter copies a response as it is written so it can be kept.
+type replayWriter struct {
+	http.ResponseWriter
+	code int
+	buf  bytes.Buffer
+}
+
+func (rw *replayWriter) WriteHeader(code int) {
+	if rw.code == 0 {
+		rw.code = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *replayWriter) Write(b []byte) (int, error) {
+	if rw.code == 0 {
+		rw.code = http.StatusOK
+	}
+	rw.buf.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// withIdempotency answers a POST carrying an Idempotency-Key it has
+// seen within the ttl with the first response rather than running it
+// again. Keys are scoped to the path and the caller's credentials, and
+// one sent again with a different body is a 422.
+func withIdempotency(s *replays, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if s.ttl <= 0 || r.Method != "POST" || len(key) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			http.Error(w, "Bad Request. Idempotency-Key too long.", http.StatusBadRequest)
+			return
+		}
+
+		key = r.URL.Path + "\n" + r.Header.Get("Authorization") + "\n" + key
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			badBody(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+
+		rp, ok := s.begin(key, sum)
+		switch {
+		case !ok && rp.sum != sum:
+			http.Error(w, "Unprocessable Entity. Idempotency-Key was used with a different body.", http.StatusUnprocessableEntity)
+			return
+		case !ok && !rp.done:
+			http.Error(w, "Conflict. A request with this Idempotency-Key is in progress.", http.StatusConflict)
+			return
+		case !ok:
+			w.Header().Set("Content-Type", rp.contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rp.code)
+			w.Write(rp.body)
+			return
+		}
+
+		// a handler which panics frees the key for a retry
+		var finished bool
+		defer func() {
+			if !finished {
+				s.finish(key, http.StatusInternalServerError, "", nil)
+			}
+		}()
+
+		rw := &replayWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, r)
+
+		if rw.code == 0 {
+			rw.code = http.StatusOK
+		}
+		s.finish(key, rw.code, w.Header().Get("Content-Type"), rw.buf.Bytes())
+		finished = true
+	})
+}
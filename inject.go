@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// errRealUser stops /_inject moving a user who isn't synthetic.
+var errRealUser = errors.New("id belongs to a real user")
+
+type injectRequest struct {
+	Users []injectedUser `json:"users"`
+}
+
+type injectedUser struct {
+	Id  string   `json:"id"`
+	Lat *float64 `json:"lat"`
+	Lon *float64 `json:"lon"`
+}
+
+func (req *injectRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	if req.Users == nil {
+		errs["users"] = "required"
+		return errs
+	}
+
+	for i, iu := range req.Users {
+		field := fmt.Sprintf("users[%d]", i)
+		errs.required(field+".id", iu.Id)
+		errs.location(field, &location{Lat: iu.Lat, Lon: iu.Lon})
+	}
+	return errs
+}
+
+// inject puts a synthetic user at lat, lon as if they had pinged there,
+// creating them if need be. Real users are left alone.
+func (m *manager) inject(ctx context.Context, id string, lat, lon float64) error {
+	if !m.bounds.contains(snap(lat), snap(lon)) {
+		return errOutOfBounds
+	}
+
+	m.Lock()
+	u, ok := m.users[id]
+	if ok && !u.synthetic {
+		m.Unlock()
+		return errRealUser
+	}
+	if !ok {
+		logger.InfoContext(ctx, "injecting user", "event", "inject", "user_id", id)
+		u = newUser(id)
+		u.synthetic = true
+		m.users[id] = u
+	}
+	m.Unlock()
+
+	return m.applyUpdate(ctx, locationUpdate{id: id, lat: lat, lon: lon})
+}
+
+// clearSynthetic removes every injected user, returning their ids.
+func (m *manager) clearSynthetic(ctx context.Context) []string {
+	m.RLock()
+	var ids []string
+	for id, u := range m.users {
+		if u.synthetic {
+			ids = append(ids, id)
+		}
+	}
+	m.RUnlock()
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		m.removeUser(ctx, id)
+	}
+	return ids
+}
+
+func (m *manager) injectHandler(w http.ResponseWriter, r *http.Request) {
+	var req injectRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	results := make([]bulkPingResult, len(req.Users))
+	for i, iu := range req.Users {
+		results[i].Id = iu.Id
+		if ok, _ := m.pings.allow(iu.Id); !ok {
+			results[i].Error = errTooManyPings.Error()
+			continue
+		}
+		if err := m.inject(r.Context(), iu.Id, *iu.Lat, *iu.Lon); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Ok = true
+	}
+
+	writeJSON(w, map[string]interface{}{"results": results})
+}
+
+func (m *manager) clearHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+
+	removed := m.clearSynthetic(r.Context())
+	if removed == nil {
+		removed = []string{}
+	}
+
+	writeJSON(w, map[string]interface{}{"removed": removed})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics are exposed at /metrics in the Prometheus text format
+type metrics struct {
+	sync.Mutex
+
+	// requests by handler and status code
+	requests map[[2]string]uint64
+
+	// pings shared between instances by what became of them, and
+	// times the NATS connection came back
+	fanouts    map[string]uint64
+	reconnects uint64
+
+	// nearContacts latency in seconds
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+var defaultMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	buckets := []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1}
+
+	return &metrics{
+		requests: make(map[[2]string]uint64),
+		fanouts:  make(map[string]uint64),
+		buckets:  buckets,
+		counts:   make([]uint64, len(buckets)),
+	}
+}
+
+func (m *metrics) request(handler string, code int) {
+	m.Lock()
+	m.requests[[2]string{handler, strconv.Itoa(code)}]++
+	m.Unlock()
+}
+
+// fanout counts a shared ping by result: applied, buffered while
+// restoring, duplicate, retried or dropped.
+func (m *metrics) fanout(result string) {
+	m.Lock()
+	m.fanouts[result]++
+	m.Unlock()
+}
+
+func (m *metrics) reconnect() {
+	m.Lock()
+	m.reconnects++
+	m.Unlock()
+}
+
+func (m *metrics) observeNear(d time.Duration) {
+	s := d.Seconds()
+
+	m.Lock()
+	defer m.Unlock()
+
+	for i, b := range m.buckets {
+		if s <= b {
+			m.counts[i]++
+		}
+	}
+	m.sum += s
+	m.count++
+}
+
+// statusWriter records the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack lets websocket upgrades through.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	w.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// instrument counts the outcome of every request to h under name,
+// which is the path it is served on.
+func instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h(sw, r)
+		defaultMetrics.request(name, sw.code)
+	}
+}
+
+func (m *manager) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	m.RLock()
+	users := len(m.users)
+	m.RUnlock()
+
+	dm := defaultMetrics
+	dm.Lock()
+	defer dm.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var keys [][2]string
+	for k := range dm.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	fmt.Fprintln(w, "# HELP remindme_requests_total Requests handled by endpoint and status code.")
+	fmt.Fprintln(w, "# TYPE remindme_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "remindme_requests_total{handler=%q,code=%q} %d\n", k[0], k[1], dm.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP remindme_near_contacts_seconds Time taken to find nearby contacts.")
+	fmt.Fprintln(w, "# TYPE remindme_near_contacts_seconds histogram")
+	for i, b := range dm.buckets {
+		fmt.Fprintf(w, "remindme_near_contacts_seconds_bucket{le=\"%g\"} %d\n", b, dm.counts[i])
+	}
+	fmt.Fprintf(w, "remindme_near_contacts_seconds_bucket{le=\"+Inf\"} %d\n", dm.count)
+	fmt.Fprintf(w, "remindme_near_contacts_seconds_sum %g\n", dm.sum)
+	fmt.Fprintf(w, "remindme_near_contacts_seconds_count %d\n", dm.count)
+
+	results := make([]string, 0, len(dm.fanouts))
+	for result := range dm.fanouts {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+
+	fmt.Fprintln(w, "# HELP remindme_fanout_total Pings shared with other instances by result.")
+	fmt.Fprintln(w, "# TYPE remindme_fanout_total counter")
+	for _, result := range results {
+		fmt.Fprintf(w, "remindme_fanout_total{result=%q} %d\n", result, dm.fanouts[result])
+	}
+
+	fmt.Fprintln(w, "# HELP remindme_nats_reconnects_total Times the NATS connection was lost and regained.")
+	fmt.Fprintln(w, "# TYPE remindme_nats_reconnects_total counter")
+	fmt.Fprintf(w, "remindme_nats_reconnects_total %d\n", dm.reconnects)
+
+	fmt.Fprintln(w, "# HELP remindme_users Users currently tracked.")
+	fmt.Fprintln(w, "# TYPE remindme_users gauge")
+	fmt.Fprintf(w, "remindme_users %d\n", users)
+}
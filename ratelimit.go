@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is one user's token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a per user token bucket refilling at rate tokens a second
+// up to burst. A rate of 0 or less never limits.
+type limiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token for id. When none is left it returns false and
+// how long until the next one is due.
+func (l *limiter) allow(id string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[id] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweepEvery runs sweep on each tick of interval, forever.
+func (l *limiter) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.sweep()
+	}
+}
+
+// sweep drops buckets that have refilled since their last use, they
+// are no different from a new one. Returns how many were dropped.
+func (l *limiter) sweep() int {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	now := l.now()
+
+	var n int
+	for id, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, id)
+			n++
+		}
+	}
+
+	return n
+}
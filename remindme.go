@@ -1,11 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"io/ioutil"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/asim/quadtree"
 )
@@ -14,417 +31,3772 @@ type user struct {
 	id       string
 	contacts map[string]bool
 	location *quadtree.Point
+	lastSeen time.Time // by our clock, for expiry and presence
+
+	// when the latest ping was taken, by the client's clock if it
+	// sent a timestamp, for ordering late pings and velocity
+	taken time.Time
+
+	// velocity in metres per second derived from the last two pings
+	vNorth, vEast float64
+
+	// stopped sharing location, pings are ignored
+	dark bool
+
+	// pings are tracked but the location is kept out of the world
+	invisible bool
+
+	// named subsets of contacts /near can be scoped to
+	groups map[string]map[string]bool
+
+	// most recent ping, kept when going dark
+	lastKnown *fix
+
+	// outgoing contact requests awaiting confirmation
+	pending map[string]bool
+
+	// users who may never find this user
+	blocks map[string]bool
+
+	// circular regions and the entries into them not yet polled
+	fences      []*geofence
+	fenceEvents []fenceEvent
+
+	// the last historySize pings
+	trail trail
+
+	// contacts near at the last ping asking to be notified
+	notified map[string]bool
+
+	// contacts this user was last alerted were near, until they move
+	// beyond nearestDistance and the margin
+	alerted map[string]bool
+
+	// put in the world with /_inject for testing, /_clear removes them
+	synthetic bool
+}
+
+// point is the data stored with each user's location in the world
+// so queries can answer without going back to the users map.
+type point struct {
+	id       string
+	alt      float64 // metres
+	accuracy float64 // metres, 0 if unknown
+	lastSeen time.Time
+}
+
+type fix struct {
+	lat, lon, alt float64
+	accuracy      float64 // metres, 0 if unknown
+	time          time.Time
+}
+
+// nearQuery is a proximity search around a location.
+type nearQuery struct {
+	lat, lon, alt float64
+	distance      float64 // metres
+	limit         int
+
+	// include the difference in altitude in distances
+	altitude bool
+
+	// only members of this group of the user's, all contacts when empty
+	group string
+
+	// best ranked first rather than nearest first
+	rank bool
 }
 
 type manager struct {
 	sync.RWMutex
 	world *quadtree.QuadTree
 	users map[string]*user
+
+	// pings outside are rejected, the world spans no more
+	bounds bounds
+
+	// set once startup loading is done, read atomically
+	ready int32
+
+	// clock used for last seen times, replaceable in tests
+	now func() time.Time
+
+	// websocket subscribers by user id
+	subscribers map[string]map[chan []byte]bool
+
+	// per user /ping rate limit, has its own lock
+	pings *limiter
+
+	// shares pings with other instances, nil when running alone
+	fanout *fanout
+
+	// set while restoring users, when remote pings are held until done
+	rebuilding bool
+	held       []locationUpdate
+
+	// where every change is written through to
+	store Store
+
+	// responses by Idempotency-Key, has its own lock
+	replays *replays
+}
+
+const earthRadius = 6371000.0 // metres
+
+var (
+	errOutOfBounds     = errors.New("location out of bounds")
+	errEmptyID         = errors.New("empty id")
+	errFutureTimestamp = errors.New("timestamp is in the future")
+	errStaleTimestamp  = errors.New("timestamp is too old")
+	errTooManyPings    = errors.New("too many pings, slow down")
+)
+
+// contactLimitError stops a change that would leave a user with more
+// than contactLimit contacts. Count is how many they have now.
+type contactLimitError struct {
+	count, limit int
+}
+
+func (e *contactLimitError) Error() string {
+	return fmt.Sprintf("user has %d contacts, at most %d allowed", e.count, e.limit)
 }
 
 var (
 	nearestContacts = 5
 	nearestDistance = 10.0 // metres
-	defaultManager  = newManager()
+
+	// how long /subscribe holds near events to send them as one, 0
+	// sends each at once; a subscriber may ask for another window
+	nearDebounce time.Duration
+
+	// fraction beyond nearestDistance a contact must move before they
+	// can be alerted as near again, so hovering at the edge is one alert
+	nearMargin = 0.2
+
+	// metres in each distance unit a request may use
+	units           = map[string]float64{"m": 1, "km": 1000, "mi": 1609.344}
+	maxContacts     = 100  // most contacts a /near may ask for
+	nearCandidates  = 4    // contacts found per one asked for, to rank before keeping the best
+	contactLimit    = 1000 // most contacts one user may have, 0 for no limit
+	rosterPage      = 100  // users per /_users page when no limit is given
+	arrivalWindow   = 15 * time.Minute
+	historySize     = 50               // pings kept per user for /history
+	maxAccuracy     = 0.0              // metres, coarser pings are not discoverable, 0 for no limit
+	coordPrecision  = -1               // decimal places pings are rounded to, -1 keeps them as sent
+	maxClockSkew    = time.Minute      // how far ahead of the server a ping's timestamp may be
+	pingHorizon     = 24 * time.Hour   // oldest a ping's timestamp may be, 0 for no limit
+	presenceWindow  = 2 * time.Minute  // online if pinged this recently
+	rankHalfLife    = 10 * time.Minute // near contacts rank half as high per this long since their ping, 0 for distance only
+	treeCapacity    = 8                // points a quadtree node holds before splitting
+	worldBounds     = globe            // pings outside this box are rejected
+	locationTTL     = 30 * time.Minute // 0 keeps locations forever
+	shutdownTimeout = 10 * time.Second
+	requestTimeout  = 10 * time.Second // longest a request may run before a 503, 0 for no limit
+
+	// address to listen on, also read from $REMINDME_ADDR
+	listen = ":9999"
+
+	// reject request bodies carrying unknown fields
+	strictJSON = false
+
+	// longest request body read, larger ones get a 413
+	maxBodyBytes int64 = 1 << 20
+
+	// JSON responses this large are gzipped for clients accepting it
+	gzipMinBytes = 1024
+
+	// answer /_all with the old object keyed by id, not an array
+	allMap = false
+
+	// 2 wraps every response in {data, error}, 1 answers as before
+	apiVersion = 1
+
+	// serve runtime profiles under /debug/pprof/, admin only
+	pprofEnabled = false
+
+	// serve https when both are set, optionally redirecting plain http
+	tlsCert      = ""
+	tlsKey       = ""
+	redirectAddr = ""
+
+	// file users are loaded from at startup and saved to on shutdown
+	statePath = ""
+
+	// SQLite database users are written through to, instead of -state
+	dbPath = ""
+
+	// share pings with other instances over NATS when a url is set
+	natsURL     = ""
+	natsSubject = "remindme.locations"
+
+	// remote updates held while the world is rebuilt, and local ones
+	// waiting to be republished, before the oldest are dropped
+	fanoutBuffer = 1000
+
+	// bearer keys, the user keys also read from $REMINDME_API_KEYS and
+	// the admin key from $REMINDME_ADMIN_KEY; none leaves the api open
+	apiKeys  = ""
+	adminKey = ""
+
+	// most apps created from X-Tenant-ID besides the default, 0 for no
+	// limit; with api keys only the tenants they name are served
+	maxTenants = 100
+
+	// how long a POST's response is replayed to retries carrying the
+	// same Idempotency-Key, 0 ignores the header
+	idempotencyTTL = 24 * time.Hour
+
+	// most responses each app keeps for retries, the least recently
+	// used dropped first, 0 for no limit
+	idempotencyMax = 10000
+
+	// pings a second each user may send, with bursts of up to pingBurst
+	pingRate  = 5.0
+	pingBurst = 10
+
+	// requests a second each client address may send, 0 for no limit
+	ipRate  = 0.0
+	ipBurst = 20
+
+	// proxies whose X-Forwarded-For and X-Real-IP name the client
+	trustedProxies proxies
+
+	// JSON lines to stderr at -log-level and above
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(contextHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})})
 )
 
 func newManager() *manager {
 	return &manager{
-		world: newWorld(),
-		users: make(map[string]*user),
+		world:       newWorld(worldBounds),
+		bounds:      worldBounds,
+		users:       make(map[string]*user),
+		now:         time.Now,
+		subscribers: make(map[string]map[chan []byte]bool),
+		pings:       newLimiter(pingRate, pingBurst),
+		store:       newMemStore(),
+		replays:     newReplays(idempotencyTTL, idempotencyMax),
 	}
 }
 
+func (m *manager) setReady() {
+	atomic.StoreInt32(&m.ready, 1)
+}
+
+func (m *manager) isReady() bool {
+	return atomic.LoadInt32(&m.ready) == 1
+}
+
 func newUser(id string) *user {
 	return &user{
 		id:       id,
 		contacts: make(map[string]bool),
+		pending:  make(map[string]bool),
+		blocks:   make(map[string]bool),
+		groups:   make(map[string]map[string]bool),
+		alerted:  make(map[string]bool),
+	}
+}
+
+// offset returns the north and east displacement in metres from one
+// coordinate to another using an equirectangular approximation.
+func offset(lat1, lon1, lat2, lon2 float64) (float64, float64) {
+	rad := math.Pi / 180
+	north := (lat2 - lat1) * rad * earthRadius
+	east := (lon2 - lon1) * rad * earthRadius * math.Cos((lat1+lat2)/2*rad)
+	return north, east
+}
+
+// validateCoords checks lat and lon are real numbers within the
+// ranges of latitude and longitude.
+func validateCoords(lat, lon float64) error {
+	if math.IsNaN(lat) || math.IsInf(lat, 0) {
+		return errors.New("latitude must be a finite number")
+	}
+
+	if math.IsNaN(lon) || math.IsInf(lon, 0) {
+		return errors.New("longitude must be a finite number")
+	}
+
+	if lat < -90 || lat > 90 {
+		return fmt.Errorf("latitude %v is outside [-90, 90]", lat)
+	}
+
+	if lon < -180 || lon > 180 {
+		return fmt.Errorf("longitude %v is outside [-180, 180]", lon)
+	}
+
+	return nil
+}
+
+// bounds is the box of latitudes and longitudes a world spans, read
+// from -bounds as "minLat,minLon,maxLat,maxLon".
+type bounds struct {
+	minLat, minLon, maxLat, maxLon float64
+}
+
+// globe is the default bounds, the whole world.
+var globe = bounds{minLat: -90, minLon: -180, maxLat: 90, maxLon: 180}
+
+// contains reports whether lat, lon lies within the box, edges included.
+func (b bounds) contains(lat, lon float64) bool {
+	return lat >= b.minLat && lat <= b.maxLat && lon >= b.minLon && lon <= b.maxLon
+}
+
+func (b bounds) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%v,%v,%v,%v", b.minLat, b.minLon, b.maxLat, b.maxLon)), nil
+}
+
+func (b *bounds) UnmarshalText(text []byte) error {
+	parts := strings.Split(string(text), ",")
+	if len(parts) != 4 {
+		return errors.New("want minLat,minLon,maxLat,maxLon")
+	}
+
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", part)
+		}
+		v[i] = f
+	}
+
+	nb := bounds{minLat: v[0], minLon: v[1], maxLat: v[2], maxLon: v[3]}
+
+	if err := validateCoords(nb.minLat, nb.minLon); err != nil {
+		return err
+	}
+	if err := validateCoords(nb.maxLat, nb.maxLon); err != nil {
+		return err
+	}
+	if nb.minLat >= nb.maxLat || nb.minLon >= nb.maxLon {
+		return errors.New("each min must be less than its max")
+	}
+
+	*b = nb
+	return nil
+}
+
+// snap rounds a coordinate to coordPrecision decimal places so GPS
+// jitter below it reads as standing still.
+func snap(v float64) float64 {
+	if coordPrecision < 0 {
+		return v
 	}
+	scale := math.Pow(10, float64(coordPrecision))
+	return math.Round(v*scale) / scale
+}
+
+// haversine returns the great-circle distance in metres between two
+// coordinates.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// bearing is the initial great circle bearing in degrees from the first
+// point to the second, clockwise from north in [0, 360).
+func bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLon := (lon2 - lon1) * rad
+
+	y := math.Sin(dLon) * math.Cos(lat2*rad)
+	x := math.Cos(lat1*rad)*math.Sin(lat2*rad) -
+		math.Sin(lat1*rad)*math.Cos(lat2*rad)*math.Cos(dLon)
+
+	return math.Mod(math.Atan2(y, x)/rad+360, 360)
+}
+
+// boundingBox returns a box centred on lat, lon covering every point
+// within distance metres. Used as a coarse prefilter for haversine.
+func boundingBox(lat, lon, distance float64) *quadtree.AABB {
+	rad := math.Pi / 180
+	dLat := math.Min(distance/earthRadius/rad, 180)
+	dLon := math.Min(dLat/math.Cos(lat*rad), 360)
+
+	ax := quadtree.NewPoint(lat, lon, nil)   // center
+	bx := quadtree.NewPoint(dLat, dLon, nil) // half extents
+	return quadtree.NewAABB(ax, bx)
 }
 
-func newWorld() *quadtree.QuadTree {
-	ax := quadtree.NewPoint(0.0, 0.0, nil)
-	bx := quadtree.NewPoint(85.0, 185.0, nil)
+// newWorld returns an empty quadtree spanning b. How many points its
+// nodes hold before splitting is quadtree.Capacity, set once in main.
+func newWorld(b bounds) *quadtree.QuadTree {
+	// the AABB is a center point and half extents, for the globe
+	// 0,0 and 90,180
+	ax := quadtree.NewPoint((b.minLat+b.maxLat)/2, (b.minLon+b.maxLon)/2, nil)
+	bx := quadtree.NewPoint((b.maxLat-b.minLat)/2, (b.maxLon-b.minLon)/2, nil)
 	bb := quadtree.NewAABB(ax, bx)
+
+	// the second argument is the node's depth, 0 for the root
 	return quadtree.New(bb, 0, nil)
 }
 
-func (m *manager) addContacts(id string, contacts []string) {
+// normalizeIDs trims whitespace from each id and drops repeats,
+// keeping the first. Case is kept as ids are matched exactly elsewhere.
+func normalizeIDs(ids []string) ([]string, error) {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if len(id) == 0 {
+			return nil, errEmptyID
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+
+	return out, nil
+}
+
+// addContacts adds contacts to the user's contact list, returning how
+// many were new and the ones the user already had. Contacts are
+// normalized first and an empty one fails the whole batch. The user's
+// own id is dropped without being counted either way.
+func (m *manager) addContacts(ctx context.Context, id string, contacts []string) (int, []string, error) {
+	contacts, err := normalizeIDs(contacts)
+	if err != nil {
+		return 0, nil, err
+	}
+
 	m.Lock()
 	defer m.Unlock()
 
 	u, ok := m.users[id]
 	if !ok {
-		log.Printf("new user %s adding contacts", id)
+		logger.InfoContext(ctx, "new user", "event", "new_user", "user_id", id)
 		u = newUser(id)
 		m.users[id] = u
 	}
 
-	log.Printf("Received contacts %v for user %s", contacts, id)
+	var add []string
+	skipped := []string{}
+
+	logger.InfoContext(ctx, "received contacts", "event", "add_contacts", "user_id", id, "contacts", contacts)
 	for _, contact := range contacts {
+		if contact == id {
+			continue
+		}
 		if _, ok := u.contacts[contact]; ok {
+			skipped = append(skipped, contact)
 			continue
 		}
+		add = append(add, contact)
+	}
+
+	if err := checkContactLimit(len(u.contacts), len(u.contacts)+len(add)); err != nil {
+		return 0, nil, err
+	}
+
+	for _, contact := range add {
 		u.contacts[contact] = true
 	}
+	added := len(add)
+
+	if added > 0 {
+		persist(ctx, saveContacts(m.store, u))
+	}
+
+	return added, skipped, nil
+}
+
+// checkContactLimit fails when a user with have contacts would end up
+// with want, more than contactLimit.
+func checkContactLimit(have, want int) error {
+	if contactLimit > 0 && want > contactLimit {
+		return &contactLimitError{count: have, limit: contactLimit}
+	}
+	return nil
+}
+
+// checkReplaceLimit checks the user's contacts may be replaced with
+// the normalized list. Callers must hold the lock.
+func (m *manager) checkReplaceLimit(id string, contacts []string) error {
+	have := 0
+	if u, ok := m.users[id]; ok {
+		have = len(u.contacts)
+	}
+
+	want := len(contacts)
+	for _, contact := range contacts {
+		if contact == id {
+			want--
+		}
+	}
+
+	return checkContactLimit(have, want)
+}
+
+// requestContact asks contact to become a mutual contact of id. Neither
+// sees the other until contact confirms.
+func (m *manager) requestContact(ctx context.Context, id, contact string) error {
+	if id == contact {
+		return errors.New("cannot request yourself as a contact")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		logger.InfoContext(ctx, "new user", "event", "new_user", "user_id", id)
+		u = newUser(id)
+		m.users[id] = u
+	}
+
+	if c, ok := m.users[contact]; ok && c.contacts[id] && u.contacts[contact] {
+		// already mutual
+		return nil
+	}
+
+	logger.InfoContext(ctx, "contact requested", "event", "request_contact", "user_id", id, "contact", contact)
+	u.pending[contact] = true
+	persist(ctx, saveState(m.store, u))
+
+	return nil
 }
 
-func (m *manager) nearContacts(id string, lat, lon float64) []string {
+// confirmContact accepts or rejects the pending request from one user
+// to id. Accepting makes each a contact of the other, failing with a
+// *contactLimitError and leaving the request pending if either would
+// have more than contactLimit. Returns false if there is no such
+// request.
+func (m *manager) confirmContact(ctx context.Context, id, from string, accept bool) (bool, error) {
 	m.Lock()
 	defer m.Unlock()
 
-	var contacts []string
+	f, ok := m.users[from]
+	if !ok || !f.pending[id] {
+		return false, nil
+	}
+
+	if !accept {
+		delete(f.pending, id)
+		logger.InfoContext(ctx, "contact rejected", "event", "reject_contact", "user_id", id, "contact", from)
+		persist(ctx, saveState(m.store, f))
+		return true, nil
+	}
 
 	u, ok := m.users[id]
-	if !ok || len(u.contacts) == 0 {
-		return contacts
+	if !ok {
+		u = newUser(id)
+		m.users[id] = u
 	}
 
-	c := u.contacts
+	// each gains the other unless they have them already
+	for _, pair := range [][2]*user{{u, f}, {f, u}} {
+		have := len(pair[0].contacts)
+		if pair[0].contacts[pair[1].id] {
+			continue
+		}
+		if err := checkContactLimit(have, have+1); err != nil {
+			return true, err
+		}
+	}
 
-	// Filter to find users contacts
-	filter := func(p *quadtree.Point) bool {
-		id, ok := p.Data().(string)
-		if !ok {
-			return false
+	delete(f.pending, id)
+
+	logger.InfoContext(ctx, "contact confirmed", "event", "confirm_contact", "user_id", id, "contact", from)
+	u.contacts[from] = true
+	f.contacts[id] = true
+
+	persist(ctx, m.store.Batch(func(tx Store) error {
+		if err := saveContacts(tx, u); err != nil {
+			return err
 		}
+		if err := saveState(tx, f); err != nil {
+			return err
+		}
+		return saveContacts(tx, f)
+	}))
 
-		if _, ok := c[id]; !ok {
-			return false
+	return true, nil
+}
+
+// block stops target from finding id in any query, whether or not
+// they have id as a contact.
+func (m *manager) block(ctx context.Context, id, target string) {
+	m.Lock()
+	defer m.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		logger.InfoContext(ctx, "new user", "event", "new_user", "user_id", id)
+		u = newUser(id)
+		m.users[id] = u
+	}
+
+	logger.InfoContext(ctx, "user blocked", "event", "block", "user_id", id, "target", target)
+	u.blocks[target] = true
+	persist(ctx, saveState(m.store, u))
+}
+
+// blocked reports whether the user id has blocked viewer.
+// Callers must hold the lock.
+func (m *manager) blocked(id, viewer string) bool {
+	u, ok := m.users[id]
+	return ok && u.blocks[viewer]
+}
+
+// shares reports whether the user id lets viewer see them: id has
+// viewer as a contact too, so both have agreed, and has not blocked
+// them. Having someone as a contact alone shows nothing of them.
+// Callers must hold the lock.
+func (m *manager) shares(id, viewer string) bool {
+	u, ok := m.users[id]
+	return ok && u.contacts[viewer] && !u.blocks[viewer]
+}
+
+// contactsFor returns a sorted copy of the user's contacts, or false
+// for an unknown user.
+func (m *manager) contactsFor(id string) ([]string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, false
+	}
+
+	contacts := make([]string, 0, len(u.contacts))
+	for contact := range u.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Strings(contacts)
+
+	return contacts, true
+}
+
+// contactsOf returns the sorted ids of users who have id as a contact.
+// Contacts are only indexed one way so this scans every user, O(n) in
+// the number of users under the read lock.
+func (m *manager) contactsOf(id string) []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	followers := []string{}
+
+	for _, u := range m.users {
+		if u.id != id && u.contacts[id] {
+			followers = append(followers, u.id)
 		}
+	}
+	sort.Strings(followers)
 
-		return true
+	return followers
+}
+
+// contactCount returns how many contacts the user has, or false for an
+// unknown user.
+func (m *manager) contactCount(id string) (int, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return 0, false
 	}
 
-	ax := quadtree.NewPoint(lat, lon, nil) // center
-	bx := ax.HalfPoint(nearestDistance)    // top right
-	bb := quadtree.NewAABB(ax, bx)
+	return len(u.contacts), true
+}
 
-	points := m.world.KNearest(bb, nearestContacts, filter)
+// mutualContacts returns the sorted contacts of the user who have them
+// as a contact too, or false for an unknown user. One lookup per
+// contact, O(contacts) under the read lock.
+func (m *manager) mutualContacts(id string) ([]string, bool) {
+	m.RLock()
+	defer m.RUnlock()
 
-	for _, point := range points {
-		id, ok := point.Data().(string)
-		if !ok {
-			continue
+	u, ok := m.users[id]
+	if !ok {
+		return nil, false
+	}
+
+	mutual := []string{}
+	for contact := range u.contacts {
+		if c, ok := m.users[contact]; ok && c.contacts[id] {
+			mutual = append(mutual, contact)
 		}
+	}
+	sort.Strings(mutual)
+
+	return mutual, true
+}
+
+// setContacts replaces the user's contacts with exactly contacts,
+// returning the sorted ids added and removed. Contacts are normalized
+// as for addContacts.
+func (m *manager) setContacts(ctx context.Context, id string, contacts []string) ([]string, []string, error) {
+	contacts, err := normalizeIDs(contacts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.checkReplaceLimit(id, contacts); err != nil {
+		return nil, nil, err
+	}
+
+	added, removed := m.replaceContacts(ctx, id, contacts)
+	persist(ctx, saveContacts(m.store, m.users[id]))
+
+	return added, removed, nil
+}
+
+// replaceContacts swaps the user's contacts for the normalized list,
+// returning those added and removed. Callers must hold the write lock.
+func (m *manager) replaceContacts(ctx context.Context, id string, contacts []string) ([]string, []string) {
+	u, ok := m.users[id]
+	if !ok {
+		logger.InfoContext(ctx, "new user", "event", "new_user", "user_id", id)
+		u = newUser(id)
+		m.users[id] = u
+	}
+
+	want := make(map[string]bool, len(contacts))
+	added := []string{}
+	removed := []string{}
 
-		if id == u.id {
+	for _, contact := range contacts {
+		if contact == id {
 			continue
 		}
+		want[contact] = true
+		if !u.contacts[contact] {
+			added = append(added, contact)
+		}
+	}
 
-		contacts = append(contacts, id)
+	for contact := range u.contacts {
+		if !want[contact] {
+			removed = append(removed, contact)
+		}
 	}
 
-	return contacts
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	logger.InfoContext(ctx, "set contacts", "event", "set_contacts", "user_id", id, "added", added, "removed", removed)
+	u.contacts = want
+
+	return added, removed
 }
 
-func (m *manager) updateLocation(id string, lat, lon float64) {
+// removeContacts deletes contacts from the user's contact list,
+// normalized as for addContacts. Contacts the user doesn't have are
+// ignored. Returns false for an unknown user.
+func (m *manager) removeContacts(ctx context.Context, id string, contacts []string) (bool, error) {
+	contacts, err := normalizeIDs(contacts)
+	if err != nil {
+		return false, err
+	}
+
 	m.Lock()
 	defer m.Unlock()
 
-	u := m.users[id]
-	if u == nil {
-		log.Printf("new user %s at %f, %f", id, lat, lon)
-		u = newUser(id)
-		m.users[id] = u
+	u, ok := m.users[id]
+	if !ok {
+		return false, nil
 	}
 
-	if u.location == nil {
-		u.location = quadtree.NewPoint(lat, lon, id)
-		m.world.Insert(u.location)
-		return
+	logger.InfoContext(ctx, "removing contacts", "event", "remove_contacts", "user_id", id, "contacts", contacts)
+	for _, contact := range contacts {
+		delete(u.contacts, contact)
+	}
+
+	persist(ctx, saveContacts(m.store, u))
+
+	return true, nil
+}
+
+// removeUser forgets the user entirely, removing their point from the
+// world and them from everyone's contacts. Returns false for an
+// unknown user.
+func (m *manager) removeUser(ctx context.Context, id string) bool {
+	m.Lock()
+
+	u, ok := m.users[id]
+	if !ok {
+		m.Unlock()
+		return false
+	}
+
+	m.forget(ctx, u)
+	f := m.fanout
+	m.Unlock()
+
+	if f != nil {
+		f.publish(locationUpdate{id: id, state: stateRemoved})
+	}
+
+	return true
+}
+
+// forget removes u and every trace of them from others. Callers must
+// hold the write lock.
+func (m *manager) forget(ctx context.Context, u *user) {
+	id := u.id
+	logger.InfoContext(ctx, "removing user", "event", "remove_user", "user_id", id)
+
+	if u.location != nil {
+		m.world.Remove(u.location)
+	}
+
+	delete(m.users, id)
+	persist(ctx, m.store.DeleteUser(id))
+
+	for _, other := range m.users {
+		delete(other.contacts, id)
+		delete(other.pending, id)
+		delete(other.blocks, id)
+		delete(other.alerted, id)
+		for _, members := range other.groups {
+			delete(members, id)
+		}
+	}
+}
+
+// expireLocations removes users who haven't pinged within ttl from the
+// world. Their contacts are kept and the next ping puts them back.
+// Returns the number of locations expired.
+func (m *manager) expireLocations(ctx context.Context, ttl time.Duration) int {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	var expired []*user
+
+	for _, u := range m.users {
+		if u.location == nil || now.Sub(u.lastSeen) <= ttl {
+			continue
+		}
+
+		m.world.Remove(u.location)
+		u.location = nil
+		u.vNorth, u.vEast = 0, 0
+		expired = append(expired, u)
+	}
+
+	persist(ctx, m.store.Batch(func(tx Store) error {
+		for _, u := range expired {
+			if err := tx.ClearLocation(u.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	if len(expired) > 0 {
+		logger.InfoContext(ctx, "expired locations", "event", "expire", "count", len(expired), "ttl", ttl.String())
+	}
+
+	return len(expired)
+}
+
+// reset forgets every user, leaving an empty world. Subscribers stay
+// connected and hear about whoever pings next.
+func (m *manager) reset(ctx context.Context) {
+	m.Lock()
+	defer m.Unlock()
+
+	logger.WarnContext(ctx, "resetting all state", "event", "reset", "users", len(m.users))
+
+	persist(ctx, m.store.Batch(func(tx Store) error {
+		for id := range m.users {
+			if err := tx.DeleteUser(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	m.world = newWorld(m.bounds)
+	m.users = make(map[string]*user)
+}
+
+// treeStats describes what the world holds. The quadtree does not
+// expose its shape so points are counted from the users.
+type treeStats struct {
+	Users     int `json:"users"`
+	Points    int `json:"points"`
+	Invisible int `json:"invisible"`
+	Dark      int `json:"dark"`
+}
+
+func (m *manager) stats() treeStats {
+	m.RLock()
+	defer m.RUnlock()
+
+	s := treeStats{Users: len(m.users)}
+
+	for _, u := range m.users {
+		switch {
+		case u.dark:
+			s.Dark++
+		case u.location == nil:
+		case u.invisible:
+			s.Invisible++
+		default:
+			s.Points++
+		}
+	}
+
+	return s
+}
+
+// setVisibility hides the user from or returns them to the world.
+// Pings are still tracked while invisible so becoming visible puts them
+// back at their latest location. Returns false for an unknown user.
+func (m *manager) setVisibility(ctx context.Context, id string, visible bool) bool {
+	m.Lock()
+
+	u, ok := m.users[id]
+	if !ok {
+		m.Unlock()
+		return false
+	}
+
+	changed := m.setVisible(ctx, u, visible)
+
+	// other instances get the change, and the location they missed
+	// while the user was hidden once they aren't
+	updates := []locationUpdate{{id: id, state: stateVisible}}
+	if !visible {
+		updates[0].state = stateHidden
+	} else if u.location != nil {
+		updates = append(updates, lastPing(u))
+	}
+	f := m.fanout
+	m.Unlock()
+
+	if changed && f != nil {
+		f.publish(updates...)
+	}
+
+	return true
+}
+
+// setVisible hides u from or returns them to the world, reporting
+// whether that changed anything. Callers must hold the write lock.
+func (m *manager) setVisible(ctx context.Context, u *user, visible bool) bool {
+	if u.invisible == !visible {
+		return false
+	}
+
+	logger.InfoContext(ctx, "visibility changed", "event", "visibility", "user_id", u.id, "visible", visible)
+	u.invisible = !visible
+
+	if u.location != nil && visible {
+		m.world.Insert(u.location)
+	} else if u.location != nil {
+		m.world.Remove(u.location)
+	}
+
+	persist(ctx, m.store.Batch(func(tx Store) error {
+		if err := saveState(tx, u); err != nil {
+			return err
+		}
+		return saveLocation(tx, u)
+	}))
+
+	return true
+}
+
+// lastPing is u's latest location as a ping, for other instances.
+func lastPing(u *user) locationUpdate {
+	lat, lon := u.location.Coordinates()
+	data := u.location.Data().(*point)
+	return locationUpdate{id: u.id, lat: lat, lon: lon, alt: data.alt, accuracy: data.accuracy, time: data.lastSeen}
+}
+
+// goDark removes the user from the world and forgets their movement
+// until goLive is called. Contacts are kept. Returns false for an
+// unknown user.
+func (m *manager) goDark(ctx context.Context, id string) bool {
+	m.Lock()
+
+	u, ok := m.users[id]
+	if !ok {
+		m.Unlock()
+		return false
+	}
+
+	m.darken(ctx, u)
+	f := m.fanout
+	m.Unlock()
+
+	if f != nil {
+		f.publish(locationUpdate{id: id, state: stateDark})
+	}
+
+	return true
+}
+
+// darken takes u out of the world and forgets their movement. Callers
+// must hold the write lock.
+func (m *manager) darken(ctx context.Context, u *user) {
+	logger.InfoContext(ctx, "going dark", "event", "go_dark", "user_id", u.id)
+
+	if u.location != nil {
+		m.world.Remove(u.location)
+		u.location = nil
+		persist(ctx, m.store.ClearLocation(u.id))
+	}
+
+	u.lastSeen, u.taken = time.Time{}, time.Time{}
+	u.vNorth, u.vEast = 0, 0
+	u.trail = trail{}
+	u.dark = true
+	persist(ctx, saveState(m.store, u))
+}
+
+// goLive lets the user's pings be shared again.
+// Returns false for an unknown user.
+func (m *manager) goLive(ctx context.Context, id string) bool {
+	m.Lock()
+
+	u, ok := m.users[id]
+	if !ok {
+		m.Unlock()
+		return false
+	}
+
+	logger.InfoContext(ctx, "going live", "event", "go_live", "user_id", id)
+	u.dark = false
+	persist(ctx, saveState(m.store, u))
+	f := m.fanout
+	m.Unlock()
+
+	if f != nil {
+		f.publish(locationUpdate{id: id, state: stateLive})
+	}
+
+	return true
+}
+
+// goOffline removes the user from the world, like an expired location,
+// until their next ping. Contacts and history are kept. Returns false
+// for an unknown user.
+func (m *manager) goOffline(ctx context.Context, id string) bool {
+	m.Lock()
+
+	u, ok := m.users[id]
+	if !ok {
+		m.Unlock()
+		return false
+	}
+
+	m.offline(ctx, u)
+	f := m.fanout
+	m.Unlock()
+
+	if f != nil {
+		f.publish(locationUpdate{id: id, state: stateOffline})
+	}
+
+	return true
+}
+
+// offline takes u out of the world until their next ping. Callers must
+// hold the write lock.
+func (m *manager) offline(ctx context.Context, u *user) {
+	logger.InfoContext(ctx, "going offline", "event", "go_offline", "user_id", u.id)
+
+	if u.location != nil {
+		m.world.Remove(u.location)
+		u.location = nil
+		persist(ctx, m.store.ClearLocation(u.id))
+	}
+
+	u.vNorth, u.vEast = 0, 0
+}
+
+// rosterEntry is one user as listed by roster.
+type rosterEntry struct {
+	Id       string `json:"id"`
+	Located  bool   `json:"located"`
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+// roster lists every user sorted by id, whether or not they have a
+// location.
+func (m *manager) roster() []rosterEntry {
+	m.RLock()
+	defer m.RUnlock()
+
+	users := make([]rosterEntry, 0, len(m.users))
+
+	for _, u := range m.users {
+		e := rosterEntry{Id: u.id, Located: u.location != nil}
+		if !u.lastSeen.IsZero() {
+			e.LastSeen = u.lastSeen.Format(time.RFC3339)
+		}
+		users = append(users, e)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users
+}
+
+// known reports whether the user has been seen.
+func (m *manager) known(id string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	_, ok := m.users[id]
+	return ok
+}
+
+// lastKnownLocation returns the most recent ping of one of the user's
+// contacts, whether or not they are still sharing their location.
+func (m *manager) lastKnownLocation(id, contact string) (*fix, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok || !u.contacts[contact] || !m.shares(contact, id) {
+		return nil, false
+	}
+
+	c, ok := m.users[contact]
+	if !ok || c.lastKnown == nil {
+		return nil, false
+	}
+
+	f := *c.lastKnown
+	return &f, true
+}
+
+// contactSet applies op ("intersect", "union" or "diff") across the
+// contact sets of the known users in ids, returning the sorted result
+// and the ids which are not known users. diff is the first user's
+// contacts minus everyone else's.
+func (m *manager) contactSet(ids []string, op string) ([]string, []string) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var sets []map[string]bool
+	var unknown []string
+
+	for _, id := range ids {
+		u, ok := m.users[id]
+		if !ok {
+			unknown = append(unknown, id)
+			continue
+		}
+		sets = append(sets, u.contacts)
+	}
+
+	result := make(map[string]bool)
+
+	for i, set := range sets {
+		switch {
+		case i == 0 || op == "union":
+			for contact := range set {
+				result[contact] = true
+			}
+		case op == "intersect":
+			for contact := range result {
+				if !set[contact] {
+					delete(result, contact)
+				}
+			}
+		case op == "diff":
+			for contact := range set {
+				delete(result, contact)
+			}
+		}
+	}
+
+	contacts := make([]string, 0, len(result))
+	for contact := range result {
+		contacts = append(contacts, contact)
+	}
+	sort.Strings(contacts)
+
+	return contacts, unknown
+}
+
+// distanceTo returns the distance in metres from the query location to
+// p, combining the great-circle and vertical separation in altitude mode.
+func (q nearQuery) distanceTo(p *quadtree.Point) float64 {
+	x, y := p.Coordinates()
+	distance := haversine(q.lat, q.lon, x, y)
+
+	data, ok := p.Data().(*point)
+	if !q.altitude || !ok {
+		return distance
+	}
+
+	return math.Hypot(distance, data.alt-q.alt)
+}
+
+// nearContacts returns up to q.limit of the user's contacts within
+// q.distance metres of the query location, nearest first or, with
+// q.rank, best ranked first. KNearest
+// only walks the tree so many queries can share the read lock.
+func (m *manager) nearContacts(id string, q nearQuery) []nearContact {
+	defer func(start time.Time) {
+		defaultMetrics.observeNear(time.Since(start))
+	}(time.Now())
+
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.findNear(id, q)
+}
+
+// findNear does the work of nearContacts. Callers must hold the lock.
+func (m *manager) findNear(id string, q nearQuery) []nearContact {
+	contacts := []nearContact{}
+
+	u, ok := m.users[id]
+	if !ok || len(u.contacts) == 0 {
+		return contacts
+	}
+
+	c := u.contacts
+	g := u.groups[q.group]
+
+	// Filter to find users contacts
+	filter := func(p *quadtree.Point) bool {
+		data, ok := p.Data().(*point)
+		if !ok {
+			return false
+		}
+
+		if _, ok := c[data.id]; !ok {
+			return false
+		}
+
+		if len(q.group) > 0 && !g[data.id] {
+			return false
+		}
+
+		if !m.shares(data.id, id) {
+			return false
+		}
+
+		return q.distanceTo(p) <= q.distance
+	}
+
+	bb := boundingBox(q.lat, q.lon, q.distance)
+
+	// KNearest stops at the first matches it walks into, not the
+	// nearest, so gather more than asked for and keep the best
+	points := m.world.KNearest(bb, q.limit*max(nearCandidates, 1), filter)
+	now := m.now()
+
+	for _, p := range points {
+		data, ok := p.Data().(*point)
+		if !ok {
+			continue
+		}
+
+		if data.id == u.id {
+			continue
+		}
+
+		distance := q.distanceTo(p)
+		lat, lon := p.Coordinates()
+
+		contacts = append(contacts, nearContact{
+			Id:       data.id,
+			Distance: distance,
+			Accuracy: data.accuracy,
+			LastSeen: data.lastSeen.Format(time.RFC3339),
+			Presence: presence(data.lastSeen, now),
+			Score:    score(distance, now.Sub(data.lastSeen)),
+			Alt:      data.alt,
+			Bearing:  bearing(q.lat, q.lon, lat, lon),
+			Groups:   u.groupsWith(data.id),
+		})
+	}
+
+	// best ranked first if asked, then closest, then by id so the
+	// order is stable
+	sort.Slice(contacts, func(i, j int) bool {
+		if q.rank && contacts[i].Score != contacts[j].Score {
+			return contacts[i].Score > contacts[j].Score
+		}
+		if contacts[i].Distance != contacts[j].Distance {
+			return contacts[i].Distance < contacts[j].Distance
+		}
+		return contacts[i].Id < contacts[j].Id
+	})
+
+	if len(contacts) > q.limit {
+		contacts = contacts[:q.limit]
+	}
+
+	return contacts
+}
+
+// score ranks a contact distance metres away who last pinged age ago.
+// Closer is better and the score halves every rankHalfLife without a
+// ping, so a nearby contact who went quiet sinks below fresher ones.
+func score(distance float64, age time.Duration) float64 {
+	s := 1 / (1 + distance)
+	if rankHalfLife > 0 && age > 0 {
+		s *= math.Exp2(-age.Seconds() / rankHalfLife.Seconds())
+	}
+	return s
+}
+
+// pingNear finds the user's contacts near lat/lon after a ping and
+// which of them were not near at their last notify ping, remembering
+// the set for next time.
+func (m *manager) pingNear(id string, lat, lon float64) (near []string, newly []string) {
+	m.Lock()
+	defer m.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return []string{}, []string{}
+	}
+
+	q := nearQuery{lat: lat, lon: lon, distance: nearestDistance, limit: nearestContacts}
+
+	near, newly = []string{}, []string{}
+	now := make(map[string]bool)
+
+	for _, c := range m.findNear(id, q) {
+		near = append(near, c.Id)
+		if !u.notified[c.Id] {
+			newly = append(newly, c.Id)
+		}
+		now[c.Id] = true
+	}
+
+	u.notified = now
+
+	return near, newly
+}
+
+// located is a user found in the world.
+type located struct {
+	id                      string
+	lat, lon, alt, distance float64
+}
+
+// usersNear returns up to limit users within distance metres of
+// lat/lon who have not blocked viewer, closest first with ties broken
+// by id so pages of them are stable. The viewer is left out too when
+// excludeSelf is set. Everything is read under the lock.
+func (m *manager) usersNear(viewer string, lat, lon, distance float64, limit int, excludeSelf bool) []located {
+	m.RLock()
+	defer m.RUnlock()
+
+	// Filter to points within distance not hidden from viewer
+	filter := func(p *quadtree.Point) bool {
+		data, ok := p.Data().(*point)
+		if !ok || m.blocked(data.id, viewer) {
+			return false
+		}
+
+		if excludeSelf && data.id == viewer {
+			return false
+		}
+
+		x, y := p.Coordinates()
+		return haversine(lat, lon, x, y) <= distance
+	}
+
+	// as findNear, gather more than asked for and keep the nearest
+	points := m.world.KNearest(boundingBox(lat, lon, distance), limit*max(nearCandidates, 1), filter)
+
+	var all []located
+
+	for _, p := range points {
+		data, ok := p.Data().(*point)
+		if !ok {
+			continue
+		}
+
+		x, y := p.Coordinates()
+		all = append(all, located{data.id, x, y, data.alt, haversine(lat, lon, x, y)})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].distance != all[j].distance {
+			return all[i].distance < all[j].distance
+		}
+		return all[i].id < all[j].id
+	})
+
+	if len(all) > limit {
+		all = all[:limit]
+	}
+
+	return all
+}
+
+// nearbyUsers returns the ids of users within distance metres of
+// lat/lon who are not id or already its contacts, nearest first, for
+// finding people to send contact requests to. Hidden users are never in
+// the world and those who blocked id are skipped.
+func (m *manager) nearbyUsers(id string, lat, lon, distance float64) []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	var contacts map[string]bool
+	if u, ok := m.users[id]; ok {
+		contacts = u.contacts
+	}
+
+	filter := func(p *quadtree.Point) bool {
+		data, ok := p.Data().(*point)
+		if !ok || data.id == id || contacts[data.id] || m.blocked(data.id, id) {
+			return false
+		}
+
+		x, y := p.Coordinates()
+		return haversine(lat, lon, x, y) <= distance
+	}
+
+	// as findNear, gather more than are kept and keep the nearest
+	points := m.world.KNearest(boundingBox(lat, lon, distance), maxContacts*max(nearCandidates, 1), filter)
+
+	type candidate struct {
+		id       string
+		distance float64
+	}
+
+	found := make([]candidate, 0, len(points))
+	for _, p := range points {
+		x, y := p.Coordinates()
+		found = append(found, candidate{p.Data().(*point).id, haversine(lat, lon, x, y)})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].distance != found[j].distance {
+			return found[i].distance < found[j].distance
+		}
+		return found[i].id < found[j].id
+	})
+
+	if len(found) > maxContacts {
+		found = found[:maxContacts]
+	}
+
+	ids := make([]string, len(found))
+	for i, c := range found {
+		ids[i] = c.id
+	}
+
+	return ids
+}
+
+// presence is online when lastSeen is within presenceWindow of now.
+func presence(lastSeen, now time.Time) string {
+	if !lastSeen.IsZero() && now.Sub(lastSeen) <= presenceWindow {
+		return "online"
+	}
+	return "offline"
+}
+
+// contactPresence returns online or offline for each of id's contacts,
+// or false for an unknown user. Contacts id cannot see are offline.
+func (m *manager) contactPresence(id string) (map[string]string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, false
+	}
+
+	now := m.now()
+	status := make(map[string]string, len(u.contacts))
+
+	for contact := range u.contacts {
+		c, ok := m.users[contact]
+		if !ok || c.invisible || !m.shares(contact, id) {
+			status[contact] = "offline"
+			continue
+		}
+		status[contact] = presence(c.lastSeen, now)
+	}
+
+	return status, true
+}
+
+// unlocatedContacts returns the sorted contacts of id with no location
+// id can see: never pinged, expired, dark or hidden. Contacts who
+// haven't added id back, or have blocked them, are listed too so
+// neither looks any different.
+func (m *manager) unlocatedContacts(id string) []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	unlocated := []string{}
+
+	u, ok := m.users[id]
+	if !ok {
+		return unlocated
+	}
+
+	for contact := range u.contacts {
+		c, ok := m.users[contact]
+		if !ok || c.location == nil || c.invisible || !m.shares(contact, id) {
+			unlocated = append(unlocated, contact)
+		}
+	}
+	sort.Strings(unlocated)
+
+	return unlocated
+}
+
+// arrivingContacts returns the contacts of id whose current velocity
+// brings them to lat, lon within the window, soonest first.
+func (m *manager) arrivingContacts(id string, lat, lon float64, within time.Duration) []arrival {
+	m.RLock()
+	defer m.RUnlock()
+
+	var arrivals []arrival
+
+	u, ok := m.users[id]
+	if !ok {
+		return arrivals
+	}
+
+	for contact := range u.contacts {
+		c, ok := m.users[contact]
+		if !ok || c.location == nil || c.invisible || c.id == u.id || !m.shares(contact, u.id) {
+			continue
+		}
+
+		x, y := c.location.Coordinates()
+		north, east := offset(x, y, lat, lon)
+		distance := math.Hypot(north, east)
+		if distance == 0 {
+			continue
+		}
+
+		// speed along the line from the contact to the target
+		closing := (c.vNorth*north + c.vEast*east) / distance
+		if closing <= 0 {
+			continue
+		}
+
+		eta := distance / closing
+		if eta > within.Seconds() {
+			continue
+		}
+
+		arrivals = append(arrivals, arrival{Id: c.id, ETA: eta})
+	}
+
+	sort.Slice(arrivals, func(i, j int) bool {
+		return arrivals[i].ETA < arrivals[j].ETA
+	})
+
+	return arrivals
+}
+
+// updateLocation records a ping from outside any request, as applyUpdate.
+func (m *manager) updateLocation(id string, lat, lon, alt float64) error {
+	return m.applyUpdate(context.Background(), locationUpdate{id: id, lat: lat, lon: lon, alt: alt})
+}
+
+// applyUpdate records a single ping, sharing it with any other
+// instances once applied if others can see it.
+func (m *manager) applyUpdate(ctx context.Context, up locationUpdate) error {
+	m.Lock()
+	shared, err := m.move(ctx, up)
+	if err == nil {
+		persist(ctx, saveLocation(m.store, m.users[up.id]))
+	}
+	f := m.fanout
+	m.Unlock()
+
+	if shared && f != nil {
+		f.publish(up)
+	}
+
+	return err
+}
+
+// sync records a ping and replaces the user's contacts under one
+// write lock, then finds their contacts near the new location. Nothing
+// changes if the location is out of bounds.
+func (m *manager) sync(ctx context.Context, up locationUpdate, contacts []string, q nearQuery) (added, removed []string, near []nearContact, err error) {
+	contacts, err = normalizeIDs(contacts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	m.Lock()
+	if err = m.checkReplaceLimit(up.id, contacts); err != nil {
+		m.Unlock()
+		return nil, nil, nil, err
+	}
+	var shared bool
+	if shared, err = m.move(ctx, up); err == nil {
+		added, removed = m.replaceContacts(ctx, up.id, contacts)
+		near = m.findNear(up.id, q)
+
+		u := m.users[up.id]
+		persist(ctx, m.store.Batch(func(tx Store) error {
+			if err := saveLocation(tx, u); err != nil {
+				return err
+			}
+			return saveContacts(tx, u)
+		}))
+	}
+	f := m.fanout
+	m.Unlock()
+
+	if shared && f != nil {
+		f.publish(up)
+	}
+
+	return added, removed, near, err
+}
+
+// updateLocations applies a batch of pings under a single lock,
+// returning the error for each update in order (nil if it applied).
+func (m *manager) updateLocations(ctx context.Context, updates []locationUpdate) []error {
+	errs := make([]error, len(updates))
+	var applied, shared []locationUpdate
+
+	m.Lock()
+	for i, up := range updates {
+		var ok bool
+		if ok, errs[i] = m.move(ctx, up); errs[i] == nil {
+			applied = append(applied, up)
+		}
+		if ok {
+			shared = append(shared, up)
+		}
+	}
+	persist(ctx, m.store.Batch(func(tx Store) error {
+		for _, up := range applied {
+			if err := saveLocation(tx, m.users[up.id]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	f := m.fanout
+	m.Unlock()
+
+	if f != nil {
+		f.publish(shared...)
+	}
+
+	return errs
+}
+
+// move records a ping, reporting whether it moved a user others can
+// see and so may be shared with other instances. One less accurate than
+// maxAccuracy, or taken before the user's last, only joins the history,
+// and one from a dark user is dropped. Callers must hold the write lock.
+func (m *manager) move(ctx context.Context, up locationUpdate) (bool, error) {
+	id, lat, lon, alt := up.id, up.lat, up.lon, up.alt
+
+	lat, lon = snap(lat), snap(lon)
+
+	if !m.bounds.contains(lat, lon) {
+		return false, errOutOfBounds
+	}
+
+	// a ping is as of when it was taken, a little ahead of our clock
+	// being taken as now. That is only for history and ordering: the
+	// user is seen now, so an old timestamp doesn't expire them early.
+	now := m.now()
+	at := now
+	if !up.time.IsZero() {
+		switch {
+		case up.time.Sub(now) > maxClockSkew:
+			return false, errFutureTimestamp
+		case pingHorizon > 0 && now.Sub(up.time) > pingHorizon:
+			return false, errStaleTimestamp
+		case up.time.Before(now):
+			at = up.time
+		}
+	}
+
+	u := m.users[id]
+	if u == nil {
+		logger.InfoContext(ctx, "new user", "event", "new_user", "user_id", id, "lat", lat, "lon", lon)
+		u = newUser(id)
+		m.users[id] = u
+	}
+
+	if u.dark {
+		return false, nil
+	}
+
+	u.trail.add(fix{lat: lat, lon: lon, alt: alt, accuracy: up.accuracy, time: at}, historySize)
+
+	if maxAccuracy > 0 && up.accuracy > maxAccuracy {
+		logger.DebugContext(ctx, "coarse ping", "event", "coarse_ping", "user_id", id, "accuracy", up.accuracy)
+		return false, nil
+	}
+
+	// a late ping, e.g. buffered offline, must not move the user back
+	// to where they were before their latest one
+	if at.Before(u.taken) {
+		logger.DebugContext(ctx, "late ping", "event", "late_ping", "user_id", id, "timestamp", at)
+		return false, nil
+	}
+
+	if !u.invisible {
+		u.lastKnown = &fix{lat: lat, lon: lon, alt: alt, accuracy: up.accuracy, time: at}
+	}
+
+	m.checkFences(ctx, u, lat, lon, at)
+
+	if u.location == nil {
+		u.location = quadtree.NewPoint(lat, lon, &point{id: id, alt: alt, accuracy: up.accuracy, lastSeen: now})
+		u.lastSeen, u.taken = now, at
+		if !u.invisible {
+			m.world.Insert(u.location)
+		}
+		m.notifyNear(u, nil)
+		return !u.invisible, nil
+	}
+
+	data := u.location.Data().(*point)
+	data.alt = alt
+	data.accuracy = up.accuracy
+	data.lastSeen = now
+
+	x, y := u.location.Coordinates()
+
+	if secs := at.Sub(u.taken).Seconds(); secs > 0 {
+		north, east := offset(x, y, lat, lon)
+		u.vNorth, u.vEast = north/secs, east/secs
+	}
+	u.lastSeen, u.taken = now, at
+
+	if x == lat && y == lon {
+		// no change but when they were last seen
+		return !u.invisible, nil
+	}
+
+	logger.InfoContext(ctx, "user moved", "event", "ping", "user_id", id, "lat", lat, "lon", lon)
+	// swap the point rather than Update so u.location is always
+	// the point held by the world, unless invisible
+	location := quadtree.NewPoint(lat, lon, data)
+	m.world.Remove(u.location)
+	if !u.invisible {
+		m.world.Insert(location)
+	}
+	prev := u.location
+	u.location = location
+
+	m.notifyNear(u, prev)
+
+	return !u.invisible, nil
+}
+
+type locationUpdate struct {
+	id                      string
+	lat, lon, alt, accuracy float64
+	time                    time.Time // when the ping was taken, zero for now
+
+	// set instead of a location for a change such as going dark,
+	// shared with other instances as one of the state constants
+	state string
+}
+
+type nearContact struct {
+	Id       string  `json:"id"`
+	Distance float64 `json:"distance_m"`
+	Accuracy float64 `json:"accuracy_m,omitempty"`
+	LastSeen string  `json:"last_seen"`
+	Presence string  `json:"presence"`
+	Score    float64 `json:"score"`
+	Alt      float64 `json:"alt"`
+	Bearing  float64 `json:"bearing_deg"`
+
+	// the user's groups the contact is in, a contact in several is
+	// still listed once
+	Groups []string `json:"groups,omitempty"`
+
+	// the distance again in the unit the request asked for
+	InUnit *float64 `json:"distance,omitempty"`
+}
+
+type arrival struct {
+	Id  string  `json:"id"`
+	ETA float64 `json:"eta_s"`
+}
+
+type location struct {
+	Lat *float64 `json:"lat"`
+	Lon *float64 `json:"lon"`
+	Alt *float64 `json:"alt"`
+}
+
+type allRequest struct {
+	Id        string    `json:"id"`
+	Distance  *float64  `json:"distance"`
+	NumPoints *float64  `json:"num_points"`
+	Location  *location `json:"location"`
+	Unit      string    `json:"unit"`
+	Limit     *int      `json:"limit"`
+	Offset    *int      `json:"offset"`
+
+	// leave the user named by id out of the results
+	ExcludeSelf bool `json:"exclude_self"`
+}
+
+// allUser is one user in a /_all response.
+type allUser struct {
+	Id  string  `json:"id"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	Alt float64 `json:"alt"`
+}
+
+type contactRequest struct {
+	Id       string   `json:"id"`
+	Contacts []string `json:"contacts"`
+}
+
+type pingRequest struct {
+	Id       string    `json:"id"`
+	Location *location `json:"location"`
+	Accuracy *float64  `json:"accuracy"`
+
+	// answer with the contacts now near, not for bulk pings
+	Notify bool `json:"notify"`
+
+	// when the ping was taken, now if not given
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+// time is when the ping was taken, zero for now.
+func (req *pingRequest) time() time.Time {
+	if req.Timestamp == nil {
+		return time.Time{}
+	}
+	return *req.Timestamp
+}
+
+// accuracy is the ping's accuracy radius in metres, 0 if not given.
+func (req *pingRequest) accuracy() (float64, error) {
+	if req.Accuracy == nil {
+		return 0, nil
+	}
+	if *req.Accuracy < 0 || math.IsNaN(*req.Accuracy) || math.IsInf(*req.Accuracy, 0) {
+		return 0, errors.New("accuracy must be a positive number of metres")
+	}
+	return *req.Accuracy, nil
+}
+
+type bulkPingRequest struct {
+	Updates []pingRequest `json:"updates"`
+}
+
+type bulkPingResult struct {
+	Id    string `json:"id"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type nearRequest struct {
+	Id        string    `json:"id"`
+	Location  *location `json:"location"`
+	Distance  *float64  `json:"distance"`
+	Unit      string    `json:"unit"`
+	NumPoints *int      `json:"num_points"`
+	Verbose   bool      `json:"verbose"`
+	Altitude  bool      `json:"altitude"`
+
+	// also list contacts with no known location
+	IncludeUnknown bool `json:"include_unknown"`
+
+	// also record location as a ping first, POST only
+	Update bool `json:"update"`
+
+	// only contacts in this group
+	Group string `json:"group"`
+}
+
+type syncRequest struct {
+	Id       string    `json:"id"`
+	Location *location `json:"location"`
+	Contacts []string  `json:"contacts"`
+	Verbose  bool      `json:"verbose"`
+}
+
+type nearbyRequest struct {
+	Id       string    `json:"id"`
+	Location *location `json:"location"`
+	Distance *float64  `json:"distance"`
+	Unit     string    `json:"unit"`
+}
+
+type contactPairRequest struct {
+	Id      string `json:"id"`
+	Contact string `json:"contact"`
+}
+
+type visibilityRequest struct {
+	Id      string `json:"id"`
+	Visible *bool  `json:"visible"`
+}
+
+type geofenceRequest struct {
+	Id       string    `json:"id"`
+	Location *location `json:"location"`
+	Radius   *float64  `json:"radius"`
+	Label    string    `json:"label"`
+
+	// instead of location and radius
+	Polygon []location `json:"polygon"`
+}
+
+// vertices is the polygon as lat, lon pairs. Only for a valid request.
+func (req *geofenceRequest) vertices() [][2]float64 {
+	polygon := make([][2]float64, len(req.Polygon))
+	for i, v := range req.Polygon {
+		polygon[i] = [2]float64{*v.Lat, *v.Lon}
+	}
+	return polygon
+}
+
+type blockRequest struct {
+	Id     string `json:"id"`
+	Target string `json:"target"`
+}
+
+type contactConfirmRequest struct {
+	Id      string `json:"id"`
+	Contact string `json:"contact"`
+	Reject  bool   `json:"reject"`
+}
+
+type contactOpsRequest struct {
+	Ids         []string `json:"ids"`
+	Op          string   `json:"op"`
+	SkipUnknown bool     `json:"skip_unknown"`
+}
+
+type idRequest struct {
+	Id string `json:"id"`
+}
+
+type arrivingRequest struct {
+	Id       string    `json:"id"`
+	Location *location `json:"location"`
+	Within   *float64  `json:"within"`
+}
+
+// decodeRequest reads a POST body into v writing a 400 on failure.
+// With -strict-json any field not declared on v is rejected.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return false
+	}
+
+	dec := json.NewDecoder(r.Body)
+	if strictJSON {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(v)
+	if err != nil {
+		badBody(w, err)
+		return false
+	}
+
+	return true
+}
+
+// badBody writes a 413 for a body cut off by withBodyLimit, otherwise
+// a 400 saying what was wrong with it.
+func badBody(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, fmt.Sprintf("Request Entity Too Large. Body is over %d bytes.", maxErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	http.Error(w, "Bad Request. "+decodeError(err), http.StatusBadRequest)
+}
+
+// paths left to run as long as they like, the websocket can't be
+// buffered and profiles are taken over a period
+func longLived(path string) bool {
+	return path == "/subscribe" || strings.HasPrefix(path, "/debug/pprof/")
+}
+
+// withTimeout answers a 503 for requests running longer than d, slow
+// queries and slow clients alike. A d of 0 or less never times out.
+func withTimeout(d time.Duration, h http.Handler) http.Handler {
+	if d <= 0 {
+		return h
+	}
+
+	th := http.TimeoutHandler(h, d, "Service Unavailable. Request timed out.")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if longLived(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		th.ServeHTTP(w, r)
+	})
+}
+
+// withBodyLimit stops reading request bodies after n bytes, so one
+// client can't exhaust memory with a huge body.
+func withBodyLimit(n int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// queryDecoder is a request which can also be read from a GET query.
+type queryDecoder interface {
+	fromQuery(q url.Values) error
+}
+
+// decodeQuery reads v from the query string of a GET or the body of a
+// POST writing a 400 on failure, or a 405 for any other method.
+func decodeQuery(w http.ResponseWriter, r *http.Request, v queryDecoder) bool {
+	switch r.Method {
+	case "GET":
+		if err := v.fromQuery(r.URL.Query()); err != nil {
+			http.Error(w, "Bad Request. "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+		return true
+	case "POST":
+		return decodeRequest(w, r, v)
+	}
+
+	methodNotAllowed(w, "GET", "POST")
+	return false
+}
+
+// methodNotAllowed writes a 405 naming the methods which are.
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "Method Not Allowed. Use "+strings.Join(methods, " or ")+".", http.StatusMethodNotAllowed)
+}
+
+// queryFloat parses the named query value, nil when it is absent.
+func queryFloat(q url.Values, key string) (*float64, error) {
+	s := q.Get(key)
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s, expected number got %q.", key, s)
+	}
+
+	return &f, nil
+}
+
+// queryInt parses the named query value, nil when it is absent.
+func queryInt(q url.Values, key string) (*int, error) {
+	s := q.Get(key)
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s, expected integer got %q.", key, s)
+	}
+
+	return &i, nil
+}
+
+// queryBool parses the named query value, false when it is absent.
+func queryBool(q url.Values, key string) (bool, error) {
+	s := q.Get(key)
+	if len(s) == 0 {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s, expected bool got %q.", key, s)
+	}
+
+	return b, nil
+}
+
+// queryLocation reads lat, lon and alt, nil when none are given.
+func queryLocation(q url.Values) (*location, error) {
+	var l location
+	var err error
+
+	if l.Lat, err = queryFloat(q, "lat"); err != nil {
+		return nil, err
+	}
+	if l.Lon, err = queryFloat(q, "lon"); err != nil {
+		return nil, err
+	}
+	if l.Alt, err = queryFloat(q, "alt"); err != nil {
+		return nil, err
+	}
+
+	if l.Lat == nil && l.Lon == nil && l.Alt == nil {
+		return nil, nil
+	}
+
+	return &l, nil
+}
+
+func (req *allRequest) fromQuery(q url.Values) (err error) {
+	req.Id = q.Get("id")
+	if req.Location, err = queryLocation(q); err != nil {
+		return err
+	}
+	if req.Distance, err = queryFloat(q, "distance"); err != nil {
+		return err
+	}
+	req.Unit = q.Get("unit")
+	if req.NumPoints, err = queryFloat(q, "num_points"); err != nil {
+		return err
+	}
+	if req.Limit, err = queryInt(q, "limit"); err != nil {
+		return err
+	}
+	if req.Offset, err = queryInt(q, "offset"); err != nil {
+		return err
+	}
+	req.ExcludeSelf, err = queryBool(q, "exclude_self")
+	return err
+}
+
+func (req *nearRequest) fromQuery(q url.Values) (err error) {
+	req.Id = q.Get("id")
+	if req.Location, err = queryLocation(q); err != nil {
+		return err
+	}
+	if req.Distance, err = queryFloat(q, "distance"); err != nil {
+		return err
+	}
+	req.Unit = q.Get("unit")
+	if req.NumPoints, err = queryInt(q, "num_points"); err != nil {
+		return err
+	}
+	if req.Verbose, err = queryBool(q, "verbose"); err != nil {
+		return err
+	}
+	if req.Altitude, err = queryBool(q, "altitude"); err != nil {
+		return err
+	}
+	req.Group = q.Get("group")
+	req.IncludeUnknown, err = queryBool(q, "include_unknown")
+	return err
+}
+
+func (req *arrivingRequest) fromQuery(q url.Values) (err error) {
+	req.Id = q.Get("id")
+	if req.Location, err = queryLocation(q); err != nil {
+		return err
+	}
+	req.Within, err = queryFloat(q, "within")
+	return err
+}
+
+// decodeError describes why a request body failed to decode, naming
+// the offending field where there is one.
+func decodeError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case err == io.EOF:
+		return "Empty body."
+	case err == io.ErrUnexpectedEOF:
+		return "Malformed JSON, unexpected end of body."
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("Malformed JSON at offset %d.", syntaxErr.Offset)
+	case errors.As(err, &typeErr) && len(typeErr.Field) == 0:
+		return "Body must be a JSON object."
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("Invalid %s, expected %s got %s.", typeErr.Field, typeErr.Type, typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "Unexpected field " + strings.TrimPrefix(err.Error(), "json: unknown field ") + "."
+	}
+
+	return "Failed to unmarshal request."
+}
+
+// writeJSON writes v as a 200 JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v as a JSON response with the given status.
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Internal Server Error. Could not marshal response.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	_, err = w.Write(b)
+	if err != nil {
+		logger.Warn("could not write response", "event", "write_error", "error", err)
+	}
+}
+
+// ack acknowledges a write which has nothing else to say.
+func ack(w http.ResponseWriter) {
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+// unitScale returns the metres in a request's distance unit, metres
+// when none is given, writing a 400 for an unknown one.
+func unitScale(w http.ResponseWriter, unit string) (float64, bool) {
+	if len(unit) == 0 {
+		return 1, true
+	}
+
+	scale, ok := units[unit]
+	if !ok {
+		http.Error(w, "Bad Request. unit must be m, km or mi.", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return scale, true
+}
+
+// coordinates returns the lat/lon of a request location writing a 400
+// if either is missing or invalid.
+func coordinates(w http.ResponseWriter, l *location) (float64, float64, bool) {
+	lat, lon, err := l.coordinates()
+	if err != nil {
+		http.Error(w, "Bad Request. "+err.Error()+".", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	return lat, lon, true
+}
+
+// coordinates returns the validated lat/lon of a request location.
+func (l *location) coordinates() (float64, float64, error) {
+	if l == nil {
+		return 0, 0, errors.New("Could not find location")
+	}
+
+	if l.Lat == nil {
+		return 0, 0, errors.New("Could not parse latitude")
+	}
+
+	if l.Lon == nil {
+		return 0, 0, errors.New("Could not parse longitude")
+	}
+
+	err := validateCoords(*l.Lat, *l.Lon)
+	if err != nil {
+		return 0, 0, errors.New("Invalid location, " + err.Error())
+	}
+
+	return *l.Lat, *l.Lon, nil
+}
+
+// altitude returns the request altitude or 0 if not given.
+func (l *location) altitude() float64 {
+	if l == nil || l.Alt == nil {
+		return 0
+	}
+	return *l.Alt
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (m *manager) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	if !m.isReady() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"loading"}`))
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "ready"})
+}
+
+func (m *manager) allHandler(w http.ResponseWriter, r *http.Request) {
+	var req allRequest
+	if !decodeQuery(w, r, &req) {
+		return
+	}
+
+	if len(req.Id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	if req.Distance == nil {
+		http.Error(w, "Bad Request. Could not find distance.", http.StatusBadRequest)
+		return
+	}
+
+	if req.NumPoints == nil {
+		http.Error(w, "Bad Request. Could not find num_points.", http.StatusBadRequest)
+		return
+	}
+
+	// written so NaN from a query fails too
+	if n := *req.NumPoints; !(n >= 1 && n <= float64(maxContacts)) {
+		http.Error(w, fmt.Sprintf("Bad Request. num_points must be between 1 and %d.", maxContacts), http.StatusBadRequest)
+		return
+	}
+
+	lat, lon, ok := coordinates(w, req.Location)
+	if !ok {
+		return
+	}
+
+	scale, ok := unitScale(w, req.Unit)
+	if !ok {
+		return
+	}
+
+	all := m.usersNear(req.Id, lat, lon, *req.Distance*scale, int(*req.NumPoints), req.ExcludeSelf)
+
+	start, end, ok := pageBounds(w, len(all), req.Limit, req.Offset)
+	if !ok {
+		return
+	}
+
+	page := all[start:end]
+
+	var users interface{}
+
+	if allMap {
+		byID := make(map[string]map[string]float64)
+		for _, f := range page {
+			byID[f.id] = map[string]float64{"lat": f.lat, "lon": f.lon, "alt": f.alt}
+		}
+		users = byID
+	} else {
+		list := make([]allUser, 0, len(page))
+		for _, f := range page {
+			list = append(list, allUser{Id: f.id, Lat: f.lat, Lon: f.lon, Alt: f.alt})
+		}
+		users = list
+	}
+
+	if req.Limit == nil && req.Offset == nil {
+		writeJSON(w, users)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"users":       users,
+		"total":       len(all),
+		"next_offset": nextOffset(end, len(all)),
+	})
+}
+
+// pageBounds returns the start and end of the page of n items picked
+// by limit and offset, either of which may be nil, writing a 400 for
+// bad values.
+func pageBounds(w http.ResponseWriter, n int, limit, offset *int) (int, int, bool) {
+	start, end := 0, n
+
+	if offset != nil {
+		if *offset < 0 {
+			http.Error(w, "Bad Request. offset must not be negative.", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		start = min(*offset, end)
+	}
+
+	if limit != nil {
+		if *limit < 1 {
+			http.Error(w, "Bad Request. limit must be positive.", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		end = min(start+*limit, end)
+	}
+
+	return start, end, true
+}
+
+// nextOffset is where the page after one ending at end starts, nil
+// (null) on the last page.
+func nextOffset(end, n int) *int {
+	if end < n {
+		return &end
+	}
+	return nil
+}
+
+func (m *manager) usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	q := r.URL.Query()
+
+	limit, err := queryInt(q, "limit")
+	if err != nil {
+		http.Error(w, "Bad Request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == nil {
+		n := rosterPage
+		limit = &n
+	}
+
+	offset, err := queryInt(q, "offset")
+	if err != nil {
+		http.Error(w, "Bad Request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	all := m.roster()
+
+	start, end, ok := pageBounds(w, len(all), limit, offset)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"users":       all[start:end],
+		"total":       len(all),
+		"next_offset": nextOffset(end, len(all)),
+	})
+}
+
+func (m *manager) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	writeJSON(w, m.stats())
+}
+
+func (m *manager) resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+
+	m.reset(r.Context())
+
+	ack(w)
+}
+
+func (m *manager) contactHandler(w http.ResponseWriter, r *http.Request) {
+	var req contactRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	added, skipped, err := m.addContacts(r.Context(), req.Id, req.Contacts)
+	if err != nil {
+		contactsFailed(w, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"added":   added,
+		"skipped": skipped,
+	}
+
+	writeJSON(w, response)
+}
+
+// contactsFailed writes a 409 with the user's count and the limit when
+// contacts would go over it, otherwise a 400.
+func contactsFailed(w http.ResponseWriter, err error) {
+	var limitErr *contactLimitError
+	if errors.As(err, &limitErr) {
+		writeJSONStatus(w, http.StatusConflict, map[string]interface{}{
+			"error": "too_many_contacts",
+			"count": limitErr.count,
+			"limit": limitErr.limit,
+		})
+		return
+	}
+
+	http.Error(w, "Bad Request. Contact ids must not be empty.", http.StatusBadRequest)
+}
+
+func (m *manager) setContactsHandler(w http.ResponseWriter, r *http.Request) {
+	var req contactRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	added, removed, err := m.setContacts(r.Context(), req.Id, req.Contacts)
+	if err != nil {
+		contactsFailed(w, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"added":   added,
+		"removed": removed,
+	}
+
+	writeJSON(w, response)
+}
+
+func (m *manager) listContactsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	contacts, ok := m.contactsFor(id)
+	if !ok {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"contacts": contacts,
+	}
+
+	writeJSON(w, response)
+}
+
+func (m *manager) mutualContactsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	contacts, ok := m.mutualContacts(id)
+	if !ok {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"contacts": contacts,
+	}
+
+	writeJSON(w, response)
+}
+
+func (m *manager) contactCountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	count, ok := m.contactCount(id)
+	if !ok {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, map[string]int{"count": count})
+}
+
+func (m *manager) followersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{
+		"followers": m.contactsOf(id),
+	}
+
+	writeJSON(w, response)
+}
+
+func (m *manager) requestContactHandler(w http.ResponseWriter, r *http.Request) {
+	var req contactPairRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	err := m.requestContact(r.Context(), req.Id, req.Contact)
+	if err != nil {
+		http.Error(w, "Bad Request. Cannot request yourself as a contact.", http.StatusBadRequest)
+		return
+	}
+
+	ack(w)
+}
+
+func (m *manager) confirmContactHandler(w http.ResponseWriter, r *http.Request) {
+	var req contactConfirmRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	ok, err := m.confirmContact(r.Context(), req.Id, req.Contact, !req.Reject)
+	if err != nil {
+		contactsFailed(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Not Found. No pending request from contact.", http.StatusNotFound)
+		return
+	}
+
+	ack(w)
+}
+
+func (m *manager) removeContactHandler(w http.ResponseWriter, r *http.Request) {
+	var req contactRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	ok, err := m.removeContacts(r.Context(), req.Id, req.Contacts)
+	if err != nil {
+		contactsFailed(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
+	}
+
+	ack(w)
+}
+
+func (m *manager) contactOpsHandler(w http.ResponseWriter, r *http.Request) {
+	var req contactOpsRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if len(req.Ids) == 0 {
+		http.Error(w, "Bad Request. Could not find ids.", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Op {
+	case "intersect", "union", "diff":
+	default:
+		http.Error(w, "Bad Request. op must be one of intersect, union or diff.", http.StatusBadRequest)
+		return
+	}
+
+	contacts, unknown := m.contactSet(req.Ids, req.Op)
+	if len(unknown) > 0 && !req.SkipUnknown {
+		http.Error(w, "Not Found. Unknown user "+unknown[0]+".", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"contacts": contacts,
+	}
+
+	if req.SkipUnknown {
+		response["unknown"] = unknown
+	}
+
+	writeJSON(w, response)
+}
+
+// allowPing takes one of id's pings, writing a 429 when they are out.
+func (m *manager) allowPing(w http.ResponseWriter, id string) bool {
+	ok, wait := m.pings.allow(id)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too Many Requests. Slow down pings.", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+func (m *manager) pingHandler(w http.ResponseWriter, r *http.Request) {
+	var req pingRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	if !m.allowPing(w, req.Id) {
+		return
+	}
+
+	lat, lon, ok := coordinates(w, req.Location)
+	if !ok {
+		return
+	}
+
+	accuracy, err := req.accuracy()
+	if err != nil {
+		http.Error(w, "Bad Request. accuracy must be a positive number of metres.", http.StatusBadRequest)
+		return
+	}
+
+	err = m.applyUpdate(r.Context(), locationUpdate{
+		id:       req.Id,
+		lat:      lat,
+		lon:      lon,
+		alt:      req.Location.altitude(),
+		accuracy: accuracy,
+		time:     req.time(),
+	})
+	switch err {
+	case nil:
+	case errFutureTimestamp:
+		validationFailed(w, fieldErrors{"timestamp": "must not be ahead of the server by more than " + maxClockSkew.String()})
+		return
+	case errStaleTimestamp:
+		validationFailed(w, fieldErrors{"timestamp": "must not be older than " + pingHorizon.String()})
+		return
+	default:
+		http.Error(w, "Bad Request. Location is out of bounds.", http.StatusBadRequest)
+		return
+	}
+
+	if !req.Notify {
+		ack(w)
+		return
+	}
+
+	near, newly := m.pingNear(req.Id, lat, lon)
+
+	writeJSON(w, map[string]interface{}{
+		"ok":         true,
+		"near":       near,
+		"newly_near": newly,
+	})
+}
+
+func (m *manager) bulkPingHandler(w http.ResponseWriter, r *http.Request) {
+	var req bulkPingRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
+
+	results := make([]bulkPingResult, len(req.Updates))
+
+	// entries that parse are applied together, keeping their position
+	var updates []locationUpdate
+	var index []int
+
+	for i, up := range req.Updates {
+		results[i].Id = up.Id
+
+		if len(up.Id) == 0 {
+			results[i].Error = "Could not find id"
+			continue
+		}
+
+		// each entry is a ping, against its own user's limit
+		if ok, _ := m.pings.allow(up.Id); !ok {
+			results[i].Error = errTooManyPings.Error()
+			continue
+		}
+
+		lat, lon, err := up.Location.coordinates()
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		accuracy, err := up.accuracy()
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		updates = append(updates, locationUpdate{id: up.Id, lat: lat, lon: lon, alt: up.Location.altitude(), accuracy: accuracy, time: up.time()})
+		index = append(index, i)
+	}
+
+	for i, err := range m.updateLocations(r.Context(), updates) {
+		if err != nil {
+			results[index[i]].Error = err.Error()
+			continue
+		}
+		results[index[i]].Ok = true
+	}
+
+	response := map[string]interface{}{
+		"results": results,
+	}
+
+	writeJSON(w, response)
+}
+
+func (m *manager) nearHandler(w http.ResponseWriter, r *http.Request) {
+	var req nearRequest
+	if !decodeQuery(w, r, &req) {
+		return
+	}
+
+	if len(req.Id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	lat, lon, ok := coordinates(w, req.Location)
+	if !ok {
+		return
+	}
+
+	scale, ok := unitScale(w, req.Unit)
+	if !ok {
+		return
+	}
+
+	q := nearQuery{
+		lat:      lat,
+		lon:      lon,
+		distance: nearestDistance,
+		limit:    nearestContacts,
+		altitude: req.Altitude,
+		group:    req.Group,
+		rank:     req.Verbose,
+	}
+
+	if req.Distance != nil {
+		if *req.Distance <= 0 {
+			http.Error(w, "Bad Request. distance must be positive.", http.StatusBadRequest)
+			return
+		}
+		q.distance = *req.Distance * scale
+	}
+
+	if req.NumPoints != nil {
+		if *req.NumPoints < 1 || *req.NumPoints > maxContacts {
+			http.Error(w, fmt.Sprintf("Bad Request. num_points must be between 1 and %d.", maxContacts), http.StatusBadRequest)
+			return
+		}
+		q.limit = *req.NumPoints
+	}
+
+	if req.Altitude {
+		if req.Location.Alt == nil {
+			http.Error(w, "Bad Request. Could not find altitude.", http.StatusBadRequest)
+			return
+		}
+		q.alt = *req.Location.Alt
+	}
+
+	// a user who was never seen is unknown, one with nobody near is not;
+	// an update makes them known
+	if !req.Update && !m.known(req.Id) {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
+	}
+
+	if len(req.Group) > 0 && !m.hasGroup(req.Id, req.Group) {
+		http.Error(w, "Not Found. Unknown group.", http.StatusNotFound)
+		return
+	}
+
+	// /near only reads unless asked to move the user too, done last so
+	// a request that fails leaves them where they were
+	if req.Update {
+		if !m.allowPing(w, req.Id) {
+			return
+		}
+
+		err := m.applyUpdate(r.Context(), locationUpdate{id: req.Id, lat: lat, lon: lon, alt: req.Location.altitude()})
+		if err != nil {
+			http.Error(w, "Bad Request. Location is out of bounds.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	contacts := m.nearContacts(req.Id, q)
+
+	response := map[string]interface{}{
+		"contacts": contacts,
+	}
+
+	if len(req.Unit) > 0 {
+		for i := range contacts {
+			d := contacts[i].Distance / scale
+			contacts[i].InUnit = &d
+		}
+		response["unit"] = req.Unit
+	}
+
+	if !req.Verbose {
+		ids := []string{}
+		for _, contact := range contacts {
+			ids = append(ids, contact.Id)
+		}
+		response["contacts"] = ids
 	}
 
-	x, y := u.location.Coordinates()
-	if x == lat && y == lon {
-		// no change
-		return
+	if req.IncludeUnknown {
+		response["unlocated"] = m.unlocatedContacts(req.Id)
 	}
 
-	log.Printf("user %s at %f, %f", id, lat, lon)
-	location := quadtree.NewPoint(lat, lon, nil)
-	m.world.Update(u.location, location)
+	writeJSON(w, response)
 }
 
-func allHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Bad Request. Non POST", http.StatusBadRequest)
+func (m *manager) syncHandler(w http.ResponseWriter, r *http.Request) {
+	var req syncRequest
+	if !decodeValid(w, r, &req) {
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Bad Request. Could not read body.", http.StatusBadRequest)
+	if !m.allowPing(w, req.Id) {
 		return
 	}
 
-	var data map[string]interface{}
-	err = json.Unmarshal(b, &data)
-	if err != nil {
-		http.Error(w, "Bad Request. Failed to unmarshal request.", http.StatusBadRequest)
+	lat, lon, ok := coordinates(w, req.Location)
+	if !ok {
 		return
 	}
 
-	_, ok := data["id"].(string)
-	if !ok {
-		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+	up := locationUpdate{id: req.Id, lat: lat, lon: lon, alt: req.Location.altitude()}
+	q := nearQuery{lat: lat, lon: lon, distance: nearestDistance, limit: nearestContacts, rank: req.Verbose}
+
+	added, removed, contacts, err := m.sync(r.Context(), up, req.Contacts, q)
+	if err == errOutOfBounds {
+		http.Error(w, "Bad Request. Location is out of bounds.", http.StatusBadRequest)
 		return
 	}
-
-	distance, ok := data["distance"].(float64)
-	if !ok {
-		http.Error(w, "Bad Request. Could not find distance.", http.StatusBadRequest)
+	if err != nil {
+		contactsFailed(w, err)
 		return
 	}
 
-	numPoints, ok := data["num_points"].(float64)
-	if !ok {
-		http.Error(w, "Bad Request. Could not find num_points.", http.StatusBadRequest)
+	response := map[string]interface{}{
+		"added":    added,
+		"removed":  removed,
+		"contacts": contacts,
+	}
+
+	if !req.Verbose {
+		ids := []string{}
+		for _, contact := range contacts {
+			ids = append(ids, contact.Id)
+		}
+		response["contacts"] = ids
+	}
+
+	writeJSON(w, response)
+}
+
+func (m *manager) nearbyHandler(w http.ResponseWriter, r *http.Request) {
+	var req nearbyRequest
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	location, ok := data["location"].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Bad Request. Could not find location.", http.StatusBadRequest)
+	if len(req.Id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
 		return
 	}
 
-	lat, ok := location["lat"].(float64)
+	lat, lon, ok := coordinates(w, req.Location)
 	if !ok {
-		http.Error(w, "Bad Request. Could not parse latitude.", http.StatusBadRequest)
 		return
 	}
 
-	lon, ok := location["lon"].(float64)
+	scale, ok := unitScale(w, req.Unit)
 	if !ok {
-		http.Error(w, "Bad Request. Could not parse longitude.", http.StatusBadRequest)
 		return
 	}
 
-	// Filter to find users contacts
-	filter := func(p *quadtree.Point) bool {
-		return true
+	distance := nearestDistance
+	if req.Distance != nil {
+		if *req.Distance <= 0 {
+			http.Error(w, "Bad Request. distance must be positive.", http.StatusBadRequest)
+			return
+		}
+		distance = *req.Distance * scale
 	}
 
-	ax := quadtree.NewPoint(lat, lon, nil) // center
-	bx := ax.HalfPoint(distance)    // top right
-	bb := quadtree.NewAABB(ax, bx)
-
-	points := defaultManager.world.KNearest(bb, int(numPoints), filter)
-
-	users := make(map[string]map[string]float64)
+	response := map[string]interface{}{
+		"users": m.nearbyUsers(req.Id, lat, lon, distance),
+	}
 
-	for _, point := range points {
-		id, ok := point.Data().(string)
-		if !ok {
-			continue
-		}
+	writeJSON(w, response)
+}
 
-		lat, lon := point.Coordinates()
-		users[id] = map[string]float64{"lat": lat, "lon": lon}
+func (m *manager) presenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
 	}
 
-	b, err = json.Marshal(users)
-	if err != nil {
-		http.Error(w, "Internal Server Error. Could not marshal response.", http.StatusInternalServerError)
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
 		return
 	}
 
-	_, err = w.Write(b)
-	if err != nil {
-		http.Error(w, "Internal Server Error. Could not write response.", http.StatusInternalServerError)
+	status, ok := m.contactPresence(id)
+	if !ok {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
 		return
 	}
+
+	writeJSON(w, map[string]interface{}{"presence": status})
 }
 
-func contactHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Bad Request. Non POST", http.StatusBadRequest)
+func (m *manager) visibilityHandler(w http.ResponseWriter, r *http.Request) {
+	var req visibilityRequest
+	if !decodeValid(w, r, &req) {
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Bad Request. Could not read body.", http.StatusBadRequest)
+	if !m.setVisibility(r.Context(), req.Id, *req.Visible) {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
 		return
 	}
 
-	var data map[string]interface{}
-	err = json.Unmarshal(b, &data)
-	if err != nil {
-		http.Error(w, "Bad Request. Failed to unmarshal request.", http.StatusBadRequest)
-		return
-	}
+	ack(w)
+}
 
-	id, ok := data["id"].(string)
-	if !ok {
-		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+func (m *manager) blockHandler(w http.ResponseWriter, r *http.Request) {
+	var req blockRequest
+	if !decodeValid(w, r, &req) {
 		return
 	}
 
-	icontacts, ok := data["contacts"].([]interface{})
-	if !ok {
-		http.Error(w, "Bad Request. Could not find contacts.", http.StatusBadRequest)
-		return
-	}
+	m.block(r.Context(), req.Id, req.Target)
 
-	var contacts []string
+	ack(w)
+}
 
-	for _, contact := range icontacts {
-		c, ok := contact.(string)
-		if !ok {
-			http.Error(w, "Bad Request. Failed to parse contacts.", http.StatusBadRequest)
-			return
-		}
+func (m *manager) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req idRequest
+	if !decodeValid(w, r, &req) {
+		return
+	}
 
-		contacts = append(contacts, c)
+	if !m.removeUser(r.Context(), req.Id) {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
+		return
 	}
 
-	defaultManager.addContacts(id, contacts)
+	ack(w)
 }
 
-func pingHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Bad Request. Non POST", http.StatusBadRequest)
+func (m *manager) goDarkHandler(w http.ResponseWriter, r *http.Request) {
+	var req idRequest
+	if !decodeValid(w, r, &req) {
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Bad Request. Could not read body.", http.StatusBadRequest)
+	if !m.goDark(r.Context(), req.Id) {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
 		return
 	}
 
-	var data map[string]interface{}
-	err = json.Unmarshal(b, &data)
-	if err != nil {
-		http.Error(w, "Bad Request. Failed to unmarshal request.", http.StatusBadRequest)
-		return
-	}
+	ack(w)
+}
 
-	id, ok := data["id"].(string)
-	if !ok {
-		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+func (m *manager) goLiveHandler(w http.ResponseWriter, r *http.Request) {
+	var req idRequest
+	if !decodeValid(w, r, &req) {
 		return
 	}
 
-	location, ok := data["location"].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Bad Request. Could not find location.", http.StatusBadRequest)
+	if !m.goLive(r.Context(), req.Id) {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
 		return
 	}
 
-	lat, ok := location["lat"].(float64)
-	if !ok {
-		http.Error(w, "Bad Request. Could not parse latitude.", http.StatusBadRequest)
+	ack(w)
+}
+
+func (m *manager) offlineHandler(w http.ResponseWriter, r *http.Request) {
+	var req idRequest
+	if !decodeValid(w, r, &req) {
 		return
 	}
 
-	lon, ok := location["lon"].(float64)
-	if !ok {
-		http.Error(w, "Bad Request. Could not parse longitude.", http.StatusBadRequest)
+	if !m.goOffline(r.Context(), req.Id) {
+		http.Error(w, "Not Found. Unknown user.", http.StatusNotFound)
 		return
 	}
 
-	defaultManager.updateLocation(id, lat, lon)
+	ack(w)
 }
 
-func nearHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Bad Request. Non POST", http.StatusBadRequest)
+func (m *manager) lastKnownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Bad Request. Could not read body.", http.StatusBadRequest)
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
 		return
 	}
 
-	var data map[string]interface{}
-	err = json.Unmarshal(b, &data)
-	if err != nil {
-		http.Error(w, "Bad Request. Failed to unmarshal request.", http.StatusBadRequest)
+	contact := r.URL.Query().Get("contact")
+	if len(contact) == 0 {
+		http.Error(w, "Bad Request. Could not find contact.", http.StatusBadRequest)
 		return
 	}
 
-	id, ok := data["id"].(string)
+	f, ok := m.lastKnownLocation(id, contact)
 	if !ok {
-		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		http.Error(w, "Not Found. No known location.", http.StatusNotFound)
 		return
 	}
 
-	location, ok := data["location"].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Bad Request. Could not find location.", http.StatusBadRequest)
+	response := map[string]interface{}{
+		"id":        contact,
+		"location":  map[string]float64{"lat": f.lat, "lon": f.lon, "alt": f.alt},
+		"last_seen": f.time.Format(time.RFC3339),
+	}
+
+	writeJSON(w, response)
+}
+
+func (m *manager) arrivingHandler(w http.ResponseWriter, r *http.Request) {
+	var req arrivingRequest
+	if !decodeQuery(w, r, &req) {
 		return
 	}
 
-	lat, ok := location["lat"].(float64)
-	if !ok {
-		http.Error(w, "Bad Request. Could not parse latitude.", http.StatusBadRequest)
+	if len(req.Id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
 		return
 	}
 
-	lon, ok := location["lon"].(float64)
+	lat, lon, ok := coordinates(w, req.Location)
 	if !ok {
-		http.Error(w, "Bad Request. Could not parse longitude.", http.StatusBadRequest)
 		return
 	}
 
-	contacts := defaultManager.nearContacts(id, lat, lon)
+	within := arrivalWindow
+	if req.Within != nil {
+		if *req.Within <= 0 {
+			http.Error(w, "Bad Request. within must be positive.", http.StatusBadRequest)
+			return
+		}
+		within = time.Duration(*req.Within * float64(time.Second))
+	}
+
+	arrivals := m.arrivingContacts(req.Id, lat, lon, within)
 
 	response := map[string]interface{}{
-		"contacts": contacts,
+		"contacts": arrivals,
 	}
 
-	b, err = json.Marshal(response)
-	if err != nil {
-		http.Error(w, "Internal Server Error. Could not marshal contacts.", http.StatusInternalServerError)
-		return
+	writeJSON(w, response)
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, append([]interface{}{"event", "fatal"}, args...)...)
+	os.Exit(1)
+}
+
+// listenAddr picks the address to serve on. An explicitly set -addr
+// wins over the env value, which wins over the default.
+func listenAddr(addr string, set bool, env string) (string, error) {
+	if !set && len(env) > 0 {
+		addr = env
 	}
 
-	_, err = w.Write(b)
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		http.Error(w, "Internal Server Error. Could not write response.", http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port in address %q", addr)
 	}
+
+	return addr, nil
 }
 
-func main() {
+// redirectHandler sends plain http requests to the same url over
+// https on the port of addr.
+func redirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if len(port) > 0 && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// newRouter registers every route on a fresh mux bound to m.
+func newRouter(m *manager) http.Handler {
+	mux := http.NewServeMux()
+
+	// Liveness And Readiness
+	mux.HandleFunc("/health", instrument("/health", healthHandler))
+	mux.HandleFunc("/ready", instrument("/ready", m.readyHandler))
+
 	// Add Contacts
-	http.HandleFunc("/contacts", contactHandler)
+	mux.HandleFunc("/contacts", instrument("/contacts", m.contactHandler))
+
+	// Replace Contacts
+	mux.HandleFunc("/contacts/set", instrument("/contacts/set", m.setContactsHandler))
+
+	// List Contacts
+	mux.HandleFunc("/contacts/list", instrument("/contacts/list", m.listContactsHandler))
+
+	// List Contacts Who Have The User Back
+	mux.HandleFunc("/contacts/mutual", instrument("/contacts/mutual", m.mutualContactsHandler))
+
+	// Count Contacts
+	mux.HandleFunc("/contacts/count", instrument("/contacts/count", m.contactCountHandler))
+
+	// Find Who Has A User As A Contact
+	mux.HandleFunc("/followers", instrument("/followers", m.followersHandler))
+
+	// Request And Confirm Mutual Contacts
+	mux.HandleFunc("/contacts/request", instrument("/contacts/request", m.requestContactHandler))
+	mux.HandleFunc("/contacts/confirm", instrument("/contacts/confirm", m.confirmContactHandler))
+
+	// Remove Contacts
+	mux.HandleFunc("/contacts/remove", instrument("/contacts/remove", m.removeContactHandler))
+
+	// Combine Contact Lists
+	mux.HandleFunc("/contacts/ops", instrument("/contacts/ops", m.contactOpsHandler))
+
+	// Group Contacts
+	mux.HandleFunc("/groups", instrument("/groups", m.groupsHandler))
 
 	// Update Location
-	http.HandleFunc("/ping", pingHandler)
+	mux.HandleFunc("/ping", instrument("/ping", m.pingHandler))
+
+	// Update Many Locations At Once
+	mux.HandleFunc("/ping/bulk", instrument("/ping/bulk", m.bulkPingHandler))
 
 	// Find Nearby Contacts
-	http.HandleFunc("/near", nearHandler)
+	mux.HandleFunc("/near", instrument("/near", m.nearHandler))
+
+	// Ping, Replace Contacts And Find Nearby In One Go
+	mux.HandleFunc("/sync", instrument("/sync", m.syncHandler))
+
+	// Which Contacts Are Active
+	mux.HandleFunc("/presence", instrument("/presence", m.presenceHandler))
+
+	// Find People Nearby To Add
+	mux.HandleFunc("/nearby", instrument("/nearby", m.nearbyHandler))
+
+	// Ghost Mode
+	mux.HandleFunc("/visibility", instrument("/visibility", m.visibilityHandler))
+
+	// Block A User
+	mux.HandleFunc("/block", instrument("/block", m.blockHandler))
+
+	// Delete User
+	mux.HandleFunc("/user/delete", instrument("/user/delete", m.deleteUserHandler))
+
+	// Stop And Resume Sharing Location
+	mux.HandleFunc("/go-dark", instrument("/go-dark", m.goDarkHandler))
+	mux.HandleFunc("/go-live", instrument("/go-live", m.goLiveHandler))
+
+	// Log Out, Sharing Again From The Next Ping
+	mux.HandleFunc("/offline", instrument("/offline", m.offlineHandler))
+
+	// Find Contacts Heading This Way
+	mux.HandleFunc("/arriving", instrument("/arriving", m.arrivingHandler))
+
+	// Recent Movement
+	mux.HandleFunc("/history", instrument("/history", m.historyHandler))
+
+	// Find Where A Contact Was Last Seen
+	mux.HandleFunc("/last-known", instrument("/last-known", m.lastKnownHandler))
+
+	// Geofences
+	mux.HandleFunc("/geofence", instrument("/geofence", m.geofenceHandler))
+	mux.HandleFunc("/geofence/events", instrument("/geofence/events", m.geofenceEventsHandler))
+
+	// Proximity Notifications
+	mux.HandleFunc("/subscribe", instrument("/subscribe", m.subscribeHandler))
+
+	// Metrics
+	mux.HandleFunc("/metrics", m.metricsHandler)
 
 	// Find Nearby Contacts
-	http.HandleFunc("/_all", allHandler)
+	mux.HandleFunc("/_all", instrument("/_all", m.allHandler))
+
+	// List Every User
+	mux.HandleFunc("/_users", instrument("/_users", m.usersHandler))
+
+	// Tree Size
+	mux.HandleFunc("/_stats", instrument("/_stats", m.statsHandler))
+
+	// Wipe Everything
+	mux.HandleFunc("/_reset", instrument("/_reset", m.resetHandler))
+
+	// Synthetic Users For Testing
+	mux.HandleFunc("/_inject", instrument("/_inject", m.injectHandler))
+	mux.HandleFunc("/_clear", instrument("/_clear", m.clearHandler))
+
+	// Dry Run Validation
+	mux.HandleFunc("/validate/", instrument("/validate/", validateHandler))
+
+	// Runtime Profiles
+	if pprofEnabled {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return withIdempotency(m.replays, mux)
+}
+
+func main() {
+	flag.StringVar(&listen, "addr", listen, "Address to listen on, falls back to $REMINDME_ADDR")
+	flag.BoolVar(&strictJSON, "strict-json", strictJSON, "Reject requests containing unknown JSON fields")
+	flag.Int64Var(&maxBodyBytes, "max-body", maxBodyBytes, "Largest request body in bytes, larger ones get a 413")
+	flag.IntVar(&gzipMinBytes, "gzip-min-bytes", gzipMinBytes, "Gzip JSON responses of at least this many bytes for clients accepting it, 0 never compresses")
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "Longest a request may run before a 503, 0 for no limit")
+	flag.BoolVar(&allMap, "all-map", allMap, "Answer /_all with the old object keyed by user id instead of an array")
+	flag.IntVar(&apiVersion, "api-version", apiVersion, "Response format, 2 wraps every response in {data, error} with error objects, 1 answers as before")
+	flag.BoolVar(&pprofEnabled, "pprof", pprofEnabled, "Serve runtime profiles under /debug/pprof/ to the admin key")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "TLS certificate file, serves HTTPS along with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "TLS private key file, serves HTTPS along with -tls-cert")
+	flag.StringVar(&redirectAddr, "redirect-addr", redirectAddr, "Address to redirect plain HTTP to HTTPS from when serving TLS")
+	flag.DurationVar(&locationTTL, "location-ttl", locationTTL, "Forget locations not updated for this long, 0 to keep forever")
+	flag.StringVar(&statePath, "state", statePath, "File to load users from at startup and save them to on shutdown")
+	flag.StringVar(&dbPath, "db", dbPath, "SQLite database every change to users is written to and loaded from at startup, instead of -state")
+	flag.StringVar(&apiKeys, "api-keys", apiKeys, "File of user API keys, one per line, each optionally followed by its tenant, falls back to $REMINDME_API_KEYS")
+	flag.StringVar(&adminKey, "admin-key", adminKey, "API key for admin endpoints such as /_all, falls back to $REMINDME_ADMIN_KEY")
+	flag.Float64Var(&pingRate, "ping-rate", pingRate, "Pings a second each user may send, by any route, 0 for no limit")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", idempotencyTTL, "How long a POST response is replayed to retries with the same Idempotency-Key, 0 ignores the header")
+	flag.IntVar(&idempotencyMax, "idempotency-max", idempotencyMax, "Most POST responses each app keeps for retries, the least recently used are dropped first, 0 for no limit")
+	flag.IntVar(&pingBurst, "ping-burst", pingBurst, "Pings a user may send in a burst above -ping-rate")
+	flag.Float64Var(&ipRate, "ip-rate", ipRate, "Requests a second each client address may send, 0 for no limit")
+	flag.IntVar(&ipBurst, "ip-burst", ipBurst, "Requests a client address may send in a burst above -ip-rate")
+	flag.TextVar(&trustedProxies, "trusted-proxies", trustedProxies, "Comma separated CIDRs or addresses of proxies whose X-Forwarded-For and X-Real-IP are believed")
+	flag.IntVar(&historySize, "history", historySize, "Pings kept per user for /history, 0 to keep none")
+	flag.Float64Var(&maxAccuracy, "max-accuracy", maxAccuracy, "Pings with a coarser accuracy radius in metres are kept in history but not shared, 0 for no limit")
+	flag.DurationVar(&nearDebounce, "near-debounce", nearDebounce, "How long /subscribe holds near alerts to send them as one batch, 0 sends each at once")
+	flag.Float64Var(&nearMargin, "near-margin", nearMargin, "Fraction beyond the near distance a contact must move before a subscriber is alerted to them again")
+	flag.IntVar(&coordPrecision, "coord-precision", coordPrecision, "Decimal places pinged coordinates are rounded to, so smaller jitter is not a move, -1 keeps them as sent")
+	flag.DurationVar(&maxClockSkew, "max-clock-skew", maxClockSkew, "How far ahead of the server a ping's timestamp may be before it is rejected")
+	flag.DurationVar(&pingHorizon, "ping-horizon", pingHorizon, "Pings with a timestamp older than this are rejected, 0 for no limit")
+	flag.IntVar(&nearCandidates, "near-candidates", nearCandidates, "Points /near, /_all and /nearby gather for each one asked for, ranking them all before keeping the best, 1 keeps the first found")
+	flag.IntVar(&contactLimit, "contact-limit", contactLimit, "Most contacts one user may have, 0 for no limit")
+	flag.DurationVar(&presenceWindow, "presence-window", presenceWindow, "Contacts who pinged within this long are shown online")
+	flag.DurationVar(&rankHalfLife, "rank-half-life", rankHalfLife, "Verbose near contacts rank half as high for each this long since their last ping, 0 ranks by distance alone")
+	flag.StringVar(&natsURL, "nats-url", natsURL, "NATS server to share pings with other instances through, none to run alone")
+	flag.StringVar(&natsSubject, "nats-subject", natsSubject, "NATS subject pings are shared on")
+	flag.IntVar(&fanoutBuffer, "nats-buffer", fanoutBuffer, "Pings held while NATS is unreachable or users are being restored, the oldest dropped past this")
+	flag.TextVar(&worldBounds, "bounds", worldBounds, "Box pings must fall in as minLat,minLon,maxLat,maxLon, smaller for a single region")
+	flag.IntVar(&treeCapacity, "tree-capacity", treeCapacity, "Points a quadtree node holds before splitting")
+	flag.TextVar(logLevel, "log-level", logLevel, "Lowest level to log: debug, info, warn or error")
+	flag.Parse()
+
+	var addrSet bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "addr" {
+			addrSet = true
+		}
+	})
+
+	addr, err := listenAddr(listen, addrSet, os.Getenv("REMINDME_ADDR"))
+	if err != nil {
+		fatal("bad -addr or REMINDME_ADDR", "error", err)
+	}
+
+	if (len(tlsCert) > 0) != (len(tlsKey) > 0) {
+		fatal("both -tls-cert and -tls-key are required to serve HTTPS")
+	}
+
+	if apiVersion != 1 && apiVersion != 2 {
+		fatal("-api-version must be 1 or 2", "api_version", apiVersion)
+	}
+
+	users, err := loadKeys(apiKeys, os.Getenv("REMINDME_API_KEYS"))
+	if err != nil {
+		fatal("could not load -api-keys", "path", apiKeys, "error", err)
+	}
+
+	if len(adminKey) == 0 {
+		adminKey = os.Getenv("REMINDME_ADMIN_KEY")
+	}
+
+	if _, ok := users[adminKey]; ok {
+		fatal("the admin key must differ from every user key")
+	}
+
+	keys := &keyring{users: users, admin: adminKey}
+
+	// the quadtree has one capacity for every world, so it is set here
+	// once before any is made and never while one is in use
+	if treeCapacity > 0 {
+		quadtree.Capacity = treeCapacity
+	}
+
+	// the default app's manager, built once flags are parsed and the
+	// only one loaded from and saved to -state or -db
+	defaultManager := newManager()
+	apps := newTenants(defaultManager)
+	if keys.enabled() {
+		apps.allowed = keys.tenants()
+	}
+
+	if len(dbPath) > 0 {
+		if len(statePath) > 0 {
+			fatal("use one of -state or -db")
+		}
+
+		store, err := openSQLStore(dbPath)
+		if err != nil {
+			fatal("could not open database", "path", dbPath, "error", err)
+		}
+		defaultManager.store = store
+	}
+	go apps.sweepEvery(time.Minute)
+
+	ipLimits := newLimiter(ipRate, ipBurst)
+	go ipLimits.sweepEvery(time.Minute)
+
+	var nb *natsBroker
+	if len(natsURL) > 0 {
+		nb, err = newNATSBroker(natsURL)
+		if err != nil {
+			fatal("could not connect to NATS", "url", natsURL, "error", err)
+		}
+
+		// a random origin so this instance skips its own pings
+		_, err = apps.share(nb, natsSubject, newRequestID())
+		if err != nil {
+			fatal("could not subscribe to NATS", "subject", natsSubject, "error", err)
+		}
+	}
+
+	// outermost last
+	var h http.Handler = apps
+	h = withBodyLimit(maxBodyBytes, h)
+	h = withTimeout(requestTimeout, h)
+	h = withAuth(keys, h)
+	h = withIPLimit(ipLimits, h)
+	h = withEnvelope(apiVersion, h)
+	h = withGzip(gzipMinBytes, h)
+	h = withRequestID(h)
+	h = withClientIP(trustedProxies, h)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: requestTimeout,
+	}
+
+	// load the pair up front so a bad cert fails before serving
+	if len(tlsCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			fatal("could not load TLS certificate and key", "cert", tlsCert, "key", tlsKey, "error", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	var redirect *http.Server
+	if len(tlsCert) > 0 && len(redirectAddr) > 0 {
+		redirect = &http.Server{Addr: redirectAddr, Handler: redirectHandler(srv.Addr)}
+
+		go func() {
+			err := redirect.ListenAndServe()
+			if err != http.ErrServerClosed {
+				fatal("listen failed", "error", err)
+			}
+		}()
+	}
+
+	go func() {
+		var err error
+		if len(tlsCert) > 0 {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("listen failed", "error", err)
+		}
+	}()
+
+	// load after listening so /health answers while /ready says 503
+	if len(statePath) > 0 {
+		err := defaultManager.Load(statePath)
+		if err != nil {
+			fatal("could not load state", "path", statePath, "error", err)
+		}
+	}
+	if len(dbPath) > 0 {
+		err := defaultManager.restore()
+		if err != nil {
+			fatal("could not load database", "path", dbPath, "error", err)
+		}
+	}
+	defaultManager.setReady()
+
+	if locationTTL > 0 {
+		go apps.expireEvery(locationTTL, locationTTL/10)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("shutting down", "event", "shutdown", "signal", (<-ch).String())
 
-	err := http.ListenAndServe(":9999", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+
+	err = srv.Shutdown(ctx)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		logger.Error("shutdown failed", "event", "shutdown", "error", err)
+	}
+	logger.Info("server stopped", "event", "shutdown")
+
+	if nb != nil {
+		nb.Close()
+	}
+
+	if len(statePath) > 0 {
+		err := defaultManager.Save(statePath)
+		if err != nil {
+			fatal("could not save state", "path", statePath, "error", err)
+		}
+		logger.Info("saved state", "event", "save", "path", statePath)
+	}
+
+	if err := defaultManager.store.Close(); err != nil {
+		logger.Error("could not close store", "event", "shutdown", "error", err)
 	}
 }
 
 /*
-	POST /contacts -- add contact to a users contact list
+	POST /contacts -- add contact to a users contact list, ids are trimmed and repeats dropped, an empty one is a 422
+	contacts are one sided until the contact adds user_id back, or confirms a /contacts/request, and until then neither finds the other
+	a user_id in its own contacts is ignored, neither added nor skipped
+	a batch taking the user past -contact-limit adds nothing and is a 409: {error: too_many_contacts, count: contacts now, limit: n}
+	request: {id: user_id, contacts: [ contact1, contact2, ... ]}
+	response: {added: n, skipped: [ contact_already_added, ... ]}
+
+	POST /contacts/set -- replace a users contacts with exactly this list, normalized and limited as for /contacts
+	request: {id: user_id, contacts: [ contact1, contact2, ... ]}
+	response: {added: [ contact2, ... ], removed: [ contact_no_longer_listed, ... ]}
+
+	GET /contacts/list?id=user_id -- a users contacts, sorted
+	response: {contacts: [ contact1, contact2, ... ]}
+
+	GET /contacts/mutual?id=user_id -- a users contacts who have user_id as a contact too, sorted
+	response: {contacts: [ contact1, contact2, ... ]}
+
+	GET /contacts/count?id=user_id -- how many contacts a user has, for badges
+	response: {count: n}
+
+	GET /followers?id=user_id -- users who have user_id as a contact, scans every user
+	response: {followers: [ user1, user2, ... ]}
+
+	POST /contacts/request -- ask another user to become a mutual contact
+	request: {id: user_id, contact: contact_id}
+
+	POST /contacts/confirm -- accept (or reject) a contact request, making both contacts
+	request: {id: user_id, contact: requester_id, reject: bool}
+	accepting past -contact-limit for either user is a 409 as for /contacts and leaves the request pending
+
+	POST /contacts/remove -- remove contacts from a users contact list, ids are trimmed and repeats dropped as for /contacts
 	request: {id: user_id, contacts: [ contact1, contact2, ... ]}
 
-	POST /ping -- update user location
-	request: {id: user_id, location: {lat: lat, lon: lon, alt: altitude}}
+	POST /groups -- add contacts to one of a users groups, e.g. family or work, creating it if need be
+	request: {id: user_id, group: name, contacts: [ contact1, contact2, ... ]}
 
-	POST /near -- get nearby contacts
-	request: {id: user_id, location: {lat: lat, lon: lon, alt: altitude}}
-	response: [ contact1, contact2, ... ]
+	GET /groups?id=user_id -- a users groups and their members
+	response: {groups: {name: [ contact1, contact2, ... ], ... }}
+
+	POST /ping -- update user location, 429 with Retry-After when sent faster than -ping-rate
+	request: {id: user_id, location: {lat: lat, lon: lon, alt: altitude}, accuracy: metres, notify: bool, timestamp: RFC 3339 time}
+	a ping with accuracy coarser than -max-accuracy only joins the history
+	timestamp is when the ping was taken, default now; one ahead by more than -max-clock-skew or older than -ping-horizon is a 422
+	it orders the ping in history, but the user counts as seen now for presence and -ttl
+	a ping older than the users last only joins the history, it never moves them back
+	with notify: {ok: true, near: [ contact1, contact2 ], newly_near: [ contact2 ]}, contacts near now and those not near at the last notify ping
+
+	POST /ping/bulk -- apply many location updates at once, e.g. buffered while offline
+	request: {updates: [ {id: user_id, location: {lat: lat, lon: lon, alt: altitude}, timestamp: RFC 3339 time}, ... ]}
+	response: {results: [ {id: user_id, ok: bool, error: reason}, ... ]}
+	each entry counts against its users -ping-rate, one over it fails alone
+
+	POST /near -- get nearby contacts of a location, never moving the user unless update is set
+	request: {id: user_id, location: {lat: lat, lon: lon, alt: altitude}, distance: metres, unit: m|km|mi, num_points: n, verbose: bool, altitude: bool, include_unknown: bool, update: bool, group: name}
+	response: {contacts: [ contact1, contact2, ... ]}
+	verbose response: {contacts: [ {id: contact1, distance_m: metres, accuracy_m: metres if known, last_seen: time of last ping, presence: online|offline, score: rank, alt: altitude, bearing_deg: degrees clockwise from north, groups: [ name, ... ] if in any}, ... ]}
+	bearing_deg is the initial great circle bearing from the location to the contact, 0 to 360
+	nearest first, then by id; verbose contacts best ranked first, score is 1 / (1 + distance_m) halved for every -rank-half-life since last_seen
+	contacts who have never pinged have no location and are left out
+	a user_id never seen is a 404, a known user with nobody near gets an empty list
+	with a unit the response carries it and each verbose contact adds distance: in that unit
+	with update: the location is first recorded as a ping from user_id, as POST /ping
+	with include_unknown: also {unlocated: [ contact3, ... ]}, contacts with no location to show
+	with group: only contacts in that group, 404 for a group the user does not have
+	verbose contacts list every group of the user they are in, a contact in several groups appears once
+
+	GET /near?id=user_id&lat=lat&lon=lon&alt=altitude&distance=metres&unit=m|km|mi&num_points=n&verbose=bool&altitude=bool&include_unknown=bool&group=name -- as POST /near, without update
+
+	POST /sync -- on app open, ping, replace contacts as /contacts/set and get nearby contacts, all at once
+	request: {id: user_id, location: {lat: lat, lon: lon, alt: altitude}, contacts: [ contact1, contact2, ... ], verbose: bool}
+	response: {added: [ ... ], removed: [ ... ], contacts: [ contact1, ... ] as POST /near}
+
+	GET /presence?id=user_id -- whether each contact pinged within -presence-window
+	response: {presence: {contact1: online, contact2: offline, ... }}
+
+	POST /nearby -- users near a location who are not yet contacts, nearest first, to send requests to
+	request: {id: user_id, location: {lat: lat, lon: lon}, distance: metres, unit: m|km|mi}
+	response: {users: [ user1, user2, ... ]}
+
+	POST /arriving -- get contacts heading towards a location
+	request: {id: user_id, location: {lat: lat, lon: lon}, within: seconds}
+	response: {contacts: [ {id: contact1, eta_s: seconds}, ... ]}
+
+	GET /arriving?id=user_id&lat=lat&lon=lon&within=seconds -- as POST /arriving
+
+	GET /history?id=user_id -- the users last -history pings, oldest first
+	response: {history: [ {lat: lat, lon: lon, accuracy_m: metres if known, time: time}, ... ]}
+
+	POST /go-dark -- stop sharing location, clearing movement history
+	request: {id: user_id}
+
+	POST /go-live -- resume sharing location from the next ping
+	request: {id: user_id}
+
+	POST /offline -- log out, leaving the world until the next ping, contacts and history are kept
+	request: {id: user_id}
+
+	GET /last-known?id=user_id&contact=contact_id -- last ping of a contact, even if dark
+	response: {id: contact_id, location: {lat: lat, lon: lon, alt: altitude}, last_seen: time}
+
+	POST /contacts/ops -- intersect, union or diff the contact lists of several users
+	request: {ids: [ user1, user2, ... ], op: intersect|union|diff, skip_unknown: bool}
+	response: {contacts: [ contact1, contact2, ... ], unknown: [ user3, ... ]}
+
+	POST /visibility -- ghost mode, hide from discovery while still pinging
+	request: {id: user_id, visible: bool}
+
+	POST /block -- never show user_id to target, in /near, /_all or anywhere else
+	request: {id: user_id, target: target_id}
+
+	POST /user/delete -- remove a user, their location and them from all contact lists
+	request: {id: user_id}
+
+	POST /validate/{endpoint} -- check a body for a write endpoint such as /validate/ping without applying it, same 400 and 422 errors
+	response: {valid: true, request: {...}}, the request as the endpoint would see it, contacts deduplicated and coordinates rounded
+
+	GET /health -- liveness, always {status: ok}
+
+	GET /ready -- readiness, 503 until startup loading is done
+
+	GET /metrics -- request counts, nearContacts latency, shared pings by result (applied, buffered, duplicate, retried, dropped), NATS reconnects and tracked users for Prometheus
+
+	POST /geofence -- remind user_id on entering radius metres of a location, replaces any fence with the same label
+	request: {id: user_id, location: {lat: lat, lon: lon}, radius: metres, label: label}
+	or a polygon instead, vertices in order, at least 3 and no edges crossing, the first may be repeated to close it
+	request: {id: user_id, polygon: [ {lat: lat, lon: lon}, ... ], label: label}
+
+	GET /geofence/events?id=user_id -- fences entered since the last poll, oldest first
+	response: {events: [ {type: enter, label: label, lat: lat, lon: lon, time: time}, ... ]}
+
+	GET /subscribe?id=user_id -- websocket, pushed whenever a contact moves within range or the user enters a geofence
+	message: {type: near, id: contact_id, distance_m: metres}
+	message: {type: enter, fence: label, distance_m: metres from the centre}
+	with &debounce=duration, e.g. 5s, near messages are held that long from the first and sent as one, default -near-debounce
+	message: {type: near_batch, contacts: [ {type: near, id: contact_id, distance_m: metres}, ... ]}
+
+	POST /_all -- admin, every visible user within distance of a location, nearest num_points of them
+	request: {id: user_id, location: {lat: lat, lon: lon}, distance: metres, unit: m|km|mi, num_points: n, limit: n, offset: n, exclude_self: bool}
+	response: [ {id: user_id, lat: lat, lon: lon, alt: altitude}, ... ], nearest first then by id, see -all-map
+	paged response, with limit or offset: {users: [ {id: user_id, lat: lat, lon: lon, alt: altitude}, ... ], total: n, next_offset: n or null}
+	pages are taken nearest first, GET /_all?id=...&lat=...&limit=n&offset=n works too
+	user_id is listed like anyone else unless exclude_self is set
+	num_points is 1 to 100, anything else is a 400
+
+	GET /_users?limit=n&offset=n -- admin, every user by id, located or not, 100 to a page by default
+	response: {users: [ {id: user_id, located: bool, last_seen: time of last ping if any}, ... ], total: n, next_offset: n or null}
+
+	GET /_stats -- admin, counts of users and of the points they hold in the quadtree
+	response: {users: n, points: n, invisible: n, dark: n}
+
+	POST /_reset -- admin, forget every user, for test and staging
+
+	POST /_inject -- admin, put synthetic users at any location as if they had pinged there, for test and staging
+	request: {users: [ {id: user_id, lat: lat, lon: lon}, ... ]}
+	response: {results: [ {id: user_id, ok: bool, error: reason}, ... ]}
+	each entry counts against its users -ping-rate, one over it fails alone
+	an id which belongs to a real user is refused, injected users are shared over NATS like any ping
+
+	POST /_clear -- admin, remove every user added with /_inject from this instance
+	response: {removed: [ user_id, ... ]}
 */
 
 /*
 func test() {
-	b, _ := ioutil.ReadFile("tube.csv")
+	b, _ := os.ReadFile("tube.csv")
 	lines := strings.Split(string(b), "\n")
 
 	points := make(map[string]*quadtree.Point)
@@ -476,4 +3848,3 @@ func test() {
 	}
 }
 */
-
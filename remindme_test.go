@@ -0,0 +1,4789 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asim/quadtree"
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	// keep test output to failures
+	logLevel.Set(slog.LevelError)
+	os.Exit(m.Run())
+}
+
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// pointsNear returns the ids of every point in the world within
+// distance metres of lat/lon.
+func pointsNear(m *manager, lat, lon, distance float64) []string {
+	var ids []string
+	all := func(p *quadtree.Point) bool { return true }
+	for _, p := range m.world.KNearest(boundingBox(lat, lon, distance), 100, all) {
+		ids = append(ids, p.Data().(*point).id)
+	}
+	return ids
+}
+
+func TestAddContacts(t *testing.T) {
+	testData := []struct {
+		name     string
+		existing []string
+		contacts []string
+		added    int
+		skipped  []string
+		stored   []string
+		err      error
+	}{
+		{"new user", nil, []string{"b", "c"}, 2, []string{}, []string{"b", "c"}, nil},
+		{"existing contacts", []string{"b"}, []string{"b", "c"}, 1, []string{"b"}, []string{"b", "c"}, nil},
+		{"repeated in request", nil, []string{"b", "b"}, 1, []string{}, []string{"b"}, nil},
+		{"nothing new", []string{"b", "c"}, []string{"c", "b"}, 0, []string{"c", "b"}, []string{"b", "c"}, nil},
+		{"whitespace", []string{"b"}, []string{" b", "c\t", " c "}, 1, []string{"b"}, []string{"b", "c"}, nil},
+		{"empty", []string{"b"}, []string{"c", "", "d"}, 0, nil, []string{"b"}, errEmptyID},
+		{"blank", nil, []string{"  "}, 0, nil, nil, errEmptyID},
+		{"self", nil, []string{"a", "b", " a"}, 1, []string{}, []string{"b"}, nil},
+	}
+
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			m := newManager()
+			if d.existing != nil {
+				m.addContacts(context.Background(), "a", d.existing)
+			}
+
+			added, skipped, err := m.addContacts(context.Background(), "a", d.contacts)
+			if err != d.err {
+				t.Errorf("got error %v, want %v", err, d.err)
+			}
+			if added != d.added {
+				t.Errorf("added %d, want %d", added, d.added)
+			}
+			if !reflect.DeepEqual(skipped, d.skipped) {
+				t.Errorf("skipped %v, want %v", skipped, d.skipped)
+			}
+
+			contacts, _ := m.contactsFor("a")
+			if !reflect.DeepEqual(contacts, d.stored) {
+				t.Errorf("stored %v, want %v", contacts, d.stored)
+			}
+		})
+	}
+}
+
+func TestContactLimit(t *testing.T) {
+	defer func(n int) { contactLimit = n }(contactLimit)
+	contactLimit = 3
+
+	r := newRouter(newManager())
+
+	steps := []struct {
+		path string
+		body string
+		code int
+		want string
+	}{
+		{"/contacts", `{"id":"a","contacts":["b","c","a"]}`, 200, `{"added":2,"skipped":[]}`},
+		{"/contacts", `{"id":"a","contacts":["c","d"]}`, 200, `{"added":1,"skipped":["c"]}`},
+		{"/contacts", `{"id":"a","contacts":["e"]}`, 409, `{"count":3,"error":"too_many_contacts","limit":3}`},
+		{"/contacts", `{"id":"a","contacts":["b"]}`, 200, `{"added":0,"skipped":["b"]}`},
+		{"/contacts/set", `{"id":"a","contacts":["a","b","c","e"]}`, 200, `{"added":["e"],"removed":["d"]}`},
+		{"/contacts/set", `{"id":"a","contacts":["b","c","d","e"]}`, 409, `{"count":3,"error":"too_many_contacts","limit":3}`},
+		// confirming counts against both, and the request stays
+		{"/contacts/request", `{"id":"f","contact":"a"}`, 200, `{"ok":true}`},
+		{"/contacts/confirm", `{"id":"a","contact":"f"}`, 409, `{"count":3,"error":"too_many_contacts","limit":3}`},
+		{"/contacts/request", `{"id":"a","contact":"g"}`, 200, `{"ok":true}`},
+		{"/contacts/confirm", `{"id":"g","contact":"a"}`, 409, `{"count":3,"error":"too_many_contacts","limit":3}`},
+		{"/contacts/remove", `{"id":"a","contacts":["e"]}`, 200, `{"ok":true}`},
+		{"/contacts/confirm", `{"id":"a","contact":"f"}`, 200, `{"ok":true}`},
+		{"/contacts/confirm", `{"id":"g","contact":"a"}`, 409, `{"count":3,"error":"too_many_contacts","limit":3}`},
+		{"/contacts/confirm", `{"id":"g","contact":"a","reject":true}`, 200, `{"ok":true}`},
+	}
+
+	for i, s := range steps {
+		w := do(r, "POST", s.path, s.body)
+		if w.Code != s.code {
+			t.Fatalf("step %d got %d, want %d: %s", i, w.Code, s.code, w.Body)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != s.want {
+			t.Errorf("step %d got %s, want %s", i, got, s.want)
+		}
+	}
+}
+
+func TestSetContacts(t *testing.T) {
+	m := newManager()
+
+	steps := []struct {
+		contacts []string
+		added    []string
+		removed  []string
+		stored   []string
+	}{
+		{[]string{"b", "c", "a"}, []string{"b", "c"}, []string{}, []string{"b", "c"}},
+		{[]string{"d", " c", "c"}, []string{"d"}, []string{"b"}, []string{"c", "d"}},
+		{[]string{"c", "d"}, []string{}, []string{}, []string{"c", "d"}},
+		{[]string{}, []string{}, []string{"c", "d"}, []string{}},
+	}
+
+	for i, s := range steps {
+		added, removed, err := m.setContacts(context.Background(), "a", s.contacts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(added, s.added) || !reflect.DeepEqual(removed, s.removed) {
+			t.Errorf("step %d got +%v -%v, want +%v -%v", i, added, removed, s.added, s.removed)
+		}
+
+		if got, _ := m.contactsFor("a"); !reflect.DeepEqual(got, s.stored) {
+			t.Errorf("step %d stored %v, want %v", i, got, s.stored)
+		}
+	}
+
+	if _, _, err := m.setContacts(context.Background(), "a", []string{"b", " "}); err != errEmptyID {
+		t.Errorf("got %v for an empty id, want errEmptyID", err)
+	}
+}
+
+func TestUpdateLocation(t *testing.T) {
+	m := newManager()
+
+	// first insert
+	if err := m.updateLocation("a", 51.5, -0.1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	u := m.users["a"]
+	if u == nil || u.location == nil {
+		t.Fatal("first ping did not set a location")
+	}
+	if ids := pointsNear(m, 51.5, -0.1, 10); !reflect.DeepEqual(ids, []string{"a"}) {
+		t.Fatalf("world has %v after first ping, want [a]", ids)
+	}
+
+	// unchanged coordinates keep the same point
+	first := u.location
+	if err := m.updateLocation("a", 51.5, -0.1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if u.location != first {
+		t.Error("unchanged ping replaced the point")
+	}
+	if ids := pointsNear(m, 51.5, -0.1, 10); len(ids) != 1 {
+		t.Errorf("world has %v after unchanged ping, want one point", ids)
+	}
+
+	// a move leaves nothing behind and tracks the new point
+	if err := m.updateLocation("a", 51.6, -0.2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if lat, lon := u.location.Coordinates(); lat != 51.6 || lon != -0.2 {
+		t.Errorf("location is %v,%v after move, want 51.6,-0.2", lat, lon)
+	}
+	if ids := pointsNear(m, 51.5, -0.1, 10); len(ids) != 0 {
+		t.Errorf("old location still holds %v", ids)
+	}
+	if ids := pointsNear(m, 51.6, -0.2, 10); !reflect.DeepEqual(ids, []string{"a"}) {
+		t.Errorf("world has %v at new location, want [a]", ids)
+	}
+
+	// out of the world is rejected and changes nothing
+	if err := m.updateLocation("a", 91, 0, 0); err != errOutOfBounds {
+		t.Errorf("got %v for lat 91, want errOutOfBounds", err)
+	}
+	if lat, _ := u.location.Coordinates(); lat != 51.6 {
+		t.Errorf("out of bounds ping moved the user to %v", lat)
+	}
+}
+
+func TestNearContacts(t *testing.T) {
+	lat, lon := 51.5, -0.1
+
+	m := newManager()
+	befriend(m, "a", "a", "near", "far")
+	m.updateLocation("a", lat, lon, 0)
+	m.updateLocation("near", lat, lon+0.00005, 0)     // ~3.5m
+	m.updateLocation("far", lat, lon+0.001, 0)        // ~70m
+	m.updateLocation("stranger", lat, lon+0.00001, 0) // not a contact
+
+	testData := []struct {
+		name     string
+		id       string
+		distance float64
+		want     []string
+	}{
+		{"only contacts within distance", "a", 10, []string{"near"}},
+		{"wider distance", "a", 100, []string{"near", "far"}},
+		{"unknown user", "nobody", 100, nil},
+		{"no contacts", "stranger", 100, nil},
+	}
+
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			q := nearQuery{lat: lat, lon: lon, distance: d.distance, limit: 10}
+
+			var ids []string
+			for _, c := range m.nearContacts(d.id, q) {
+				ids = append(ids, c.Id)
+			}
+
+			if !reflect.DeepEqual(ids, d.want) {
+				t.Errorf("got %v, want %v", ids, d.want)
+			}
+		})
+	}
+}
+
+// The search box is centred on the user, so contacts south and west of
+// them are found as well as those north and east.
+func TestNearContactsAllDirections(t *testing.T) {
+	lat, lon := 51.5, -0.1
+	step := 0.00005 // about 5.5m of latitude, under 4m of longitude
+
+	m := newManager()
+	befriend(m, "a", "north", "south", "east", "west")
+	m.updateLocation("north", lat+step, lon, 0)
+	m.updateLocation("south", lat-step, lon, 0)
+	m.updateLocation("east", lat, lon+step, 0)
+	m.updateLocation("west", lat, lon-step, 0)
+
+	q := nearQuery{lat: lat, lon: lon, distance: nearestDistance, limit: 10}
+
+	var ids []string
+	for _, c := range m.nearContacts("a", q) {
+		ids = append(ids, c.Id)
+	}
+	sort.Strings(ids)
+
+	want := []string{"east", "north", "south", "west"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestNearContactsOrder(t *testing.T) {
+	lat, lon := 51.5, -0.1
+
+	m := newManager()
+	befriend(m, "a", "w", "x", "y", "z")
+	m.updateLocation("z", lat, lon+0.0001, 0)
+	m.updateLocation("x", lat, lon+0.0003, 0)
+	m.updateLocation("w", lat, lon-0.0001, 0) // same distance as z
+	m.updateLocation("y", lat, lon+0.0002, 0)
+
+	q := nearQuery{lat: lat, lon: lon, distance: 100, limit: 10}
+
+	var ids []string
+	var last float64
+	for _, c := range m.nearContacts("a", q) {
+		if c.Distance < last {
+			t.Errorf("%s at %vm after one at %vm", c.Id, c.Distance, last)
+		}
+		last = c.Distance
+		ids = append(ids, c.Id)
+	}
+
+	want := []string{"w", "z", "y", "x"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestAltitudeEchoed(t *testing.T) {
+	r := newRouter(newManager())
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+	do(r, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1,"alt":120.5}}`)
+
+	w := do(r, "GET", "/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points=10", "")
+	var all []allUser
+	if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Alt != 120.5 {
+		t.Errorf("/_all alt got %+v, want 120.5: %s", all, w.Body)
+	}
+
+	w = do(r, "GET", "/near?id=a&lat=51.5&lon=-0.1&verbose=true", "")
+	var near struct {
+		Contacts []nearContact `json:"contacts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &near); err != nil {
+		t.Fatal(err)
+	}
+	if len(near.Contacts) != 1 || near.Contacts[0].Alt != 120.5 {
+		t.Errorf("/near alt got %+v, want 120.5", near.Contacts)
+	}
+}
+
+func TestAllExcludeSelf(t *testing.T) {
+	m := newManager()
+	m.updateLocation("a", 51.5, -0.1, 0)
+	m.updateLocation("b", 51.5, -0.1, 0)
+	r := newRouter(m)
+
+	data := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a", "b"}},
+		{"&exclude_self=false", []string{"a", "b"}},
+		{"&exclude_self=true", []string{"b"}},
+	}
+
+	for _, d := range data {
+		w := do(r, "GET", "/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points=10"+d.query, "")
+		var users []allUser
+		if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+			t.Fatalf("%q: %v: %s", d.query, err, w.Body)
+		}
+
+		var ids []string
+		for _, u := range users {
+			ids = append(ids, u.Id)
+		}
+		if !reflect.DeepEqual(ids, d.want) {
+			t.Errorf("%q got %v, want %v", d.query, ids, d.want)
+		}
+	}
+}
+
+func TestAllNumPoints(t *testing.T) {
+	m := newManager()
+	m.updateLocation("a", 51.5, -0.1, 0)
+	r := newRouter(m)
+
+	bad := fmt.Sprintf("Bad Request. num_points must be between 1 and %d.", maxContacts)
+
+	data := []struct {
+		numPoints string
+		code      int
+		want      string
+	}{
+		{"1", 200, `[{"id":"a","lat":51.5,"lon":-0.1,"alt":0}]`},
+		{fmt.Sprint(maxContacts), 200, `[{"id":"a","lat":51.5,"lon":-0.1,"alt":0}]`},
+		{"0", 400, bad},
+		{"-1", 400, bad},
+		{"1e12", 400, bad},
+		{fmt.Sprint(maxContacts + 1), 400, bad},
+		{"NaN", 400, bad},
+	}
+
+	for _, d := range data {
+		w := do(r, "GET", "/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points="+d.numPoints, "")
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("num_points=%s got %d %s, want %d %s", d.numPoints, w.Code, got, d.code, d.want)
+		}
+	}
+
+	// the same through the JSON body
+	w := do(r, "POST", "/_all", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":10,"num_points":-1}`)
+	if got := strings.TrimSpace(w.Body.String()); w.Code != 400 || got != bad {
+		t.Errorf("POST num_points -1 got %d %s", w.Code, got)
+	}
+}
+
+func TestAllStable(t *testing.T) {
+	defer func(v bool) { allMap = v }(allMap)
+
+	m := newManager()
+	// a and c at the same spot to order by id, b further off
+	m.updateLocation("c", 51.5, -0.1, 0)
+	m.updateLocation("b", 51.5, -0.1001, 0)
+	m.updateLocation("a", 51.5, -0.1, 0)
+	r := newRouter(m)
+
+	path := "/_all?id=x&lat=51.5&lon=-0.1&distance=100&num_points=10"
+	want := `[{"id":"a","lat":51.5,"lon":-0.1,"alt":0},{"id":"c","lat":51.5,"lon":-0.1,"alt":0},{"id":"b","lat":51.5,"lon":-0.1001,"alt":0}]`
+
+	for i := 0; i < 20; i++ {
+		if got := strings.TrimSpace(do(r, "GET", path, "").Body.String()); got != want {
+			t.Fatalf("call %d got %s, want %s", i, got, want)
+		}
+	}
+
+	allMap = true
+	want = `{"a":{"alt":0,"lat":51.5,"lon":-0.1},"b":{"alt":0,"lat":51.5,"lon":-0.1001},"c":{"alt":0,"lat":51.5,"lon":-0.1}}`
+	if got := strings.TrimSpace(do(r, "GET", path, "").Body.String()); got != want {
+		t.Errorf("-all-map got %s, want %s", got, want)
+	}
+}
+
+func TestAllPagination(t *testing.T) {
+	m := newManager()
+	for i := 0; i < 7; i++ {
+		m.updateLocation(fmt.Sprintf("u%d", i), 51.5, -0.1+float64(i%3)*0.0001, 0)
+	}
+
+	r := newRouter(m)
+
+	seen := make(map[string]bool)
+	offset := 0
+
+	for pages := 0; ; pages++ {
+		if pages > 7 {
+			t.Fatal("pagination did not end")
+		}
+
+		body := fmt.Sprintf(`{"id":"admin","location":{"lat":51.5,"lon":-0.1},"distance":100,"num_points":10,"limit":3,"offset":%d}`, offset)
+		w := do(r, "POST", "/_all", body)
+		if w.Code != 200 {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+
+		var rsp struct {
+			Users      []allUser `json:"users"`
+			Total      int       `json:"total"`
+			NextOffset *int      `json:"next_offset"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+
+		if rsp.Total != 7 {
+			t.Errorf("total %d, want 7", rsp.Total)
+		}
+		for _, u := range rsp.Users {
+			if seen[u.Id] {
+				t.Errorf("%s returned twice", u.Id)
+			}
+			seen[u.Id] = true
+		}
+
+		if rsp.NextOffset == nil {
+			break
+		}
+		if *rsp.NextOffset != offset+len(rsp.Users) {
+			t.Fatalf("next_offset %d after %d users from %d", *rsp.NextOffset, len(rsp.Users), offset)
+		}
+		offset = *rsp.NextOffset
+	}
+
+	if len(seen) != 7 {
+		t.Errorf("saw %d users across pages, want 7", len(seen))
+	}
+}
+
+func TestRoster(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := newManager()
+	m.now = func() time.Time { return now }
+	m.addContacts(context.Background(), "a", []string{"b"}) // a never pings
+	m.updateLocation("c", 51.5, -0.1, 0)
+	m.updateLocation("b", 51.5, -0.1, 0)
+	m.goOffline(context.Background(), "b")
+
+	r := newRouter(m)
+
+	type page struct {
+		Users      []rosterEntry `json:"users"`
+		Total      int           `json:"total"`
+		NextOffset *int          `json:"next_offset"`
+	}
+
+	get := func(path string) page {
+		w := do(r, "GET", path, "")
+		if w.Code != 200 {
+			t.Fatalf("%s got %d: %s", path, w.Code, w.Body)
+		}
+		var p page
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	seen := "2020-01-01T12:00:00Z"
+	want := []rosterEntry{
+		{Id: "a"},
+		{Id: "b", LastSeen: seen},
+		{Id: "c", Located: true, LastSeen: seen},
+	}
+
+	if p := get("/_users"); !reflect.DeepEqual(p.Users, want) || p.Total != 3 || p.NextOffset != nil {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+
+	p := get("/_users?limit=2")
+	if !reflect.DeepEqual(p.Users, want[:2]) || p.NextOffset == nil || *p.NextOffset != 2 {
+		t.Errorf("first page got %+v", p)
+	}
+	if p := get("/_users?limit=2&offset=2"); !reflect.DeepEqual(p.Users, want[2:]) || p.NextOffset != nil {
+		t.Errorf("last page got %+v", p)
+	}
+
+	if w := do(r, "GET", "/_users?limit=0", ""); w.Code != 400 {
+		t.Errorf("zero limit got %d, want 400", w.Code)
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := newManager()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		m.updateLocation(id, 51.5, -0.1, 0)
+	}
+	m.updateLocation("b", 51.5001, -0.1, 0)
+	m.addContacts(context.Background(), "f", []string{"a"}) // no location
+	m.removeUser(context.Background(), "c")
+	m.setVisibility(context.Background(), "d", false)
+	m.goDark(context.Background(), "e")
+
+	want := treeStats{Users: 5, Points: 2, Invisible: 1, Dark: 1}
+	if s := m.stats(); s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+
+	if ids := pointsNear(m, 51.5, -0.1, 1000); len(ids) != want.Points {
+		t.Errorf("world holds %v, stats say %d points", ids, want.Points)
+	}
+}
+
+func TestGeofenceEnter(t *testing.T) {
+	lat, lon := 51.5, -0.1
+
+	m := newManager()
+	m.updateLocation("a", lat, lon+0.01, 0) // ~700m east
+
+	if err := m.addGeofence(context.Background(), "a", lat, lon, 100, "office"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := []struct {
+		lon    float64
+		events int
+	}{
+		{lon + 0.005, 0},  // still outside
+		{lon + 0.0005, 1}, // enter
+		{lon, 0},          // still inside
+		{lon + 0.01, 0},   // leave
+		{lon - 0.0001, 1}, // enter again
+	}
+
+	for i, step := range path {
+		m.updateLocation("a", lat, step.lon, 0)
+
+		events, ok := m.pollFenceEvents("a")
+		if !ok {
+			t.Fatal("unknown user")
+		}
+		if len(events) != step.events {
+			t.Errorf("step %d got %d events, want %d", i, len(events), step.events)
+		}
+		for _, e := range events {
+			if e.Type != "enter" || e.Label != "office" {
+				t.Errorf("step %d got %+v", i, e)
+			}
+		}
+	}
+
+	// a fence added around the user does not fire
+	m.addGeofence(context.Background(), "a", lat, lon, 50, "desk")
+	m.updateLocation("a", lat, lon+0.00001, 0)
+	if events, _ := m.pollFenceEvents("a"); len(events) != 0 {
+		t.Errorf("got %v for a fence added while inside", events)
+	}
+}
+
+func TestPolygonFence(t *testing.T) {
+	// an L two cells wide and two high, missing the top right cell,
+	// each cell 0.001 degrees from 51.5,-0.1
+	cell := func(lat, lon float64) [2]float64 {
+		return [2]float64{51.5 + lat*0.001, -0.1 + lon*0.001}
+	}
+	l := [][2]float64{cell(0, 0), cell(0, 2), cell(1, 2), cell(1, 1), cell(2, 1), cell(2, 0)}
+
+	m := newManager()
+	m.updateLocation("a", 51.49, -0.1, 0)
+
+	if err := m.addPolygonFence(context.Background(), "a", append(l, l[0]), "campus"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := []struct {
+		at     [2]float64
+		events int
+	}{
+		{cell(1.5, 1.5), 0}, // the missing cell, outside
+		{cell(0.5, 1.5), 1}, // bottom right, enter
+		{cell(0.5, 0.5), 0}, // bottom left, still inside
+		{cell(1.5, 0.5), 0}, // top left, still inside
+		{cell(1.5, 1.5), 0}, // back out to the missing cell
+		{cell(1.5, 0.9), 1}, // enter across the inner corner
+		{cell(2.5, 0.5), 0}, // above, outside
+	}
+
+	for i, step := range path {
+		m.updateLocation("a", step.at[0], step.at[1], 0)
+
+		events, _ := m.pollFenceEvents("a")
+		if len(events) != step.events {
+			t.Errorf("step %d got %d events, want %d", i, len(events), step.events)
+		}
+		for _, e := range events {
+			if e.Label != "campus" {
+				t.Errorf("step %d got %+v", i, e)
+			}
+		}
+	}
+
+	data := []struct {
+		name    string
+		polygon [][2]float64
+		err     string
+	}{
+		{"open", l, ""},
+		{"closed", append(l, l[0]), ""},
+		{"line", [][2]float64{cell(0, 0), cell(1, 1)}, "needs at least 3 vertices"},
+		{"flat", [][2]float64{cell(0, 0), cell(1, 1), cell(2, 2)}, "must enclose an area"},
+		{"repeat", [][2]float64{cell(0, 0), cell(0, 1), cell(0, 1), cell(1, 1)}, "repeats a vertex"},
+		{"bowtie", [][2]float64{cell(0, 0), cell(1, 1), cell(1, 0), cell(0, 1)}, "must not cross itself"},
+		{"touching", [][2]float64{cell(0, 0), cell(0, 2), cell(1, 1), cell(0, 1), cell(-1, 1)}, "must not cross itself"},
+	}
+
+	for _, d := range data {
+		_, err := checkPolygon(d.polygon)
+		if got := fmt.Sprint(err); (err == nil) != (len(d.err) == 0) || err != nil && got != d.err {
+			t.Errorf("%s got %v, want %q", d.name, err, d.err)
+		}
+	}
+
+	r := newRouter(m)
+	w := do(r, "POST", "/geofence", `{"id":"a","label":"x","polygon":[{"lat":0,"lon":0},{"lat":1,"lon":1},{"lat":1,"lon":0},{"lat":0,"lon":1}]}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"polygon":"must not cross itself"`) {
+		t.Errorf("bowtie got %d %s", w.Code, w.Body)
+	}
+
+	w = do(r, "POST", "/geofence", `{"id":"a","label":"y","polygon":[{"lat":0,"lon":0},{"lat":0,"lon":1},{"lat":1,"lon":0}]}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("triangle got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestNearHysteresis(t *testing.T) {
+	lat, lon := 51.5, -0.1
+	metres := func(d float64) float64 { return lat + d/(earthRadius*math.Pi/180) }
+
+	m := newManager()
+	befriend(m, "a", "b")
+	m.updateLocation("a", lat, lon, 0)
+	m.updateLocation("b", metres(50), lon, 0)
+
+	ch := m.subscribe("a")
+	defer m.unsubscribe("a", ch)
+
+	// b hovers at the 10m edge, within the 12m margin, then leaves and
+	// comes back
+	path := []struct {
+		d      float64
+		alerts int
+	}{
+		{9, 1},
+		{10.5, 0},
+		{9.5, 0},
+		{11.9, 0},
+		{8, 0},
+		{13, 0},
+		{11, 0},
+		{9, 1},
+	}
+
+	for i, step := range path {
+		m.updateLocation("b", metres(step.d), lon, 0)
+
+		var alerts int
+		for len(ch) > 0 {
+			var e event
+			json.Unmarshal(<-ch, &e)
+			if e.Type != "near" || e.Id != "b" {
+				t.Errorf("step %d got %+v", i, e)
+			}
+			alerts++
+		}
+		if alerts != step.alerts {
+			t.Errorf("step %d at %vm got %d alerts, want %d", i, step.d, alerts, step.alerts)
+		}
+	}
+}
+
+func TestRelayDebounce(t *testing.T) {
+	ch := make(chan []byte, 16)
+	done := make(chan struct{})
+	sent := make(chan string, 16)
+
+	go relay(ch, done, 50*time.Millisecond, func(b []byte) error {
+		sent <- string(b)
+		return nil
+	})
+	defer close(done)
+
+	push := func(e event) {
+		b, _ := json.Marshal(e)
+		ch <- b
+	}
+
+	// three contacts come near in quick succession, b twice, and a
+	// geofence is entered meanwhile
+	push(event{Type: "near", Id: "b", Distance: 9})
+	push(event{Type: "near", Id: "c", Distance: 5})
+	push(event{Type: "enter", Fence: "home", Distance: 3})
+	push(event{Type: "near", Id: "b", Distance: 4})
+	push(event{Type: "near", Id: "d", Distance: 7})
+
+	want := []string{
+		`{"type":"enter","fence":"home","distance_m":3}`,
+		`{"type":"near_batch","contacts":[{"type":"near","id":"b","distance_m":4},{"type":"near","id":"c","distance_m":5},{"type":"near","id":"d","distance_m":7}]}`,
+	}
+
+	for i, w := range want {
+		select {
+		case got := <-sent:
+			if got != w {
+				t.Errorf("message %d got %s, want %s", i, got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d never sent", i)
+		}
+	}
+
+	select {
+	case got := <-sent:
+		t.Errorf("got another message %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r := newRouter(newManager())
+	for _, v := range []string{"soon", "-1s", "2h"} {
+		if w := do(r, "GET", "/subscribe?id=a&debounce="+v, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("debounce %s got %d, want 400", v, w.Code)
+		}
+	}
+}
+
+func TestNearContactsLastSeen(t *testing.T) {
+	lat, lon := 51.5, -0.1
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := newManager()
+	m.now = func() time.Time { return now }
+	befriend(m, "a", "b", "c") // c never pings
+
+	m.updateLocation("b", lat, lon, 0)
+	now = now.Add(time.Minute)
+	m.updateLocation("b", lat, lon+0.00001, 0)
+
+	q := nearQuery{lat: lat, lon: lon, distance: 100, limit: 10}
+
+	contacts := m.nearContacts("a", q)
+	if len(contacts) != 1 || contacts[0].Id != "b" {
+		t.Fatalf("got %+v, want only b", contacts)
+	}
+	if contacts[0].LastSeen != "2020-01-01T12:01:00Z" {
+		t.Errorf("last seen %s, want the latest ping", contacts[0].LastSeen)
+	}
+}
+
+func TestNearContactsRank(t *testing.T) {
+	defer func(h time.Duration) { rankHalfLife = h }(rankHalfLife)
+
+	lat, lon := 51.5, -0.1
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := newManager()
+	m.now = func() time.Time { return now }
+	befriend(m, "a", "stale", "near", "far")
+
+	// stale is closest but last pinged four half lives ago
+	m.updateLocation("stale", lat, lon, 0)
+	now = now.Add(40 * time.Minute)
+	m.updateLocation("near", lat, lon+0.0001, 0)
+	m.updateLocation("far", lat, lon+0.0003, 0)
+
+	q := nearQuery{lat: lat, lon: lon, distance: 100, limit: 10, rank: true}
+
+	data := []struct {
+		halfLife time.Duration
+		want     []string
+		decay    map[string]float64 // of 1 / (1 + distance), 1 when missing
+	}{
+		{10 * time.Minute, []string{"near", "stale", "far"}, map[string]float64{"stale": 1.0 / 16}},
+		{0, []string{"stale", "near", "far"}, nil},
+	}
+
+	for _, d := range data {
+		rankHalfLife = d.halfLife
+
+		var ids []string
+		for _, c := range m.nearContacts("a", q) {
+			ids = append(ids, c.Id)
+
+			want := 1 / (1 + c.Distance)
+			if decay, ok := d.decay[c.Id]; ok {
+				want *= decay
+			}
+			if math.Abs(c.Score-want) > 1e-12 {
+				t.Errorf("half life %v: %s scored %v, want %v", d.halfLife, c.Id, c.Score, want)
+			}
+		}
+
+		if !reflect.DeepEqual(ids, d.want) {
+			t.Errorf("half life %v: got %v, want %v", d.halfLife, ids, d.want)
+		}
+	}
+}
+
+// Only verbose /near ranks by score, plain ids stay nearest first so
+// the oldest contact leads when it is the nearest.
+func TestNearOrder(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := newManager()
+	m.now = func() time.Time { return now }
+	befriend(m, "a", "old", "fresh")
+
+	m.updateLocation("old", 51.5, -0.1, 0)
+	now = now.Add(time.Hour)
+	m.updateLocation("fresh", 51.5, -0.09995, 0) // about 3m east
+	r := newRouter(m)
+
+	data := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"old", "fresh"}},
+		{"&verbose=true", []string{"fresh", "old"}},
+	}
+
+	for _, d := range data {
+		w := do(r, "GET", "/near?id=a&lat=51.5&lon=-0.1"+d.query, "")
+
+		var ids []string
+		if d.query == "" {
+			var rsp struct {
+				Contacts []string `json:"contacts"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatalf("%v: %s", err, w.Body)
+			}
+			ids = rsp.Contacts
+		} else {
+			var rsp struct {
+				Contacts []nearContact `json:"contacts"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatalf("%v: %s", err, w.Body)
+			}
+			for _, c := range rsp.Contacts {
+				ids = append(ids, c.Id)
+			}
+		}
+
+		if !reflect.DeepEqual(ids, d.want) {
+			t.Errorf("%q got %v, want %v", d.query, ids, d.want)
+		}
+	}
+}
+
+func TestNearCandidates(t *testing.T) {
+	defer func(n int) { nearCandidates = n }(nearCandidates)
+
+	lat, lon := 51.5, -0.1
+	metres := func(d float64) float64 { return lat + d/(earthRadius*math.Pi/180) }
+
+	m := newManager()
+	befriend(m, "a", "far1", "far2", "near1", "near2")
+
+	// far contacts are put in the tree first, so found first, then a
+	// crowd of strangers closer than all of them
+	m.updateLocation("far1", metres(80), lon, 0)
+	m.updateLocation("far2", metres(90), lon, 0)
+	m.updateLocation("near1", metres(20), lon, 0)
+	m.updateLocation("near2", metres(30), lon, 0)
+	for i := 0; i < 50; i++ {
+		m.updateLocation(fmt.Sprintf("stranger%d", i), metres(float64(i%10)), lon, 0)
+	}
+
+	q := nearQuery{lat: lat, lon: lon, distance: 100, limit: 2}
+
+	data := []struct {
+		candidates int
+		want       []string
+	}{
+		{1, []string{"far1", "far2"}},
+		{2, []string{"near1", "near2"}},
+		{4, []string{"near1", "near2"}},
+	}
+
+	for _, d := range data {
+		nearCandidates = d.candidates
+
+		var ids []string
+		for _, c := range m.nearContacts("a", q) {
+			ids = append(ids, c.Id)
+		}
+		if !reflect.DeepEqual(ids, d.want) {
+			t.Errorf("%d candidates got %v, want %v", d.candidates, ids, d.want)
+		}
+	}
+
+	// strangers never use up the quota
+	q.limit = 4
+	if got := m.nearContacts("a", q); len(got) != 4 {
+		t.Errorf("got %d contacts among strangers, want 4", len(got))
+	}
+}
+
+func TestUsersNearCandidates(t *testing.T) {
+	defer func(n int) { nearCandidates = n }(nearCandidates)
+
+	lat, lon := 51.5, -0.1
+	metres := func(d float64) float64 { return lat + d/(earthRadius*math.Pi/180) }
+
+	// the far users are put in the tree first, so found first
+	m := newManager()
+	m.updateLocation("far1", metres(80), lon, 0)
+	m.updateLocation("far2", metres(90), lon, 0)
+	m.updateLocation("near1", metres(20), lon, 0)
+	m.updateLocation("near2", metres(30), lon, 0)
+
+	data := []struct {
+		candidates int
+		want       []string
+	}{
+		{1, []string{"far1", "far2"}},
+		{2, []string{"near1", "near2"}},
+		{4, []string{"near1", "near2"}},
+	}
+
+	for _, d := range data {
+		nearCandidates = d.candidates
+
+		var ids []string
+		for _, u := range m.usersNear("admin", lat, lon, 100, 2, false) {
+			ids = append(ids, u.id)
+		}
+		if !reflect.DeepEqual(ids, d.want) {
+			t.Errorf("%d candidates got %v, want %v", d.candidates, ids, d.want)
+		}
+	}
+}
+
+func TestUnlocatedContacts(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "located", "never", "dark", "hidden", "blocker", "unknown")
+	for _, id := range []string{"located", "dark", "hidden", "blocker"} {
+		m.updateLocation(id, 51.5, -0.1, 0)
+	}
+	m.addContacts(context.Background(), "never", []string{"a"})
+	m.goDark(context.Background(), "dark")
+	m.setVisibility(context.Background(), "hidden", false)
+	m.block(context.Background(), "blocker", "a")
+
+	want := []string{"blocker", "dark", "hidden", "never", "unknown"}
+	if got := m.unlocatedContacts("a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	w := do(newRouter(m), "GET", "/near?id=a&lat=51.5&lon=-0.1&include_unknown=true", "")
+	var rsp struct {
+		Contacts  []string `json:"contacts"`
+		Unlocated []string `json:"unlocated"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rsp.Contacts, []string{"located"}) {
+		t.Errorf("contacts %v, want [located]", rsp.Contacts)
+	}
+	if !reflect.DeepEqual(rsp.Unlocated, want) {
+		t.Errorf("unlocated %v, want %v", rsp.Unlocated, want)
+	}
+}
+
+func TestNearGroup(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["mum","dad","boss","far"]}`)
+	for _, id := range []string{"mum", "dad", "boss", "far"} {
+		m.addContacts(context.Background(), id, []string{"a"})
+	}
+	do(r, "POST", "/groups", `{"id":"a","group":"family","contacts":["mum","dad"]}`)
+	do(r, "POST", "/groups", `{"id":"a","group":"work","contacts":["boss","far"]}`)
+
+	for _, id := range []string{"mum", "dad", "boss"} {
+		m.updateLocation(id, 51.5, -0.1, 0)
+	}
+	m.updateLocation("far", 52.5, -0.1, 0)
+
+	data := []struct {
+		group string
+		code  int
+		want  []string
+	}{
+		{"", 200, []string{"boss", "dad", "mum"}},
+		{"family", 200, []string{"dad", "mum"}},
+		{"work", 200, []string{"boss"}},
+		{"friends", 404, nil},
+	}
+
+	for _, d := range data {
+		w := do(r, "GET", "/near?id=a&lat=51.5&lon=-0.1&group="+d.group, "")
+		if w.Code != d.code {
+			t.Fatalf("group %q got %d, want %d: %s", d.group, w.Code, d.code, w.Body)
+		}
+		if d.code != 200 {
+			continue
+		}
+
+		var rsp struct {
+			Contacts []string `json:"contacts"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(rsp.Contacts)
+		if !reflect.DeepEqual(rsp.Contacts, d.want) {
+			t.Errorf("group %q got %v, want %v", d.group, rsp.Contacts, d.want)
+		}
+	}
+
+	groups, _ := m.groupsOf("a")
+	want := map[string][]string{"family": {"dad", "mum"}, "work": {"boss", "far"}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups got %v, want %v", groups, want)
+	}
+}
+
+func TestNearGroupLabels(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "b", "c")
+	m.addToGroup(context.Background(), "a", "family", []string{"b"})
+	m.addToGroup(context.Background(), "a", "work", []string{"b"})
+	m.updateLocation("b", 51.5, -0.1, 0)
+	m.updateLocation("c", 51.5, -0.1, 0)
+
+	r := newRouter(m)
+
+	data := []struct {
+		group string
+		want  map[string][]string
+	}{
+		{"", map[string][]string{"b": {"family", "work"}, "c": nil}},
+		{"family", map[string][]string{"b": {"family", "work"}}},
+		{"work", map[string][]string{"b": {"family", "work"}}},
+	}
+
+	for _, d := range data {
+		w := do(r, "GET", "/near?id=a&lat=51.5&lon=-0.1&verbose=true&group="+d.group, "")
+		var rsp struct {
+			Contacts []nearContact `json:"contacts"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("group %q: %v: %s", d.group, err, w.Body)
+		}
+
+		got := map[string][]string{}
+		for _, c := range rsp.Contacts {
+			if _, ok := got[c.Id]; ok {
+				t.Errorf("group %q: %s listed twice", d.group, c.Id)
+			}
+			got[c.Id] = c.Groups
+		}
+		if !reflect.DeepEqual(got, d.want) {
+			t.Errorf("group %q got %v, want %v", d.group, got, d.want)
+		}
+	}
+}
+
+func TestNearUnits(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "b", "c", "d")
+	m.updateLocation("b", 0, 0.008094, 0) // 0.9km
+	m.updateLocation("c", 0, 0.010792, 0) // 1.2km
+	m.updateLocation("d", 0, 0.015289, 0) // 1.7km
+
+	r := newRouter(m)
+
+	testData := []struct {
+		unit string
+		want []string
+	}{
+		{"km", []string{"b"}},
+		{"mi", []string{"b", "c"}},
+	}
+
+	for _, d := range testData {
+		t.Run(d.unit, func(t *testing.T) {
+			body := fmt.Sprintf(`{"id":"a","location":{"lat":0,"lon":0},"distance":1,"unit":%q,"verbose":true}`, d.unit)
+			w := do(r, "POST", "/near", body)
+			if w.Code != 200 {
+				t.Fatalf("got %d: %s", w.Code, w.Body)
+			}
+
+			var rsp struct {
+				Contacts []nearContact `json:"contacts"`
+				Unit     string        `json:"unit"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, c := range rsp.Contacts {
+				ids = append(ids, c.Id)
+				if c.InUnit == nil || math.Abs(*c.InUnit*units[d.unit]-c.Distance) > 1e-6 {
+					t.Errorf("%s is %vm but %v%s", c.Id, c.Distance, c.InUnit, d.unit)
+				}
+			}
+			if !reflect.DeepEqual(ids, d.want) {
+				t.Errorf("got %v, want %v", ids, d.want)
+			}
+			if rsp.Unit != d.unit {
+				t.Errorf("unit %q, want %q", rsp.Unit, d.unit)
+			}
+		})
+	}
+
+	if w := do(r, "POST", "/near", `{"id":"a","location":{"lat":0,"lon":0},"unit":"ft"}`); w.Code != 400 {
+		t.Errorf("unknown unit got %d, want 400", w.Code)
+	}
+}
+
+func TestNearbyUsers(t *testing.T) {
+	lat, lon := 51.5, -0.1
+
+	m := newManager()
+	m.addContacts(context.Background(), "a", []string{"friend"})
+	m.updateLocation("a", lat, lon, 0)
+	m.updateLocation("friend", lat, lon+0.00001, 0)
+	m.updateLocation("near", lat, lon+0.00003, 0)
+	m.updateLocation("nearer", lat, lon+0.00002, 0)
+	m.updateLocation("far", lat, lon+0.01, 0)
+	m.updateLocation("ghost", lat, lon+0.00001, 0)
+	m.setVisibility(context.Background(), "ghost", false)
+	m.updateLocation("blocker", lat, lon+0.00001, 0)
+	m.block(context.Background(), "blocker", "a")
+
+	want := []string{"nearer", "near"}
+	if got := m.nearbyUsers("a", lat, lon, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	w := do(newRouter(m), "POST", "/nearby", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	if body := w.Body.String(); body != `{"users":["nearer","near"]}` {
+		t.Errorf("handler got %d %s", w.Code, body)
+	}
+
+	// with more found than kept, the nearest are kept even though the
+	// tree gives the far ones, put in first, first
+	defer func(n int) { maxContacts = n }(maxContacts)
+	maxContacts = 2
+
+	metres := func(d float64) float64 { return lat + d/(earthRadius*math.Pi/180) }
+	m = newManager()
+	m.updateLocation("far1", metres(80), lon, 0)
+	m.updateLocation("far2", metres(90), lon, 0)
+	m.updateLocation("near1", metres(20), lon, 0)
+	m.updateLocation("near2", metres(30), lon, 0)
+
+	want = []string{"near1", "near2"}
+	if got := m.nearbyUsers("a", lat, lon, 100); !reflect.DeepEqual(got, want) {
+		t.Errorf("capped got %v, want %v", got, want)
+	}
+}
+
+func TestSQLStoreUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remindme.db")
+
+	// a database from before users kept more than a location
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE users (id TEXT PRIMARY KEY, lat REAL, lon REAL, alt REAL, accuracy REAL, seen INTEGER);
+		INSERT INTO users (id, lat, lon, seen) VALUES ('a', 51.5, -0.1, 0)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.SaveState("a", userState{dark: true}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].location == nil || users[0].lastKnown != nil || !users[0].dark {
+		t.Errorf("upgraded database loaded %+v", users)
+	}
+}
+
+func TestStoreRestart(t *testing.T) {
+	data := []struct {
+		name string
+		// returns what opens the store, again after each restart
+		store func(t *testing.T) func() (Store, error)
+	}{
+		{"memory", func(t *testing.T) func() (Store, error) {
+			s := newMemStore()
+			return func() (Store, error) { return s, nil }
+		}},
+		{"sqlite", func(t *testing.T) func() (Store, error) {
+			path := filepath.Join(t.TempDir(), "remindme.db")
+			return func() (Store, error) { return openSQLStore(path) }
+		}},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			testStoreRestart(t, d.store(t))
+		})
+	}
+}
+
+// testStoreRestart checks a manager brought back from the store opened
+// by openStore has the users the last one left there.
+func testStoreRestart(t *testing.T, openStore func() (Store, error)) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	open := func() *manager {
+		s, err := openStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := newManager()
+		m.now = func() time.Time { return now }
+		m.store = s
+		if err := m.restore(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	m := open()
+	m.addContacts(context.Background(), "a", []string{"b", "c", "gone"})
+	m.setContacts(context.Background(), "b", []string{"a"})
+	m.updateLocations(context.Background(), []locationUpdate{
+		{id: "a", lat: 51.5, lon: -0.1},
+		{id: "b", lat: 51.50001, lon: -0.1, accuracy: 5},
+		{id: "c", lat: 51.50002, lon: -0.1},
+		{id: "gone", lat: 51.5, lon: -0.1},
+	})
+	m.goOffline(context.Background(), "c")
+	m.removeUser(context.Background(), "gone")
+	q := nearQuery{lat: 51.5, lon: -0.1, distance: 100, limit: 10}
+	before := m.nearContacts("a", q)
+	m.store.Close()
+
+	m = open()
+	defer m.store.Close()
+
+	if got, _ := m.contactsFor("a"); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("contacts got %v, want [b c]", got)
+	}
+	if got := m.nearContacts("a", q); !reflect.DeepEqual(got, before) || len(got) != 1 {
+		t.Errorf("after restart near got %+v, want %+v", got, before)
+	}
+	if got, want := m.stats(), (treeStats{Users: 3, Points: 2}); got != want {
+		t.Errorf("stats got %+v, want %+v", got, want)
+	}
+
+	// everything else about users survives too
+	ctx := context.Background()
+	m.requestContact(ctx, "a", "d")
+	m.requestContact(ctx, "e", "a")
+	m.confirmContact(ctx, "a", "e", false)
+	m.block(ctx, "b", "c")
+	m.addToGroup(ctx, "a", "family", []string{"b", "c"})
+	m.addToGroup(ctx, "a", "empty", []string{"a"})
+	m.addToGroup(ctx, "b", "work", []string{"gone2"})
+	m.updateLocation("gone2", 51.5, -0.1, 0)
+	m.removeUser(ctx, "gone2")
+	m.goDark(ctx, "c")
+	m.setVisibility(ctx, "b", false)
+	m.goOffline(ctx, "a")
+
+	state := func(m *manager) map[string]storedUser {
+		users := make(map[string]storedUser)
+		for id, u := range m.users {
+			users[id] = storedUser{id: id, contacts: sortedKeys(u.contacts), lastKnown: u.lastKnown, userState: userState{
+				pending:   sortedKeys(u.pending),
+				blocks:    sortedKeys(u.blocks),
+				groups:    make(map[string][]string),
+				dark:      u.dark,
+				invisible: u.invisible,
+			}}
+			for name, members := range u.groups {
+				users[id].groups[name] = sortedKeys(members)
+			}
+		}
+		return users
+	}
+
+	want := state(m)
+	if len(want["a"].pending) != 1 || !want["b"].invisible || !want["c"].dark || want["a"].lastKnown == nil {
+		t.Fatalf("state before restart is not what the test sets up: %+v", want)
+	}
+	m.store.Close()
+
+	m = open()
+	defer m.store.Close()
+
+	if got := state(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("after restart got\n%+v\nwant\n%+v", got, want)
+	}
+	if f, ok := m.lastKnownLocation("b", "a"); !ok || f.lat != 51.5 {
+		t.Errorf("last known location got %+v, %v", f, ok)
+	}
+	if got := m.stats(); got.Points != 0 {
+		t.Errorf("offline, dark and invisible users restored to the world: %+v", got)
+	}
+
+	// a failed batch leaves nothing behind
+	err := m.store.Batch(func(tx Store) error {
+		tx.SaveContacts("d", []string{"a"})
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("batch error was dropped")
+	}
+	users, _ := m.store.Load()
+	for _, su := range users {
+		if su.id == "d" {
+			t.Errorf("rolled back batch still wrote %+v", su)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	defer func(size int) { historySize = size }(historySize)
+	historySize = 3
+
+	m := newManager()
+	for i := 0; i < 5; i++ {
+		m.updateLocation("a", 51.5, float64(i), 0)
+	}
+
+	fixes, ok := m.history("a")
+	if !ok {
+		t.Fatal("unknown user")
+	}
+
+	var lons []float64
+	for _, f := range fixes {
+		lons = append(lons, f.lon)
+	}
+	if want := []float64{2, 3, 4}; !reflect.DeepEqual(lons, want) {
+		t.Errorf("got %v, want %v", lons, want)
+	}
+
+	w := do(newRouter(m), "GET", "/history?id=a", "")
+	var rsp struct {
+		History []map[string]interface{} `json:"history"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.History) != 3 || rsp.History[0]["lon"] != 2.0 {
+		t.Errorf("handler got %s", w.Body)
+	}
+
+	m.goDark(context.Background(), "a")
+	if fixes, _ := m.history("a"); len(fixes) != 0 {
+		t.Errorf("going dark kept %d fixes", len(fixes))
+	}
+}
+
+func TestPingAccuracy(t *testing.T) {
+	defer func(max float64) { maxAccuracy = max }(maxAccuracy)
+	maxAccuracy = 100
+
+	m := newManager()
+	befriend(m, "a", "b")
+	r := newRouter(m)
+
+	ping := func(lon, accuracy float64) {
+		body := fmt.Sprintf(`{"id":"b","location":{"lat":51.5,"lon":%v},"accuracy":%v}`, lon, accuracy)
+		if w := do(r, "POST", "/ping", body); w.Code != 200 {
+			t.Fatalf("ping got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	near := func(lon float64) []nearContact {
+		return m.nearContacts("a", nearQuery{lat: 51.5, lon: lon, distance: 10, limit: 10})
+	}
+
+	// a coarse first fix is not discoverable
+	ping(-0.1, 5000)
+	if got := near(-0.1); len(got) != 0 {
+		t.Errorf("coarse fix is discoverable: %+v", got)
+	}
+
+	// a fine fix is, with its accuracy
+	ping(-0.1, 8)
+	if got := near(-0.1); len(got) != 1 || got[0].Accuracy != 8 {
+		t.Errorf("fine fix got %+v", got)
+	}
+
+	// a coarse move leaves the discoverable location alone
+	ping(-0.2, 5000)
+	if got := near(-0.1); len(got) != 1 {
+		t.Errorf("coarse move changed discovery: %+v", got)
+	}
+
+	fixes, _ := m.history("b")
+	if len(fixes) != 3 || fixes[2].accuracy != 5000 {
+		t.Errorf("history is %+v, want all three fixes", fixes)
+	}
+
+	if w := do(r, "POST", "/ping", `{"id":"b","location":{"lat":1,"lon":1},"accuracy":-1}`); w.Code != 422 {
+		t.Errorf("negative accuracy got %d, want 422", w.Code)
+	}
+}
+
+func TestReset(t *testing.T) {
+	m := newManager()
+	m.addContacts(context.Background(), "a", []string{"b"})
+	m.updateLocation("a", 51.5, -0.1, 0)
+	m.updateLocation("b", 51.5, -0.1, 0)
+
+	r := newRouter(m)
+
+	if w := do(r, "POST", "/_reset", ""); w.Code != 200 {
+		t.Fatalf("reset got %d: %s", w.Code, w.Body)
+	}
+
+	if got := m.nearContacts("a", nearQuery{lat: 51.5, lon: -0.1, distance: 10, limit: 10}); len(got) != 0 {
+		t.Errorf("near after reset got %+v", got)
+	}
+
+	w := do(r, "POST", "/_all", `{"id":"x","location":{"lat":51.5,"lon":-0.1},"distance":10,"num_points":10}`)
+	if w.Body.String() != "[]" {
+		t.Errorf("all after reset got %s", w.Body)
+	}
+
+	// still usable
+	m.updateLocation("b", 51.5, -0.1, 0)
+	if s := m.stats(); s.Users != 1 || s.Points != 1 {
+		t.Errorf("stats after a ping got %+v", s)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := newManager()
+	m.now = func() time.Time { return now }
+	befriend(m, "a", "b", "never")
+	m.updateLocation("b", 51.5, -0.1, 0)
+
+	testData := []struct {
+		after time.Duration
+		want  string
+	}{
+		{0, "online"},
+		{presenceWindow, "online"},
+		{presenceWindow + time.Second, "offline"},
+	}
+
+	start := now
+	for _, d := range testData {
+		now = start.Add(d.after)
+
+		status, ok := m.contactPresence("a")
+		if !ok {
+			t.Fatal("unknown user")
+		}
+		if status["b"] != d.want {
+			t.Errorf("after %v got %s, want %s", d.after, status["b"], d.want)
+		}
+		if status["never"] != "offline" {
+			t.Errorf("never pinged contact is %s", status["never"])
+		}
+
+		near := m.nearContacts("a", nearQuery{lat: 51.5, lon: -0.1, distance: 10, limit: 10})
+		if len(near) != 1 || near[0].Presence != d.want {
+			t.Errorf("after %v near got %+v, want %s", d.after, near, d.want)
+		}
+	}
+}
+
+// TestConcurrentNearAndPing is for go test -race.
+func TestConcurrentNearAndPing(t *testing.T) {
+	m := newManager()
+	m.addContacts(context.Background(), "a", []string{"b", "c"})
+	m.pings = newLimiter(0, 0)
+	r := newRouter(m)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.updateLocation("b", 51.5, -0.1+float64(j)*0.00001, 0)
+				do(r, "POST", "/ping", `{"id":"c","location":{"lat":51.5,"lon":-0.1}}`)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.nearContacts("a", nearQuery{lat: 51.5, lon: -0.1, distance: 100, limit: 10})
+				m.contactsFor("a")
+				do(r, "GET", "/_all?id=x&lat=51.5&lon=-0.1&distance=100&num_points=10", "")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestConcurrentAllAndPing is for go test -race.
+func TestConcurrentAllAndPing(t *testing.T) {
+	m := newManager()
+	m.pings = newLimiter(0, 0)
+	r := newRouter(m)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				body := fmt.Sprintf(`{"id":"u%d","location":{"lat":51.5,"lon":%v}}`, i, -0.1+float64(j)*0.00001)
+				do(r, "POST", "/ping", body)
+				m.block(context.Background(), fmt.Sprintf("u%d", i), "admin")
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if w := do(r, "POST", "/_all", `{"id":"admin","location":{"lat":51.5,"lon":-0.1},"distance":100,"num_points":10,"limit":2}`); w.Code != 200 {
+					t.Errorf("all got %d: %s", w.Code, w.Body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Users anywhere on the globe, whatever the sign of their coordinates,
+// are found by /near and /_all alike.
+func TestWorldQuadrants(t *testing.T) {
+	cities := []struct {
+		id       string
+		lat, lon float64
+	}{
+		{"tokyo", 35.6762, 139.6503},
+		{"new_york", 40.7128, -74.006},
+		{"sydney", -33.8688, 151.2093},
+		{"sao_paulo", -23.5505, -46.6333},
+		{"date_line", -16.5, -179.99},
+		{"pole", 89.99, 0},
+	}
+
+	m := newManager()
+	r := newRouter(m)
+	for _, c := range cities {
+		befriend(m, "a", c.id)
+		if err := m.updateLocation(c.id, c.lat, c.lon, 0); err != nil {
+			t.Fatalf("%s: %v", c.id, err)
+		}
+	}
+
+	for _, c := range cities {
+		q := nearQuery{lat: c.lat, lon: c.lon, distance: 100, limit: 10}
+		if near := m.nearContacts("a", q); len(near) != 1 || near[0].Id != c.id {
+			t.Errorf("nearContacts at %s got %+v", c.id, near)
+		}
+
+		w := do(r, "GET", fmt.Sprintf("/_all?id=a&lat=%v&lon=%v&distance=100&num_points=10", c.lat, c.lon), "")
+		var all []allUser
+		if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil {
+			t.Fatalf("%s: %v: %s", c.id, err, w.Body)
+		}
+		if len(all) != 1 || all[0].Id != c.id || all[0].Lat != c.lat || all[0].Lon != c.lon {
+			t.Errorf("/_all at %s got %+v", c.id, all)
+		}
+	}
+
+	// a ping off the globe is refused rather than put anywhere
+	for _, p := range [][2]float64{{-90.1, 0}, {90.1, 0}, {0, -180.1}, {0, 180.1}} {
+		if err := m.updateLocation("lost", p[0], p[1], 0); err != errOutOfBounds {
+			t.Errorf("ping at %v got %v, want errOutOfBounds", p, err)
+		}
+	}
+	if m.known("lost") {
+		t.Error("out of bounds pings made a user")
+	}
+}
+
+// Each ping leaves the user's point, the one in the world and the one
+// they hold, at the latest location and carrying their id.
+func TestRepeatedPings(t *testing.T) {
+	m := newManager()
+	befriend(m, "viewer", "a")
+
+	pings := [][2]float64{{51.5, -0.1}, {51.51, -0.11}, {51.52, -0.12}}
+
+	for i, p := range pings {
+		if err := m.updateLocation("a", p[0], p[1], 0); err != nil {
+			t.Fatal(err)
+		}
+
+		u := m.users["a"]
+		if lat, lon := u.location.Coordinates(); lat != p[0] || lon != p[1] {
+			t.Errorf("ping %d: user holds %v,%v, want %v", i, lat, lon, p)
+		}
+		if id := u.location.Data().(*point).id; id != "a" {
+			t.Errorf("ping %d: point carries id %q", i, id)
+		}
+
+		if ids := pointsNear(m, p[0], p[1], 10); !reflect.DeepEqual(ids, []string{"a"}) {
+			t.Errorf("ping %d: world has %v at the new location, want [a]", i, ids)
+		}
+		for _, old := range pings[:i] {
+			if ids := pointsNear(m, old[0], old[1], 10); len(ids) != 0 {
+				t.Errorf("ping %d: world still has %v at %v", i, ids, old)
+			}
+		}
+
+		near := m.nearContacts("viewer", nearQuery{lat: p[0], lon: p[1], distance: 10, limit: 10})
+		if len(near) != 1 || near[0].Id != "a" || near[0].Distance != 0 {
+			t.Errorf("ping %d: nearContacts got %+v", i, near)
+		}
+	}
+
+	if got := m.stats().Points; got != 1 {
+		t.Errorf("world holds %d points, want 1", got)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+	befriend(m, "a", "b")
+	m.updateLocation("a", 51.5, -0.1, 0)
+	m.updateLocation("b", 51.5, -0.1, 0)
+
+	if w := do(r, "POST", "/user/delete", `{"id":"b"}`); w.Code != 200 {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+
+	if m.known("b") {
+		t.Error("deleted user still known")
+	}
+	if ids := pointsNear(m, 51.5, -0.1, 10); !reflect.DeepEqual(ids, []string{"a"}) {
+		t.Errorf("world has %v, want only [a]", ids)
+	}
+	if got, _ := m.contactsFor("a"); len(got) != 0 {
+		t.Errorf("survivor still has contacts %v", got)
+	}
+	if w := do(r, "GET", "/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points=10", ""); strings.Contains(w.Body.String(), `"b"`) {
+		t.Errorf("/_all still lists b: %s", w.Body)
+	}
+
+	if w := do(r, "POST", "/user/delete", `{"id":"b"}`); w.Code != 404 {
+		t.Errorf("deleting again got %d, want 404", w.Code)
+	}
+}
+
+func TestNearDistances(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "n1", "n2", "n3", "e1")
+	// due north a degree of latitude is earthRadius*pi/180 metres
+	m.updateLocation("n3", 51.503, -0.1, 0)
+	m.updateLocation("n1", 51.501, -0.1, 0)
+	m.updateLocation("e1", 51.5, -0.0984, 0)
+	m.updateLocation("n2", 51.502, -0.1, 0)
+	r := newRouter(m)
+
+	w := do(r, "POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":500,"verbose":true}`)
+	var rsp struct {
+		Contacts []nearContact `json:"contacts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+
+	perDegree := earthRadius * math.Pi / 180
+	want := []struct {
+		id     string
+		metres float64
+	}{
+		{"n1", 0.001 * perDegree},                               // 111.2m
+		{"e1", 0.0016 * perDegree * math.Cos(51.5*math.Pi/180)}, // 110.8m
+		{"n2", 0.002 * perDegree},
+		{"n3", 0.003 * perDegree},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].metres < want[j].metres })
+
+	if len(rsp.Contacts) != len(want) {
+		t.Fatalf("got %s", w.Body)
+	}
+	for i, c := range rsp.Contacts {
+		if i > 0 && c.Distance < rsp.Contacts[i-1].Distance {
+			t.Errorf("%s at %vm follows one at %vm", c.Id, c.Distance, rsp.Contacts[i-1].Distance)
+		}
+		if c.Id != want[i].id || math.Abs(c.Distance-want[i].metres) > 0.1 {
+			t.Errorf("contact %d got %s at %vm, want %s at %vm", i, c.Id, c.Distance, want[i].id, want[i].metres)
+		}
+	}
+
+	// without verbose only the ids, in the same order
+	w = do(r, "POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":500}`)
+	if got := strings.TrimSpace(w.Body.String()); got != `{"contacts":["e1","n1","n2","n3"]}` {
+		t.Errorf("plain /near got %s", got)
+	}
+}
+
+func TestHaversine(t *testing.T) {
+	// published great circle distances between city centres
+	data := []struct {
+		from, to string
+		lat1     float64
+		lon1     float64
+		lat2     float64
+		lon2     float64
+		km       float64
+	}{
+		{"London", "Paris", 51.5074, -0.1278, 48.8566, 2.3522, 344},
+		{"New York", "Los Angeles", 40.7128, -74.006, 34.0522, -118.2437, 3936},
+		{"Sydney", "Melbourne", -33.8688, 151.2093, -37.8136, 144.9631, 713},
+		{"London", "Tokyo", 51.5074, -0.1278, 35.6762, 139.6503, 9560},
+	}
+
+	for _, d := range data {
+		got := haversine(d.lat1, d.lon1, d.lat2, d.lon2) / 1000
+		if math.Abs(got-d.km)/d.km > 0.01 {
+			t.Errorf("%s to %s got %.0fkm, want %.0fkm within 1%%", d.from, d.to, got, d.km)
+		}
+		if back := haversine(d.lat2, d.lon2, d.lat1, d.lon1) / 1000; back != got {
+			t.Errorf("%s to %s is %vkm one way and %vkm back", d.from, d.to, got, back)
+		}
+	}
+}
+
+// The quadtree box is only a prefilter: contacts in its corners, or a
+// degree of longitude away at 60N where it is half as long as at the
+// equator, are kept or dropped by their true distance.
+func TestNearGreatCircle(t *testing.T) {
+	perDegree := earthRadius * math.Pi / 180
+
+	for _, lat := range []float64{0, 60} {
+		east := func(metres float64) float64 { return -0.1 + metres/(perDegree*math.Cos(lat*math.Pi/180)) }
+		north := func(metres float64) float64 { return lat + metres/perDegree }
+
+		m := newManager()
+		befriend(m, "a", "in", "out", "corner")
+		m.updateLocation("in", lat, east(9), 0)
+		m.updateLocation("out", lat, east(11), 0)
+		m.updateLocation("corner", north(8), east(8), 0) // 11.3m
+
+		var ids []string
+		for _, c := range m.nearContacts("a", nearQuery{lat: lat, lon: -0.1, distance: 10, limit: 10}) {
+			ids = append(ids, c.Id)
+		}
+		if !reflect.DeepEqual(ids, []string{"in"}) {
+			t.Errorf("at %vN got %v, want [in]", lat, ids)
+		}
+	}
+}
+
+func TestNearRadiusAndCount(t *testing.T) {
+	defer func(d float64, n int) { nearestDistance, nearestContacts = d, n }(nearestDistance, nearestContacts)
+	nearestDistance, nearestContacts = 10, 5
+
+	m := newManager()
+	befriend(m, "a", "c0", "c1", "c2", "c3", "c4", "c5", "far")
+	for i := 0; i < 6; i++ {
+		m.updateLocation(fmt.Sprintf("c%d", i), 51.5, -0.1+float64(i)*0.00001, 0)
+	}
+	m.updateLocation("far", 51.501, -0.1, 0) // 111m north
+	r := newRouter(m)
+
+	data := []struct {
+		extra string
+		code  int
+		want  string
+	}{
+		// the package defaults when left out
+		{``, 200, `{"contacts":["c0","c1","c2","c3","c4"]}`},
+		{`,"distance":10,"num_points":10`, 200, `{"contacts":["c0","c1","c2","c3","c4","c5"]}`},
+		{`,"distance":200,"num_points":10`, 200, `{"contacts":["c0","c1","c2","c3","c4","c5","far"]}`},
+		{`,"distance":200,"num_points":2`, 200, `{"contacts":["c0","c1"]}`},
+		{`,"distance":0`, 400, "Bad Request. distance must be positive."},
+		{`,"distance":-5`, 400, "Bad Request. distance must be positive."},
+		{`,"num_points":0`, 400, fmt.Sprintf("Bad Request. num_points must be between 1 and %d.", maxContacts)},
+		{fmt.Sprintf(`,"num_points":%d`, maxContacts+1), 400, fmt.Sprintf("Bad Request. num_points must be between 1 and %d.", maxContacts)},
+	}
+
+	for _, d := range data {
+		w := do(r, "POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1}`+d.extra+`}`)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("%q got %d %s, want %d %s", d.extra, w.Code, got, d.code, d.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	defer func(s bool) { strictJSON = s }(strictJSON)
+
+	r := newRouter(newManager())
+
+	data := []struct {
+		strict bool
+		path   string
+		body   string
+		code   int
+		want   string
+	}{
+		// malformed
+		{false, "/ping", ``, 400, "Bad Request. Empty body."},
+		{false, "/ping", `{"id":"a",`, 400, "Bad Request. Malformed JSON, unexpected end of body."},
+		{false, "/ping", `{"id" "a"}`, 400, "Bad Request. Malformed JSON at offset 7."},
+		{false, "/ping", `["a"]`, 400, "Bad Request. Body must be a JSON object."},
+		{false, "/contacts", `"a"`, 400, "Bad Request. Body must be a JSON object."},
+		// wrong types, a numeric id included, where only decoded
+		{false, "/near", `{"id":1,"location":{"lat":51.5,"lon":-0.1}}`, 400, "Bad Request. Invalid id, expected string got number."},
+		{false, "/near", `{"id":"a","location":{"lat":"51.5","lon":-0.1}}`, 400, "Bad Request. Invalid location.lat, expected float64 got string."},
+		{false, "/near", `{"id":"a","location":[51.5,-0.1]}`, 400, "Bad Request. Invalid location, expected main.location got array."},
+		// and named among the fields where validated
+		{false, "/ping", `{"id":1,"location":{"lat":51.5,"lon":-0.1}}`, 422, `{"error":"validation_failed","fields":{"id":"expected string"}}`},
+		{false, "/ping", `{"id":"a","location":{"lat":"51.5","lon":-0.1}}`, 422, `{"error":"validation_failed","fields":{"location.lat":"expected number"}}`},
+		{false, "/contacts", `{"id":"a","contacts":"b"}`, 422, `{"error":"validation_failed","fields":{"contacts":"expected array"}}`},
+		{false, "/contacts", `{"id":"a","contacts":[1]}`, 422, `{"error":"validation_failed","fields":{"contacts.0":"expected string"}}`},
+		// unknown fields, only refused with -strict-json
+		{true, "/ping", `{"id":"a","lat":51.5}`, 400, `Bad Request. Unexpected field "lat".`},
+		// missing fields pass decoding and fail validation by name
+		{false, "/ping", `{}`, 422, `{"error":"validation_failed","fields":{"id":"required","location":"required"}}`},
+		{false, "/ping", `{"id":"a","location":{"lat":51.5}}`, 422, `{"error":"validation_failed","fields":{"location.lon":"required"}}`},
+		{false, "/contacts", `{"id":"a"}`, 422, `{"error":"validation_failed","fields":{"contacts":"required"}}`},
+	}
+
+	for _, d := range data {
+		strictJSON = d.strict
+
+		w := do(r, "POST", d.path, d.body)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("%s %s got %d %s, want %d %s", d.path, d.body, w.Code, got, d.code, d.want)
+		}
+	}
+}
+
+func TestNearAltitude(t *testing.T) {
+	now := time.Now()
+	m := newManager()
+	m.now = func() time.Time { return now }
+	r := newRouter(m)
+	befriend(m, "a", "same_floor", "upstairs", "beside")
+	m.updateLocation("same_floor", 51.5, -0.1, 3)
+	m.updateLocation("upstairs", 51.5, -0.1, 33)
+	m.updateLocation("beside", 51.5, -0.09991, 3) // about 6m east
+
+	data := []struct {
+		body string
+		code int
+		want string
+	}{
+		// without altitude everyone at the spot is near
+		{`{"id":"a","location":{"lat":51.5,"lon":-0.1,"alt":3},"distance":10}`, 200, `{"contacts":["same_floor","upstairs","beside"]}`},
+		{`{"id":"a","location":{"lat":51.5,"lon":-0.1,"alt":3},"distance":10,"altitude":true}`, 200, `{"contacts":["same_floor","beside"]}`},
+		{`{"id":"a","location":{"lat":51.5,"lon":-0.1,"alt":33},"distance":10,"altitude":true}`, 200, `{"contacts":["upstairs"]}`},
+		{`{"id":"a","location":{"lat":51.5,"lon":-0.1,"alt":3},"distance":40,"altitude":true}`, 200, `{"contacts":["same_floor","beside","upstairs"]}`},
+		{`{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":10,"altitude":true}`, 400, "Bad Request. Could not find altitude."},
+	}
+
+	for _, d := range data {
+		w := do(r, "POST", "/near", d.body)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("%s got %d %s, want %d %s", d.body, w.Code, got, d.code, d.want)
+		}
+	}
+
+	// the vertical separation joins the distance, 30m straight up
+	w := do(r, "POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1,"alt":3},"distance":40,"altitude":true,"verbose":true}`)
+	var rsp struct {
+		Contacts []nearContact `json:"contacts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if c := rsp.Contacts[2]; c.Id != "upstairs" || c.Distance != 30 {
+		t.Errorf("got %+v, want upstairs 30m away", c)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	m := newManager()
+	m.now = func() time.Time { return now }
+	befriend(m, "a", "b", "c", "hidden", "blocker")
+	m.updateLocation("b", 51.5001, -0.1, 0)
+	m.updateLocation("c", 51.5003, -0.1, 12)
+	m.updateLocation("hidden", 51.5, -0.1, 0)
+	m.setVisibility(ctx, "hidden", false)
+	m.updateLocation("blocker", 51.5, -0.1, 0)
+	m.block(ctx, "blocker", "a")
+	m.addToGroup(ctx, "a", "close", []string{"b"})
+	m.updateLocations(ctx, []locationUpdate{{id: "b", lat: 51.5002, lon: -0.1, accuracy: 8}})
+	m.addGeofence(ctx, "b", 51.5, -0.1, 50, "home")
+	m.addPolygonFence(ctx, "b", [][2]float64{{51.6, -0.2}, {51.6, -0.1}, {51.7, -0.1}}, "park")
+
+	q := nearQuery{lat: 51.5, lon: -0.1, distance: 100, limit: 10}
+	before := m.nearContacts("a", q)
+	if len(before) != 2 || before[0].Accuracy != 8 {
+		t.Fatalf("near before save got %+v", before)
+	}
+	history, _ := m.history("b")
+	if len(history) != 2 || len(m.users["b"].fences) != 2 || !m.users["b"].fences[0].inside {
+		t.Fatalf("b before save has history %+v and fences %+v", history, m.users["b"].fences)
+	}
+
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newManager()
+	loaded.now = m.now
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loaded.nearContacts("a", q); !reflect.DeepEqual(got, before) {
+		t.Errorf("after load got %+v, want %+v", got, before)
+	}
+	q.group = "close"
+	if got := loaded.nearContacts("a", q); len(got) != 1 || got[0].Id != "b" {
+		t.Errorf("group after load got %+v", got)
+	}
+	if got, want := loaded.stats(), m.stats(); got != want {
+		t.Errorf("stats after load %+v, want %+v", got, want)
+	}
+	if got, _ := loaded.history("b"); !reflect.DeepEqual(got, history) {
+		t.Errorf("history after load got %+v, want %+v", got, history)
+	}
+	if got, want := loaded.users["b"].fences, m.users["b"].fences; !reflect.DeepEqual(got, want) {
+		t.Errorf("fences after load got %+v, want %+v", got, want)
+	}
+
+	// no file starts empty, a corrupt one is an error
+	empty := newManager()
+	if err := empty.Load(filepath.Join(t.TempDir(), "missing.json")); err != nil || len(empty.users) != 0 {
+		t.Errorf("missing file got %v with %d users", err, len(empty.users))
+	}
+	os.WriteFile(path, []byte(`{"users":[`), 0600)
+	if err := newManager().Load(path); err == nil {
+		t.Error("corrupt file loaded without error")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	// hold /ping open until shutdown has begun
+	started, release := make(chan struct{}), make(chan struct{})
+	router := newRouter(newManager())
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			close(started)
+			<-release
+		}
+		router.ServeHTTP(w, r)
+	})}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	type result struct {
+		code int
+		err  error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		rsp, err := http.Post("http://"+addr+"/ping", "application/json", strings.NewReader(`{"id":"a","location":{"lat":51.5,"lon":-0.1}}`))
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		rsp.Body.Close()
+		inflight <- result{code: rsp.StatusCode}
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- srv.Shutdown(ctx)
+	}()
+
+	// the listener closes straight away, before the ping finishes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting connections after shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned with a request in flight")
+	default:
+	}
+
+	close(release)
+	if res := <-inflight; res.err != nil || res.code != 200 {
+		t.Errorf("in flight ping got %d, %v", res.code, res.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("shutdown got %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("serve got %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	testData := []struct {
+		addr string
+		set  bool
+		env  string
+		want string
+		ok   bool
+	}{
+		{":9999", false, "", ":9999", true},
+		{":9999", false, ":8080", ":8080", true},
+		{":7000", true, ":8080", ":7000", true},
+		{":7000", true, "", ":7000", true},
+		{":9999", false, "127.0.0.1:8080", "127.0.0.1:8080", true},
+		{":9999", false, "8080", "", false},
+		{":9999", false, ":http", "", false},
+		{":99999", true, "", "", false},
+		{"localhost", true, ":8080", "", false},
+	}
+
+	for _, d := range testData {
+		got, err := listenAddr(d.addr, d.set, d.env)
+		if ok := err == nil; ok != d.ok || got != d.want {
+			t.Errorf("listenAddr(%q, %v, %q) got %q, %v, want %q", d.addr, d.set, d.env, got, err, d.want)
+		}
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	saved := newManager()
+	saved.updateLocation("a", 51.5, -0.1, 0)
+	if err := saved.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newManager()
+	r := newRouter(m)
+
+	// alive but not ready while loading
+	w := do(r, "GET", "/health", "")
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"status":"ok"}` {
+		t.Errorf("health got %d: %s", w.Code, w.Body)
+	}
+	if w := do(r, "GET", "/ready", ""); w.Code != 503 {
+		t.Errorf("ready before load got %d: %s", w.Code, w.Body)
+	}
+
+	if err := m.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	m.setReady()
+
+	if w := do(r, "GET", "/ready", ""); w.Code != 200 {
+		t.Errorf("ready after load got %d: %s", w.Code, w.Body)
+	}
+	if w := do(r, "GET", "/health", ""); w.Code != 200 {
+		t.Errorf("health after load got %d: %s", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/health", "/ready"} {
+		if w := do(r, "POST", path, ""); w.Code != 405 || w.Header().Get("Allow") != "GET" {
+			t.Errorf("POST %s got %d, Allow %q", path, w.Code, w.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	defer func(dm *metrics) { defaultMetrics = dm }(defaultMetrics)
+	defaultMetrics = newMetrics()
+
+	m := newManager()
+	r := newRouter(m)
+	befriend(m, "b", "a")
+
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5001,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":91,"lon":-0.1}}`)
+	for i := 0; i < 3; i++ {
+		do(r, "GET", "/near?id=a&lat=51.5&lon=-0.1", "")
+	}
+
+	w := do(r, "GET", "/metrics", "")
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("metrics got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	values := map[string]string{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if i := strings.LastIndex(line, " "); i > 0 && !strings.HasPrefix(line, "#") {
+			values[line[:i]] = line[i+1:]
+		}
+	}
+
+	testData := map[string]string{
+		`remindme_requests_total{handler="/ping",code="200"}`: "2",
+		`remindme_requests_total{handler="/ping",code="422"}`: "1",
+		`remindme_requests_total{handler="/near",code="200"}`: "3",
+		`remindme_near_contacts_seconds_count`:                "3",
+		`remindme_near_contacts_seconds_bucket{le="+Inf"}`:    "3",
+		`remindme_users`: "2",
+	}
+	for name, want := range testData {
+		if got := values[name]; got != want {
+			t.Errorf("%s got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExpireLocations(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newManager()
+	m.now = func() time.Time { return now }
+	r := newRouter(m)
+
+	do(r, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+
+	near := func(id string) string {
+		return strings.TrimSpace(do(r, "GET", "/near?lat=51.5&lon=-0.1&id="+id, "").Body.String())
+	}
+	all := func() []string {
+		var users []allUser
+		json.Unmarshal(do(r, "GET", "/_all?id=x&lat=51.5&lon=-0.1&distance=100&num_points=10", "").Body.Bytes(), &users)
+		var ids []string
+		for _, u := range users {
+			ids = append(ids, u.Id)
+		}
+		return ids
+	}
+
+	// b keeps pinging, a goes quiet
+	now = now.Add(20 * time.Minute)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+
+	if n := m.expireLocations(context.Background(), 30*time.Minute); n != 0 {
+		t.Errorf("expired %d within the ttl", n)
+	}
+	if got := near("b"); got != `{"contacts":["a"]}` {
+		t.Fatalf("before the ttl got %s", got)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if n := m.expireLocations(context.Background(), 30*time.Minute); n != 1 {
+		t.Errorf("expired %d, want 1", n)
+	}
+	if got := near("b"); got != `{"contacts":[]}` {
+		t.Errorf("expired user still near: %s", got)
+	}
+	if got := near("a"); got != `{"contacts":["b"]}` {
+		t.Errorf("expired user lost their view: %s", got)
+	}
+	if got := all(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("/_all after expiry got %v", got)
+	}
+	if got, _ := m.contactsFor("a"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("contacts got %v after expiry", got)
+	}
+
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	if got := near("b"); got != `{"contacts":["a"]}` {
+		t.Errorf("after pinging again got %s", got)
+	}
+	if got := all(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("/_all after pinging again got %v", got)
+	}
+}
+
+func TestListContacts(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["zed","b","mo","c"]}`)
+	do(r, "POST", "/ping", `{"id":"loner","location":{"lat":51.5,"lon":-0.1}}`)
+
+	testData := []struct {
+		method string
+		path   string
+		code   int
+		want   string
+	}{
+		{"GET", "/contacts/list?id=a", 200, `{"contacts":["b","c","mo","zed"]}`},
+		{"GET", "/contacts/list?id=loner", 200, `{"contacts":[]}`},
+		// added as a contact but never seen themselves
+		{"GET", "/contacts/list?id=b", 404, "Not Found. Unknown user."},
+		{"GET", "/contacts/list?id=nobody", 404, "Not Found. Unknown user."},
+		{"GET", "/contacts/list", 400, "Bad Request. Could not find id."},
+		{"POST", "/contacts/list?id=a", 405, "Method Not Allowed. Use GET."},
+	}
+
+	for _, d := range testData {
+		w := do(r, d.method, d.path, "")
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("%s %s got %d %s, want %d %s", d.method, d.path, w.Code, got, d.code, d.want)
+		}
+	}
+
+	// the map behind it is unordered, the list isn't
+	for i := 0; i < 20; i++ {
+		if got, _ := m.contactsFor("a"); !reflect.DeepEqual(got, []string{"b", "c", "mo", "zed"}) {
+			t.Fatalf("call %d got %v", i, got)
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+
+	for _, body := range []string{
+		`{"id":"a","contacts":["b","c"]}`,
+		`{"id":"b","contacts":["a"]}`,
+		`{"id":"c","contacts":["a"]}`,
+	} {
+		do(r, "POST", "/contacts", body)
+	}
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5001,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"c","location":{"lat":51.5002,"lon":-0.1}}`)
+
+	near := func(id string) string {
+		return strings.TrimSpace(do(r, "GET", "/near?lat=51.5&lon=-0.1&distance=100&id="+id, "").Body.String())
+	}
+	all := func(id string) []string {
+		var users []allUser
+		json.Unmarshal(do(r, "GET", "/_all?lat=51.5&lon=-0.1&distance=100&num_points=10&id="+id, "").Body.Bytes(), &users)
+		var ids []string
+		for _, u := range users {
+			ids = append(ids, u.Id)
+		}
+		return ids
+	}
+
+	if got := near("a"); got != `{"contacts":["b","c"]}` {
+		t.Fatalf("before blocking got %s", got)
+	}
+
+	if w := do(r, "POST", "/block", `{"id":"b","target":"a"}`); w.Code != 200 {
+		t.Fatalf("block got %d: %s", w.Code, w.Body)
+	}
+
+	// a still has b as a contact and b still has a, but b is gone
+	if got := near("a"); got != `{"contacts":["c"]}` {
+		t.Errorf("blocked viewer got %s", got)
+	}
+	if got := all("a"); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("/_all for the blocked viewer got %v", got)
+	}
+	if got, _ := m.contactsFor("a"); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("blocking changed contacts to %v", got)
+	}
+
+	// it only works one way and only against a
+	if got := near("b"); got != `{"contacts":["a"]}` {
+		t.Errorf("blocker got %s", got)
+	}
+	if got := all("c"); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("/_all for others got %v", got)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newManager()
+	m.now = func() time.Time { return now }
+	r := newRouter(m)
+
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+	do(r, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+
+	near := func() string {
+		return strings.TrimSpace(do(r, "GET", "/near?id=a&lat=51.5&lon=-0.1&distance=100", "").Body.String())
+	}
+	all := func() []allUser {
+		var users []allUser
+		json.Unmarshal(do(r, "GET", "/_all?id=a&lat=51.5&lon=-0.1&distance=100&num_points=10", "").Body.Bytes(), &users)
+		return users
+	}
+
+	if got := near(); got != `{"contacts":["b"]}` {
+		t.Fatalf("before hiding got %s", got)
+	}
+
+	if w := do(r, "POST", "/visibility", `{"id":"b","visible":false}`); w.Code != 200 {
+		t.Fatalf("hiding got %d: %s", w.Code, w.Body)
+	}
+
+	// pinging while hidden moves b without putting them back
+	for i, lat := range []float64{51.5003, 51.5005} {
+		now = now.Add(time.Minute)
+		do(r, "POST", "/ping", fmt.Sprintf(`{"id":"b","location":{"lat":%v,"lon":-0.1}}`, lat))
+
+		if got := near(); got != `{"contacts":[]}` {
+			t.Errorf("hidden ping %d got %s", i, got)
+		}
+		if got := all(); len(got) != 1 || got[0].Id != "a" {
+			t.Errorf("hidden ping %d /_all got %+v", i, got)
+		}
+
+		m.RLock()
+		seen := m.users["b"].lastSeen
+		m.RUnlock()
+		if !seen.Equal(now) {
+			t.Errorf("hidden ping %d last seen %v, want %v", i, seen, now)
+		}
+	}
+
+	// showing again puts b where they last were
+	if w := do(r, "POST", "/visibility", `{"id":"b","visible":true}`); w.Code != 200 {
+		t.Fatalf("showing got %d: %s", w.Code, w.Body)
+	}
+	if got := near(); got != `{"contacts":["b"]}` {
+		t.Errorf("after showing got %s", got)
+	}
+	if got := all(); len(got) != 2 || got[1].Id != "b" || got[1].Lat != 51.5005 {
+		t.Errorf("after showing /_all got %+v", got)
+	}
+
+	// and pings move them as usual
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.6,"lon":-0.1}}`)
+	if got := near(); got != `{"contacts":[]}` {
+		t.Errorf("after moving away got %s", got)
+	}
+
+	if w := do(r, "POST", "/visibility", `{"id":"nobody","visible":false}`); w.Code != 404 {
+		t.Errorf("unknown user got %d, want 404", w.Code)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b","c"]}`)
+	do(r, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.501,"lon":-0.1}}`)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/subscribe?id=a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the handler registers after the upgrade
+	for i := 0; ; i++ {
+		m.RLock()
+		n := len(m.subscribers["a"])
+		m.RUnlock()
+		if n > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// c isn't mutual so coming near says nothing, b is
+	do(r, "POST", "/ping", `{"id":"c","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.50003,"lon":-0.1}}`)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var e event
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "near" || e.Id != "b" || e.Distance > nearestDistance {
+		t.Errorf("got %+v, want b near", e)
+	}
+
+	// nothing more until b leaves and comes back
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := conn.ReadJSON(&e); err == nil {
+		t.Errorf("got another event %+v", e)
+	}
+}
+
+func TestContactsAddedSkipped(t *testing.T) {
+	r := newRouter(newManager())
+
+	// the same overlapping batch twice, each reporting only what it did
+	steps := []struct {
+		body string
+		want string
+	}{
+		{`{"id":"a","contacts":["b","c","d"]}`, `{"added":3,"skipped":[]}`},
+		{`{"id":"a","contacts":["c","d","e"]}`, `{"added":1,"skipped":["c","d"]}`},
+		{`{"id":"a","contacts":["c","d","e"]}`, `{"added":0,"skipped":["c","d","e"]}`},
+		{`{"id":"a","contacts":["f","b","f"]}`, `{"added":1,"skipped":["b"]}`},
+	}
+
+	for i, s := range steps {
+		w := do(r, "POST", "/contacts", s.body)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != 200 || got != s.want {
+			t.Errorf("step %d got %d %s, want %s", i, w.Code, got, s.want)
+		}
+	}
+
+	w := do(r, "GET", "/contacts/list?id=a", "")
+	if got := strings.TrimSpace(w.Body.String()); got != `{"contacts":["b","c","d","e","f"]}` {
+		t.Errorf("stored %s", got)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	r := newRouter(newManager())
+
+	// in order, each succeeding with JSON
+	steps := []struct {
+		method, path, body string
+		want               string
+	}{
+		{"POST", "/contacts", `{"id":"a","contacts":["b"]}`, `{"added":1,"skipped":[]}`},
+		{"POST", "/contacts", `{"id":"b","contacts":["a"]}`, `{"added":1,"skipped":[]}`},
+		{"POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`, `{"ok":true}`},
+		{"POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`, `{"ok":true}`},
+		{"GET", "/near?id=a&lat=51.5&lon=-0.1", "", `{"contacts":["b"]}`},
+		{"POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`, `{"contacts":["b"]}`},
+		{"GET", "/contacts/list?id=a", "", `{"contacts":["b"]}`},
+		{"POST", "/visibility", `{"id":"b","visible":false}`, `{"ok":true}`},
+		{"POST", "/block", `{"id":"a","target":"b"}`, `{"ok":true}`},
+		{"POST", "/go-dark", `{"id":"a"}`, `{"ok":true}`},
+		{"POST", "/go-live", `{"id":"a"}`, `{"ok":true}`},
+		{"POST", "/offline", `{"id":"a"}`, `{"ok":true}`},
+		{"GET", "/health", "", `{"status":"ok"}`},
+	}
+
+	for i, s := range steps {
+		w := do(r, s.method, s.path, s.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("step %d %s %s got %d: %s", i, s.method, s.path, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("step %d %s %s content type %q", i, s.method, s.path, ct)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != s.want {
+			t.Errorf("step %d %s %s got %s, want %s", i, s.method, s.path, got, s.want)
+		}
+	}
+}
+
+func TestValidateCoords(t *testing.T) {
+	testData := []struct {
+		lat, lon float64
+		err      string
+	}{
+		{0, 0, ""},
+		{90, 180, ""},
+		{-90, -180, ""},
+		{89.999999, -179.999999, ""},
+		{90.000001, 0, "latitude 90.000001 is outside [-90, 90]"},
+		{-90.000001, 0, "latitude -90.000001 is outside [-90, 90]"},
+		{0, 180.000001, "longitude 180.000001 is outside [-180, 180]"},
+		{0, -181, "longitude -181 is outside [-180, 180]"},
+		{math.NaN(), 0, "latitude must be a finite number"},
+		{math.Inf(1), 0, "latitude must be a finite number"},
+		{0, math.NaN(), "longitude must be a finite number"},
+		{0, math.Inf(-1), "longitude must be a finite number"},
+	}
+
+	for _, d := range testData {
+		err := validateCoords(d.lat, d.lon)
+		if got := fmt.Sprint(err); (err == nil) != (d.err == "") || (err != nil && got != d.err) {
+			t.Errorf("validateCoords(%v, %v) got %v, want %q", d.lat, d.lon, err, d.err)
+		}
+	}
+
+	// and the handlers taking coordinates in a query
+	r := newRouter(newManager())
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+
+	queries := []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"lat=90&lon=180", 200, ""},
+		{"lat=-90&lon=-180", 200, ""},
+		{"lat=90.5&lon=0", 400, "Bad Request. Invalid location, latitude 90.5 is outside [-90, 90]."},
+		{"lat=0&lon=-180.5", 400, "Bad Request. Invalid location, longitude -180.5 is outside [-180, 180]."},
+		{"lat=NaN&lon=0", 400, "Bad Request. Invalid location, latitude must be a finite number."},
+		{"lat=-Inf&lon=0", 400, "Bad Request. Invalid location, latitude must be a finite number."},
+		{"lat=0&lon=Inf", 400, "Bad Request. Invalid location, longitude must be a finite number."},
+	}
+
+	for _, path := range []string{"/near?id=a&", "/_all?id=a&distance=10&num_points=10&"} {
+		for _, q := range queries {
+			w := do(r, "GET", path+q.query, "")
+			if got := strings.TrimSpace(w.Body.String()); w.Code != q.code || (q.code != 200 && got != q.want) {
+				t.Errorf("GET %s%s got %d %s, want %d %s", path, q.query, w.Code, got, q.code, q.want)
+			}
+		}
+	}
+}
+
+func TestFollowers(t *testing.T) {
+	r := newRouter(newManager())
+
+	// a is had by b, d and e; c had a but removes them
+	for _, body := range []string{
+		`{"id":"a","contacts":["b","c"]}`,
+		`{"id":"b","contacts":["a","c"]}`,
+		`{"id":"c","contacts":["a"]}`,
+		`{"id":"d","contacts":["a"]}`,
+		`{"id":"e","contacts":["x","a"]}`,
+	} {
+		do(r, "POST", "/contacts", body)
+	}
+	do(r, "POST", "/contacts/remove", `{"id":"c","contacts":["a"]}`)
+
+	testData := []struct {
+		id   string
+		code int
+		want string
+	}{
+		{"a", 200, `{"followers":["b","d","e"]}`},
+		{"b", 200, `{"followers":["a"]}`},
+		{"c", 200, `{"followers":["a","b"]}`},
+		{"x", 200, `{"followers":["e"]}`},
+		{"nobody", 200, `{"followers":[]}`},
+		{"", 400, "Bad Request. Could not find id."},
+	}
+
+	for _, d := range testData {
+		w := do(r, "GET", "/followers?id="+d.id, "")
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("%q got %d %s, want %d %s", d.id, w.Code, got, d.code, d.want)
+		}
+	}
+}
+
+func TestPingLog(t *testing.T) {
+	buf := captureLogs(t)
+	m := newManager()
+
+	// the first ping is a new user, the next a move
+	m.updateLocation("a", 51.5, -0.1, 0)
+	m.updateLocation("a", 51.6, -0.2, 0)
+
+	want := []map[string]interface{}{
+		{"level": "INFO", "msg": "new user", "event": "new_user", "user_id": "a", "lat": 51.5, "lon": -0.1},
+		{"level": "INFO", "msg": "user moved", "event": "ping", "user_id": "a", "lat": 51.6, "lon": -0.2},
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d: %s", len(lines), len(want), buf)
+	}
+	for i, line := range lines {
+		for k, v := range want[i] {
+			if line[k] != v {
+				t.Errorf("line %d %s got %v, want %v", i, k, line[k], v)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(line["time"])); err != nil {
+			t.Errorf("line %d time got %v: %v", i, line["time"], err)
+		}
+	}
+
+	// -log-level warn leaves pings out
+	buf.Reset()
+	logLevel.Set(slog.LevelWarn)
+	m.updateLocation("a", 51.7, -0.1, 0)
+	if buf.Len() > 0 {
+		t.Errorf("logged below the level: %s", buf)
+	}
+}
+
+// captureLogs sends log lines at info and above to the returned buffer
+// until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	l, level := logger, logLevel.Level()
+	t.Cleanup(func() {
+		logger = l
+		logLevel.Set(level)
+	})
+
+	var buf bytes.Buffer
+	logLevel.Set(slog.LevelInfo)
+	logger = slog.New(contextHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: logLevel})})
+	return &buf
+}
+
+// logLines decodes each JSON log line written to buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines = append(lines, v)
+	}
+	return lines
+}
+
+func TestRequestID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ping := `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`
+
+	data := []struct {
+		sent   string
+		want   func(string) bool
+		path   string
+		body   string
+		events []string
+	}{
+		{"client-1", func(id string) bool { return id == "client-1" }, "/ping", ping, []string{"new_user", "request"}},
+		{"", uuid.MatchString, "/ping", ping, []string{"new_user", "request"}},
+		{"client-2", func(id string) bool { return id == "client-2" }, "/contacts/set", `{"id":"a","contacts":["b"]}`, []string{"new_user", "set_contacts", "request"}},
+	}
+
+	for _, d := range data {
+		buf := captureLogs(t)
+		h := withRequestID(newRouter(newManager()))
+
+		r := httptest.NewRequest("POST", d.path, strings.NewReader(d.body))
+		if len(d.sent) > 0 {
+			r.Header.Set("X-Request-ID", d.sent)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		id := w.Header().Get("X-Request-ID")
+		if !d.want(id) {
+			t.Errorf("sent %q, got header %q", d.sent, id)
+		}
+
+		// the manager's own events carry it, not just the access log
+		events := make(map[interface{}]bool)
+		for _, line := range logLines(t, buf) {
+			events[line["event"]] = true
+			if line["request_id"] != id {
+				t.Errorf("%s sent %q, %v logged with request_id %v, want %s", d.path, d.sent, line["event"], line["request_id"], id)
+			}
+		}
+		for _, event := range d.events {
+			if !events[event] {
+				t.Errorf("%s sent %q, logged events %v, want %v", d.path, d.sent, events, d.events)
+			}
+		}
+	}
+}
+
+func TestBulkPing(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+
+	body := `{"updates":[
+		{"id":"a","location":{"lat":51.5,"lon":-0.1}},
+		{"location":{"lat":51.5,"lon":-0.1}},
+		{"id":"b","location":{"lat":91,"lon":-0.1}},
+		{"id":"c","location":{"lat":51.5,"lon":-0.1},"accuracy":-5},
+		{"id":"d"},
+		{"id":"e","location":{"lat":51.5001,"lon":-0.1}}
+	]}`
+
+	w := do(r, "POST", "/ping/bulk", body)
+	if w.Code != 200 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	var res struct {
+		Results []bulkPingResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	// every entry answered in place, the bad ones alone failing
+	want := []struct {
+		id string
+		ok bool
+	}{{"a", true}, {"", false}, {"b", false}, {"c", false}, {"d", false}, {"e", true}}
+	if len(res.Results) != len(want) {
+		t.Fatalf("got %d results, want %d: %s", len(res.Results), len(want), w.Body)
+	}
+	for i, d := range want {
+		got := res.Results[i]
+		if got.Id != d.id || got.Ok != d.ok || got.Ok == (len(got.Error) > 0) {
+			t.Errorf("result %d got %+v, want %s ok %v", i, got, d.id, d.ok)
+		}
+	}
+
+	ids := pointsNear(m, 51.5, -0.1, 100)
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"a", "e"}) {
+		t.Errorf("located %v, want [a e]", ids)
+	}
+}
+
+// selfSigned writes a certificate for 127.0.0.1 and its key as PEM
+// files, returning their paths.
+func selfSigned(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "remindme test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cert, priv := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(priv, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, priv
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile := selfSigned(t)
+
+	// as main loads them, a mismatched pair failing up front
+	if _, err := tls.LoadX509KeyPair(certFile, certFile); err == nil {
+		t.Error("loaded a cert as its own key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   newRouter(newManager()),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pemCert, _ := os.ReadFile(certFile)
+	pool.AppendCertsFromPEM(pemCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	url := "https://" + ln.Addr().String()
+
+	rsp, err := client.Post(url+"/ping", "application/json", strings.NewReader(`{"id":"a","location":{"lat":51.5,"lon":-0.1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 || rsp.TLS == nil || strings.TrimSpace(string(b)) != `{"ok":true}` {
+		t.Errorf("ping over TLS got %d %s", rsp.StatusCode, b)
+	}
+
+	// plain http and untrusting clients get nowhere
+	if rsp, err := http.Get("http://" + ln.Addr().String() + "/health"); err == nil {
+		if rsp.StatusCode != http.StatusBadRequest {
+			t.Errorf("plain http got %d", rsp.StatusCode)
+		}
+		rsp.Body.Close()
+	}
+	if _, err := http.Get(url + "/health"); err == nil {
+		t.Error("client without the cert trusted it")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	h := withAuth(&keyring{users: map[string]string{"user": ""}, admin: "admin"}, newRouter(newManager()))
+
+	ping := `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`
+	all := "/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points=10"
+
+	testData := []struct {
+		auth   string
+		method string
+		path   string
+		code   int
+		want   string
+	}{
+		{"", "POST", "/ping", 401, "Unauthorized. Missing bearer key."},
+		{"Bearer ", "POST", "/ping", 401, "Unauthorized. Missing bearer key."},
+		{"Basic user", "POST", "/ping", 401, "Unauthorized. Missing bearer key."},
+		{"Bearer wrong", "POST", "/ping", 401, "Unauthorized. Unknown key."},
+		{"Bearer user", "POST", "/ping", 200, `{"ok":true}`},
+		{"Bearer admin", "POST", "/ping", 200, `{"ok":true}`},
+		{"", "GET", all, 401, "Unauthorized. Missing bearer key."},
+		{"Bearer wrong", "GET", all, 401, "Unauthorized. Unknown key."},
+		{"Bearer user", "GET", all, 403, "Forbidden. Admin key required."},
+		{"Bearer admin", "GET", all, 200, `[{"id":"a","lat":51.5,"lon":-0.1,"alt":0}]`},
+		// probes need no key
+		{"", "GET", "/health", 200, `{"status":"ok"}`},
+	}
+
+	for _, d := range testData {
+		r := httptest.NewRequest(d.method, d.path, strings.NewReader(ping))
+		if len(d.auth) > 0 {
+			r.Header.Set("Authorization", d.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("%s %s with %q got %d %s, want %d %s", d.method, d.path, d.auth, w.Code, got, d.code, d.want)
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s %s with %q has no challenge", d.method, d.path, d.auth)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var trusted proxies
+	if err := trusted.UnmarshalText([]byte("10.0.0.0/8, ::1")); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []struct {
+		remote string
+		xff    string
+		real   string
+		want   string
+	}{
+		// anyone not a trusted proxy is taken at their address
+		{"203.0.113.5:1234", "1.2.3.4", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "", "1.2.3.4", "203.0.113.5"},
+		// a trusted proxy names the client
+		{"10.0.0.1:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"[::1]:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "", "1.2.3.4", "1.2.3.4"},
+		// through several proxies, ignoring what the client claimed
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 10.0.0.2", "", "1.2.3.4"},
+		// only proxies, the furthest is the client
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		// nothing readable falls back to the proxy
+		{"10.0.0.1:1234", "garbage", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+	}
+
+	for _, d := range data {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = d.remote
+		if len(d.xff) > 0 {
+			r.Header.Set("X-Forwarded-For", d.xff)
+		}
+		if len(d.real) > 0 {
+			r.Header.Set("X-Real-IP", d.real)
+		}
+
+		if got := clientIP(r, trusted); got != d.want {
+			t.Errorf("%s xff %q real %q got %s, want %s", d.remote, d.xff, d.real, got, d.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "proxy", "10.0.0"} {
+		var p proxies
+		if err := p.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("%q parsed as %v", bad, p)
+		}
+	}
+}
+
+func TestIPLimit(t *testing.T) {
+	var trusted proxies
+	trusted.UnmarshalText([]byte("10.0.0.1"))
+
+	l := newLimiter(1, 1)
+	h := withClientIP(trusted, withIPLimit(l, newRouter(newManager())))
+
+	get := func(path, remote, xff string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	data := []struct {
+		path   string
+		remote string
+		xff    string
+		code   int
+	}{
+		{"/contacts/list?id=a", "10.0.0.1:1", "1.2.3.4", http.StatusNotFound},
+		{"/contacts/list?id=a", "10.0.0.1:1", "1.2.3.4", http.StatusTooManyRequests},
+		// another client behind the same proxy has its own limit
+		{"/contacts/list?id=a", "10.0.0.1:1", "5.6.7.8", http.StatusNotFound},
+		// a client can't dodge the limit by sending the header itself
+		{"/contacts/list?id=a", "9.9.9.9:1", "1.1.1.1", http.StatusNotFound},
+		{"/contacts/list?id=a", "9.9.9.9:1", "2.2.2.2", http.StatusTooManyRequests},
+		// probes are never limited
+		{"/health", "10.0.0.1:1", "1.2.3.4", http.StatusOK},
+	}
+
+	for i, d := range data {
+		if code := get(d.path, d.remote, d.xff); code != d.code {
+			t.Errorf("request %d got %d, want %d", i, code, d.code)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	h := withBodyLimit(1024, newRouter(newManager()))
+
+	big := `{"id":"a","contacts":["` + strings.Repeat("b", 2048) + `"]}`
+	for _, path := range []string{"/contacts", "/near"} {
+		if w := do(h, "POST", path, big); w.Code != 413 {
+			t.Errorf("%s with an oversized body got %d, want 413", path, w.Code)
+		}
+	}
+
+	if w := do(h, "POST", "/contacts", `{"id":"a","contacts":["b"]}`); w.Code != 200 {
+		t.Errorf("small body got %d: %s", w.Code, w.Body)
+	}
+}
+
+// slowBody sends the start of a request then stalls until released.
+type slowBody struct {
+	sent    bool
+	release chan struct{}
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if !b.sent {
+		b.sent = true
+		return copy(p, `{"id":"a",`), nil
+	}
+	<-b.release
+	return 0, io.EOF
+}
+
+func TestRequestTimeout(t *testing.T) {
+	h := withTimeout(50*time.Millisecond, newRouter(newManager()))
+
+	body := &slowBody{release: make(chan struct{})}
+	defer close(body.release)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/contacts", body))
+	if w.Code != 503 {
+		t.Errorf("slow body got %d, want 503", w.Code)
+	}
+
+	if w := do(h, "POST", "/contacts", `{"id":"a","contacts":["b"]}`); w.Code != 200 {
+		t.Errorf("quick request got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	m := newManager()
+	for i := 0; i < 50; i++ {
+		m.updateLocation(fmt.Sprintf("user%d", i), 51.5, -0.1, 0)
+	}
+	h := withGzip(1024, newRouter(m))
+
+	get := func(path, encoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if len(encoding) > 0 {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	large := "/_all?id=admin&lat=51.5&lon=-0.1&distance=100&num_points=100"
+
+	plain := get(large, "")
+	if plain.Header().Get("Content-Encoding") != "" || !json.Valid(plain.Body.Bytes()) {
+		t.Fatalf("plain response encoded as %q", plain.Header().Get("Content-Encoding"))
+	}
+	if plain.Body.Len() < 1024 {
+		t.Fatalf("response of %d bytes is too small to test with", plain.Body.Len())
+	}
+
+	w := get(large, "br, gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large response encoded as %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, plain.Body.Bytes()) {
+		t.Errorf("gunzipped body differs from the plain one")
+	}
+
+	if w := get("/health", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("small response encoded as %q", w.Header().Get("Content-Encoding"))
+	}
+	if w := get(large, "gzip;q=0"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("refused gzip but got %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestPprof(t *testing.T) {
+	defer func(on bool) { pprofEnabled = on }(pprofEnabled)
+
+	pprofEnabled = false
+	if w := do(newRouter(newManager()), "GET", "/debug/pprof/", ""); w.Code != 404 {
+		t.Errorf("without -pprof got %d, want 404", w.Code)
+	}
+
+	pprofEnabled = true
+	h := withAuth(&keyring{users: map[string]string{"user": ""}, admin: "admin"}, newRouter(newManager()))
+
+	for key, code := range map[string]int{"user": 403, "admin": 200} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/debug/pprof/", nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("with -pprof and the %s key got %d, want %d", key, w.Code, code)
+		}
+	}
+}
+
+func TestRoutersAreIndependent(t *testing.T) {
+	m1, m2 := newManager(), newManager()
+	r1, r2 := newRouter(m1), newRouter(m2)
+
+	if w := do(r1, "POST", "/contacts", `{"id":"a","contacts":["b"]}`); w.Code != 200 {
+		t.Fatalf("add contacts got %d: %s", w.Code, w.Body)
+	}
+
+	if w := do(r1, "GET", "/contacts/list?id=a", ""); w.Code != 200 {
+		t.Errorf("first router got %d for its own user", w.Code)
+	}
+	if w := do(r2, "GET", "/contacts/list?id=a", ""); w.Code != 404 {
+		t.Errorf("second router got %d for the first router's user, want 404", w.Code)
+	}
+	if len(m2.users) != 0 {
+		t.Errorf("second manager has %d users, want 0", len(m2.users))
+	}
+
+	// the same ids in each, placed apart, only ever see their own
+	do(r1, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r2, "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+	do(r2, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r1, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r2, "POST", "/ping", `{"id":"b","location":{"lat":40.7,"lon":-74}}`)
+
+	testData := []struct {
+		r        http.Handler
+		lat, lon float64
+		want     string
+	}{
+		{r1, 51.5, -0.1, `{"contacts":["b"]}`},
+		{r1, 40.7, -74, `{"contacts":[]}`},
+		{r2, 51.5, -0.1, `{"contacts":[]}`},
+		{r2, 40.7, -74, `{"contacts":["b"]}`},
+	}
+	for i, d := range testData {
+		w := do(d.r, "GET", fmt.Sprintf("/near?id=a&lat=%v&lon=%v", d.lat, d.lon), "")
+		if got := strings.TrimSpace(w.Body.String()); got != d.want {
+			t.Errorf("query %d got %s, want %s", i, got, d.want)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "b", "c")
+	m.updateLocation("b", 51.5, -0.1, 0)
+	m.updateLocation("c", 51.5005, -0.1, 0)
+	r := newRouter(m)
+
+	// each GET answers as its POST does
+	forms := []struct {
+		get, post, body string
+		want            string
+	}{
+		{"/near?id=a&lat=51.5&lon=-0.1", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`,
+			`{"contacts":["b"]}`},
+		{"/near?id=a&lat=51.5&lon=-0.1&distance=100", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":100}`,
+			`{"contacts":["b","c"]}`},
+		{"/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points=10", "/_all", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":10,"num_points":10}`,
+			`[{"id":"b","lat":51.5,"lon":-0.1,"alt":0}]`},
+		{"/_all?id=a&lat=51.5&lon=-0.1&distance=100&num_points=10", "/_all", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":100,"num_points":10}`,
+			`[{"id":"b","lat":51.5,"lon":-0.1,"alt":0},{"id":"c","lat":51.5005,"lon":-0.1,"alt":0}]`},
+	}
+
+	for _, f := range forms {
+		get, post := do(r, "GET", f.get, ""), do(r, "POST", f.post, f.body)
+		if got := strings.TrimSpace(get.Body.String()); get.Code != 200 || got != f.want {
+			t.Errorf("GET %s got %d %s, want %s", f.get, get.Code, got, f.want)
+		}
+		if got := strings.TrimSpace(post.Body.String()); post.Code != 200 || got != f.want {
+			t.Errorf("POST %s %s got %d %s, want %s", f.post, f.body, post.Code, got, f.want)
+		}
+	}
+
+	// anything else is a 405 saying what is allowed
+	methods := []struct {
+		method, path, allow string
+	}{
+		{"PUT", "/near", "GET, POST"},
+		{"DELETE", "/_all", "GET, POST"},
+		{"GET", "/ping", "POST"},
+		{"GET", "/contacts", "POST"},
+		{"POST", "/contacts/list", "GET"},
+		{"PATCH", "/health", "GET"},
+	}
+
+	for _, d := range methods {
+		w := do(r, d.method, d.path, "")
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != d.allow {
+			t.Errorf("%s %s got %d, Allow %q, want 405, Allow %q", d.method, d.path, w.Code, w.Header().Get("Allow"), d.allow)
+		}
+	}
+}
+
+// befriend makes id and each of contacts contacts of one another, as
+// only mutual contacts find each other.
+func befriend(m *manager, id string, contacts ...string) {
+	m.addContacts(context.Background(), id, contacts)
+	for _, contact := range contacts {
+		m.addContacts(context.Background(), contact, []string{id})
+	}
+}
+
+func TestManagerHandlers(t *testing.T) {
+	// each manager's own handlers, called without a router
+	serve := func(h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	m, other := newManager(), newManager()
+
+	steps := []struct {
+		h          http.HandlerFunc
+		method     string
+		path, body string
+		want       string
+	}{
+		{m.contactHandler, "POST", "/contacts", `{"id":"a","contacts":["b"]}`, `{"added":1,"skipped":[]}`},
+		{m.contactHandler, "POST", "/contacts", `{"id":"b","contacts":["a"]}`, `{"added":1,"skipped":[]}`},
+		{m.pingHandler, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`, `{"ok":true}`},
+		{m.nearHandler, "GET", "/near?id=a&lat=51.5&lon=-0.1", "", `{"contacts":["b"]}`},
+		{m.allHandler, "GET", "/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points=10", "", `[{"id":"b","lat":51.5,"lon":-0.1,"alt":0}]`},
+		{other.allHandler, "GET", "/_all?id=a&lat=51.5&lon=-0.1&distance=10&num_points=10", "", `[]`},
+		{other.listContactsHandler, "GET", "/contacts/list?id=a", "", "Not Found. Unknown user."},
+	}
+
+	for i, s := range steps {
+		w := serve(s.h, s.method, s.path, s.body)
+		if got := strings.TrimSpace(w.Body.String()); got != s.want {
+			t.Errorf("step %d %s %s got %d %s, want %s", i, s.method, s.path, w.Code, got, s.want)
+		}
+	}
+
+	if len(m.users) != 2 || len(other.users) != 0 {
+		t.Errorf("got %d and %d users, want 2 and 0", len(m.users), len(other.users))
+	}
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	apps := newTenants(newManager())
+
+	send := func(tenant, method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(tenant) > 0 {
+			r.Header.Set(tenantHeader, tenant)
+		}
+		w := httptest.NewRecorder()
+		apps.ServeHTTP(w, r)
+		return w
+	}
+
+	near := func(tenant string) string {
+		w := send(tenant, "GET", "/near?id=a&lat=51.5&lon=-0.1", "")
+		if w.Code != 200 {
+			t.Fatalf("near for %q got %d: %s", tenant, w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	for _, tenant := range []string{"A", "B", ""} {
+		send(tenant, "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+		send(tenant, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	}
+	send("A", "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+
+	if got := near("A"); got != `{"contacts":["b"]}` {
+		t.Errorf("tenant A got %s", got)
+	}
+	if got := near("B"); got != `{"contacts":[]}` {
+		t.Errorf("tenant B got %s", got)
+	}
+	if got := near(""); got != `{"contacts":[]}` {
+		t.Errorf("default tenant got %s", got)
+	}
+
+	if w := send(strings.Repeat("x", maxTenantID+1), "GET", "/health", ""); w.Code != 400 {
+		t.Errorf("long tenant id got %d, want 400", w.Code)
+	}
+}
+
+func TestTenantKeys(t *testing.T) {
+	keys := &keyring{users: map[string]string{"keyA": "A", "keyB": "B", "key": ""}, admin: "admin"}
+	apps := newTenants(newManager())
+	apps.allowed = keys.tenants()
+	h := withAuth(keys, apps)
+
+	send := func(key, tenant, method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+		if len(tenant) > 0 {
+			r.Header.Set(tenantHeader, tenant)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// key A's users, reached without naming the tenant
+	send("keyA", "", "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+	send("keyA", "", "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	send("keyA", "", "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+
+	data := []struct {
+		key    string
+		tenant string
+		code   int
+	}{
+		{"keyA", "", http.StatusOK},
+		{"keyA", "A", http.StatusOK},
+		{"admin", "A", http.StatusOK},
+		// key B only ever reaches tenant B, where a is unknown
+		{"keyB", "", http.StatusNotFound},
+		{"keyB", "B", http.StatusNotFound},
+		{"keyB", "A", http.StatusForbidden},
+		{"key", "", http.StatusNotFound},
+		{"key", "A", http.StatusForbidden},
+		// no key names C so it never exists
+		{"admin", "C", http.StatusNotFound},
+	}
+
+	for _, d := range data {
+		w := send(d.key, d.tenant, "GET", "/contacts/list?id=a", "")
+		if w.Code != d.code {
+			t.Errorf("%s for tenant %q got %d, want %d: %s", d.key, d.tenant, w.Code, d.code, w.Body)
+		}
+	}
+
+	if w := send("keyB", "", "GET", "/near?id=a&lat=51.5&lon=-0.1", ""); strings.Contains(w.Body.String(), `"b"`) {
+		t.Errorf("key B saw tenant A's user: %s", w.Body)
+	}
+
+	if _, _, err := apps.get("C"); err != errUnknownTenant {
+		t.Errorf("tenant C got %v, want %v", err, errUnknownTenant)
+	}
+}
+
+func TestTenantLimit(t *testing.T) {
+	apps := newTenants(newManager())
+	apps.limit = 2
+
+	for i, d := range []struct {
+		tenant string
+		code   int
+	}{
+		{"A", http.StatusOK},
+		{"B", http.StatusOK},
+		{"C", http.StatusServiceUnavailable},
+		// those already made and the default are still served
+		{"A", http.StatusOK},
+		{"", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/health", nil)
+		r.Header.Set(tenantHeader, d.tenant)
+		w := httptest.NewRecorder()
+		apps.ServeHTTP(w, r)
+		if w.Code != d.code {
+			t.Errorf("request %d for %q got %d, want %d", i, d.tenant, w.Code, d.code)
+		}
+	}
+	if len(apps.managers) != 3 {
+		t.Errorf("got %d managers, want 3", len(apps.managers))
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(path, []byte("# keys\nkeyA A\n\n  key  \nkeyB\tB\n"), 0600)
+
+	want := map[string]string{"keyA": "A", "key": "", "keyB": "B"}
+	for _, src := range []struct{ path, env string }{{path, ""}, {"", "keyA A, key ,keyB B,"}} {
+		keys, err := loadKeys(src.path, src.env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("from %+v got %v, want %v", src, keys, want)
+		}
+	}
+}
+
+func TestFanout(t *testing.T) {
+	b := newMemBroker()
+
+	m1, m2 := newManager(), newManager()
+	apps1, apps2 := newTenants(m1), newTenants(m2)
+
+	for i, apps := range []*tenants{apps1, apps2} {
+		if _, err := apps.share(b, "locations", fmt.Sprintf("instance%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	befriend(m2, "a", "b")
+
+	// a ping on the first instance is seen on the second
+	if err := m1.updateLocation("b", 51.5, -0.1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	near := m2.nearContacts("a", nearQuery{lat: 51.5, lon: -0.1, distance: 10, limit: 10})
+	if len(near) != 1 || near[0].Id != "b" {
+		t.Errorf("second instance got %+v, want b", near)
+	}
+
+	// and only applied once on each
+	if fixes, _ := m1.history("b"); len(fixes) != 1 {
+		t.Errorf("first instance applied its own ping %d times", len(fixes))
+	}
+	if fixes, _ := m2.history("b"); len(fixes) != 1 {
+		t.Errorf("second instance applied the ping %d times", len(fixes))
+	}
+
+	// tenants stay apart across instances
+	r := httptest.NewRequest("POST", "/ping", strings.NewReader(`{"id":"c","location":{"lat":1,"lon":1}}`))
+	r.Header.Set(tenantHeader, "other")
+	apps1.ServeHTTP(httptest.NewRecorder(), r)
+
+	if _, ok := m2.users["c"]; ok {
+		t.Error("tenant ping reached the default tenant")
+	}
+	if other, _, _ := apps2.get("other"); other.stats().Points != 1 {
+		t.Error("tenant ping did not reach the same tenant")
+	}
+}
+
+func TestFanoutPrivacy(t *testing.T) {
+	b := newMemBroker()
+
+	m1, m2 := newManager(), newManager()
+	for i, m := range []*manager{m1, m2} {
+		if _, err := newTenants(m).share(b, "locations", fmt.Sprintf("instance%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		// contacts aren't shared, so made on both
+		befriend(m, "a", "b")
+	}
+	r1, r2 := newRouter(m1), newRouter(m2)
+
+	ping := func(lat float64) {
+		if w := do(r1, "POST", "/ping", fmt.Sprintf(`{"id":"b","location":{"lat":%v,"lon":-0.1}}`, lat)); w.Code != 200 {
+			t.Fatalf("ping got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// where the second instance's /near puts b for a, "" when absent
+	near := func() string {
+		w := do(r2, "GET", "/near?id=a&lat=51.5&lon=-0.1&distance=1000&verbose=true", "")
+		var rsp struct {
+			Contacts []nearContact `json:"contacts"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		if len(rsp.Contacts) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.0fm", rsp.Contacts[0].Distance)
+	}
+
+	steps := []struct {
+		name string
+		do   func()
+		want string
+	}{
+		{"ping", func() { ping(51.5) }, "0m"},
+		{"dark", func() { do(r1, "POST", "/go-dark", `{"id":"b"}`) }, ""},
+		{"ping while dark", func() { ping(51.501) }, ""},
+		{"live", func() { do(r1, "POST", "/go-live", `{"id":"b"}`) }, ""},
+		{"ping when live", func() { ping(51.501) }, "111m"},
+		{"invisible", func() { do(r1, "POST", "/visibility", `{"id":"b","visible":false}`) }, ""},
+		{"ping while invisible", func() { ping(51.502) }, ""},
+		// back where they last pinged, not where they were hidden
+		{"visible", func() { do(r1, "POST", "/visibility", `{"id":"b","visible":true}`) }, "222m"},
+		{"offline", func() { do(r1, "POST", "/offline", `{"id":"b"}`) }, ""},
+		{"ping when online", func() { ping(51.5) }, "0m"},
+		{"delete", func() { do(r1, "POST", "/user/delete", `{"id":"b"}`) }, ""},
+	}
+
+	for _, s := range steps {
+		s.do()
+		if got := near(); got != s.want {
+			t.Errorf("after %s second instance has b at %q, want %q", s.name, got, s.want)
+		}
+
+		// and what the second instance stores agrees with its memory
+		users, _ := m2.store.Load()
+		for _, su := range users {
+			if u := m2.users["b"]; su.id == "b" && u != nil && (su.dark != u.dark || su.invisible != u.invisible) {
+				t.Errorf("after %s second instance stored dark %v invisible %v, has %v %v", s.name, su.dark, su.invisible, u.dark, u.invisible)
+			}
+		}
+	}
+
+	if _, ok := m2.users["b"]; ok {
+		t.Error("deleted user kept on the second instance")
+	}
+}
+
+// flakyBroker is a memBroker whose connection can be cut, refusing
+// publishes until it is back.
+type flakyBroker struct {
+	*memBroker
+	mu   sync.Mutex
+	down bool
+}
+
+func (b *flakyBroker) setDown(down bool) {
+	b.mu.Lock()
+	b.down = down
+	b.mu.Unlock()
+}
+
+func (b *flakyBroker) Publish(subject string, data []byte) error {
+	b.mu.Lock()
+	down := b.down
+	b.mu.Unlock()
+
+	if down {
+		return errors.New("disconnected")
+	}
+	return b.memBroker.Publish(subject, data)
+}
+
+func TestFanoutReconnect(t *testing.T) {
+	defer func(base time.Duration) { retryBase = base }(retryBase)
+	retryBase = time.Millisecond
+
+	b := &flakyBroker{memBroker: newMemBroker()}
+
+	m1, m2 := newManager(), newManager()
+	apps1, apps2 := newTenants(m1), newTenants(m2)
+
+	for i, apps := range []*tenants{apps1, apps2} {
+		if _, err := apps.share(b, "locations", fmt.Sprintf("instance%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// keep every update as sent to replay later
+	var mu sync.Mutex
+	var sent [][]byte
+	b.Subscribe("locations", func(data []byte) {
+		mu.Lock()
+		sent = append(sent, data)
+		mu.Unlock()
+	})
+
+	m1.updateLocation("a", 51.5, -0.1, 0)
+
+	// pings made while the broker is down arrive once it is back
+	b.setDown(true)
+	m1.updateLocation("a", 51.501, -0.1, 0)
+	m1.updateLocation("a", 51.502, -0.1, 0)
+
+	if fixes, _ := m2.history("a"); len(fixes) != 1 {
+		t.Fatalf("got %d pings while down, want 1", len(fixes))
+	}
+
+	b.setDown(false)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		fixes, _ := m2.history("a")
+		if len(fixes) == 3 {
+			if fixes[2].lat != 51.502 {
+				t.Errorf("last ping got %v, want 51.502", fixes[2].lat)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pings after reconnect, want 3", len(fixes))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a redelivered update is not applied twice
+	mu.Lock()
+	replay := sent[0]
+	mu.Unlock()
+	b.Publish("locations", replay)
+
+	if fixes, _ := m2.history("a"); len(fixes) != 3 {
+		t.Errorf("got %d pings after a redelivery, want 3", len(fixes))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	data := []struct {
+		n   int
+		max time.Duration
+	}{
+		{0, retryBase},
+		{1, 2 * retryBase},
+		{3, 8 * retryBase},
+		{20, retryMax},
+		{100, retryMax},
+	}
+
+	for _, d := range data {
+		for i := 0; i < 10; i++ {
+			if got := backoff(d.n); got > d.max || got < d.max*4/5 {
+				t.Errorf("backoff(%d) got %v, want %v less up to a fifth", d.n, got, d.max)
+			}
+		}
+	}
+}
+
+func TestRemoteHeldWhileRebuilding(t *testing.T) {
+	defer func(n int) { fanoutBuffer = n }(fanoutBuffer)
+	fanoutBuffer = 2
+
+	m := newManager()
+	m.holdRemote()
+
+	for i, lat := range []float64{51.5, 51.501, 51.502} {
+		m.applyRemote(locationUpdate{id: fmt.Sprintf("u%d", i), lat: lat, lon: -0.1})
+	}
+
+	if s := m.stats(); s.Points != 0 {
+		t.Errorf("got %d points while rebuilding, want 0", s.Points)
+	}
+
+	m.releaseRemote()
+
+	// the oldest was dropped to keep two
+	if _, ok := m.users["u0"]; ok {
+		t.Error("u0 was not dropped")
+	}
+	if s := m.stats(); s.Points != 2 {
+		t.Errorf("got %d points after rebuilding, want 2", s.Points)
+	}
+
+	// once released pings apply straight away
+	m.applyRemote(locationUpdate{id: "u3", lat: 51.5, lon: -0.1})
+	if s := m.stats(); s.Points != 3 {
+		t.Errorf("got %d points, want 3", s.Points)
+	}
+}
+
+func TestMutualContacts(t *testing.T) {
+	r := newRouter(newManager())
+
+	// a and b have each other, a has c who doesn't have a back, d has a
+	// who doesn't have d
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b","c","e"]}`)
+	do(r, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r, "POST", "/contacts", `{"id":"c","contacts":["b"]}`)
+	do(r, "POST", "/contacts", `{"id":"d","contacts":["a"]}`)
+
+	data := []struct {
+		id   string
+		code int
+		want string
+	}{
+		{"a", http.StatusOK, `{"contacts":["b"]}`},
+		{"b", http.StatusOK, `{"contacts":["a"]}`},
+		{"c", http.StatusOK, `{"contacts":[]}`},
+		{"d", http.StatusOK, `{"contacts":[]}`},
+		{"e", http.StatusNotFound, ""},
+	}
+
+	for _, d := range data {
+		w := do(r, "GET", "/contacts/mutual?id="+d.id, "")
+		if w.Code != d.code {
+			t.Errorf("%s got %d, want %d", d.id, w.Code, d.code)
+			continue
+		}
+		if got := strings.TrimSpace(w.Body.String()); len(d.want) > 0 && got != d.want {
+			t.Errorf("%s got %s, want %s", d.id, got, d.want)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	setup := func() (*manager, http.Handler) {
+		m := newManager()
+		m.now = func() time.Time { return now }
+		r := newRouter(m)
+		do(r, "POST", "/contacts", `{"id":"a","contacts":["old"]}`)
+		for _, id := range []string{"b", "c", "old"} {
+			m.addContacts(context.Background(), id, []string{"a"})
+		}
+		for _, body := range []string{
+			`{"id":"b","location":{"lat":51.50001,"lon":-0.1}}`,
+			`{"id":"c","location":{"lat":51.50005,"lon":-0.1}}`,
+			`{"id":"old","location":{"lat":51.5,"lon":-0.1}}`,
+		} {
+			do(r, "POST", "/ping", body)
+		}
+		return m, r
+	}
+
+	m1, r1 := setup()
+	w := do(r1, "POST", "/sync", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"contacts":["b","c"],"verbose":true}`)
+	if w.Code != 200 {
+		t.Fatalf("sync got %d: %s", w.Code, w.Body)
+	}
+
+	var synced struct {
+		Added    []string      `json:"added"`
+		Removed  []string      `json:"removed"`
+		Contacts []nearContact `json:"contacts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &synced); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same three calls made separately
+	m2, r2 := setup()
+	do(r2, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r2, "POST", "/contacts/set", `{"id":"a","contacts":["b","c"]}`)
+	w = do(r2, "POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"verbose":true}`)
+
+	var near struct {
+		Contacts []nearContact `json:"contacts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &near); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(synced.Added, []string{"b", "c"}) || !reflect.DeepEqual(synced.Removed, []string{"old"}) {
+		t.Errorf("got +%v -%v, want +[b c] -[old]", synced.Added, synced.Removed)
+	}
+	if len(synced.Contacts) != 2 || !reflect.DeepEqual(synced.Contacts, near.Contacts) {
+		t.Errorf("sync found %+v, separate calls %+v", synced.Contacts, near.Contacts)
+	}
+
+	c1, _ := m1.contactsFor("a")
+	c2, _ := m2.contactsFor("a")
+	if !reflect.DeepEqual(c1, c2) {
+		t.Errorf("sync stored contacts %v, separate calls %v", c1, c2)
+	}
+	h1, _ := m1.history("a")
+	h2, _ := m2.history("a")
+	if !reflect.DeepEqual(h1, h2) {
+		t.Errorf("sync history %v, separate calls %v", h1, h2)
+	}
+	if m1.stats() != m2.stats() {
+		t.Errorf("sync stats %+v, separate calls %+v", m1.stats(), m2.stats())
+	}
+
+	// out of bounds changes nothing
+	if w := do(r1, "POST", "/sync", `{"id":"a","location":{"lat":95,"lon":0},"contacts":[]}`); w.Code != 422 {
+		t.Errorf("out of bounds got %d, want 422", w.Code)
+	}
+	if got, _ := m1.contactsFor("a"); !reflect.DeepEqual(got, c1) {
+		t.Errorf("failed sync changed contacts to %v", got)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+
+	do(r, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b"]}`)
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+
+	near := func() string {
+		return strings.TrimSpace(do(r, "GET", "/near?id=b&lat=51.5&lon=-0.1", "").Body.String())
+	}
+
+	if got := near(); got != `{"contacts":["a"]}` {
+		t.Fatalf("before going offline got %s", got)
+	}
+
+	if w := do(r, "POST", "/offline", `{"id":"a"}`); w.Code != 200 {
+		t.Fatalf("offline got %d: %s", w.Code, w.Body)
+	}
+	if got := near(); got != `{"contacts":[]}` {
+		t.Errorf("offline user still near: %s", got)
+	}
+	if got, _ := m.contactsFor("b"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("contacts got %v after going offline", got)
+	}
+
+	do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	if got := near(); got != `{"contacts":["a"]}` {
+		t.Errorf("after pinging again got %s", got)
+	}
+
+	if w := do(r, "POST", "/offline", `{"id":"nobody"}`); w.Code != 404 {
+		t.Errorf("unknown user got %d, want 404", w.Code)
+	}
+}
+
+func TestCoordPrecision(t *testing.T) {
+	defer func(p int) { coordPrecision = p }(coordPrecision)
+	coordPrecision = 4
+
+	m := newManager()
+	m.updateLocation("a", 51.5, -0.1, 0)
+	p := m.users["a"].location
+
+	data := []struct {
+		lat, lon float64
+		moved    bool
+	}{
+		{51.50001, -0.1, false},
+		{51.49996, -0.10004, false},
+		{51.50006, -0.1, true},
+		{51.5, -0.1, true},
+	}
+
+	for _, d := range data {
+		m.updateLocation("a", d.lat, d.lon, 0)
+		q := m.users["a"].location
+
+		if moved := q != p; moved != d.moved {
+			t.Errorf("ping %v,%v moved %v, want %v", d.lat, d.lon, moved, d.moved)
+		}
+		p = q
+	}
+
+	lat, lon := p.Coordinates()
+	if lat != 51.5 || lon != -0.1 {
+		t.Errorf("stored %v,%v, want 51.5,-0.1", lat, lon)
+	}
+}
+
+func TestValidateDryRun(t *testing.T) {
+	defer func(p int) { coordPrecision = p }(coordPrecision)
+	coordPrecision = 4
+
+	m := newManager()
+	r := newRouter(m)
+
+	data := []struct {
+		path string
+		body string
+		code int
+		want string
+	}{
+		{
+			"/validate/ping",
+			`{"id":"a","location":{"lat":51.500001,"lon":-0.1},"notify":true}`,
+			http.StatusOK,
+			`{"request":{"id":"a","location":{"lat":51.5,"lon":-0.1,"alt":null},"accuracy":null,"notify":true,"timestamp":null},"valid":true}`,
+		},
+		{
+			"/validate/contacts",
+			`{"id":"a","contacts":[" b","b","c "]}`,
+			http.StatusOK,
+			`{"request":{"id":"a","contacts":["b","c"]},"valid":true}`,
+		},
+		{
+			"/validate/ping",
+			`{"id":"","location":{"lat":91,"lon":-0.1}}`,
+			http.StatusUnprocessableEntity,
+			`{"error":"validation_failed","fields":{"id":"required","location.lat":"must be between -90 and 90"}}`,
+		},
+		{
+			"/validate/ping",
+			`{"id":`,
+			http.StatusBadRequest,
+			"",
+		},
+		{
+			"/validate/near",
+			`{"id":"a"}`,
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, d := range data {
+		w := do(r, "POST", d.path, d.body)
+		if w.Code != d.code {
+			t.Errorf("%s %s got %d, want %d: %s", d.path, d.body, w.Code, d.code, w.Body)
+			continue
+		}
+		if got := strings.TrimSpace(w.Body.String()); len(d.want) > 0 && got != d.want {
+			t.Errorf("%s %s got %s, want %s", d.path, d.body, got, d.want)
+		}
+	}
+
+	if len(m.users) != 0 {
+		t.Errorf("dry runs created %d users", len(m.users))
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/contacts", strings.NewReader(body))
+		req.Header.Set(idempotencyHeader, key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := post("k1", `{"id":"a","contacts":["b"]}`)
+	again := post("k1", `{"id":"a","contacts":["b"]}`)
+
+	if first.Body.String() != again.Body.String() || first.Code != again.Code {
+		t.Errorf("replay got %d %s, want %d %s", again.Code, again.Body, first.Code, first.Body)
+	}
+	if again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay not marked: %v", again.Header())
+	}
+
+	// a key is for one body, another is refused without applying
+	if w := post("k1", `{"id":"a","contacts":["c"]}`); w.Code != http.StatusUnprocessableEntity || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another body got %d %v, want 422", w.Code, w.Header())
+	}
+	if got, _ := m.contactsFor("a"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("another body applied, contacts %v", got)
+	}
+
+	// a new key runs again, finding b already added
+	other := post("k2", `{"id":"a","contacts":["b"]}`)
+	if !strings.Contains(other.Body.String(), `"skipped":["b"]`) {
+		t.Errorf("new key got %s", other.Body)
+	}
+
+	// the same key on another path is another request
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/contacts/remove", strings.NewReader(`{"id":"a","contacts":["b"]}`))
+	req.Header.Set(idempotencyHeader, "k1")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("other path got %d %v", w.Code, w.Header())
+	}
+
+	// once the ttl passes the key is forgotten and the request applies
+	now := time.Now().Add(idempotencyTTL + time.Second)
+	m.replays.now = func() time.Time { return now }
+
+	if n := m.replays.sweep(); n != 3 {
+		t.Errorf("swept %d, want 3", n)
+	}
+	if w := post("k1", `{"id":"a","contacts":["b"]}`); w.Header().Get("Idempotent-Replayed") != "" || !strings.Contains(w.Body.String(), `"added":1`) {
+		t.Errorf("expired key got %v %s", w.Header(), w.Body)
+	}
+}
+
+func TestIdempotencyEviction(t *testing.T) {
+	s := newReplays(time.Hour, 2)
+
+	sum := sha256.Sum256(nil)
+	run := func(key string) {
+		if _, ok := s.begin(key, sum); ok {
+			s.finish(key, http.StatusOK, "text/plain", []byte(key))
+		}
+	}
+	kept := func() []string {
+		var keys []string
+		for e := s.order.Front(); e != nil; e = e.Next() {
+			keys = append(keys, e.Value.(*replay).key)
+		}
+		return keys
+	}
+
+	run("a")
+	run("b")
+	// a retry of a makes b the least recently used
+	run("a")
+	run("c")
+	if want := []string{"c", "a"}; !reflect.DeepEqual(kept(), want) || len(s.entries) != 2 {
+		t.Errorf("got %v, want %v", kept(), want)
+	}
+
+	// a request still running is never dropped, c and a go instead
+	if _, ok := s.begin("d", sum); !ok {
+		t.Fatal("d not claimed")
+	}
+	s.begin("e", sum)
+	if want := []string{"e", "d"}; !reflect.DeepEqual(kept(), want) {
+		t.Errorf("got %v, want %v", kept(), want)
+	}
+	s.begin("f", sum)
+	if want := []string{"f", "e", "d"}; !reflect.DeepEqual(kept(), want) {
+		t.Errorf("got %v, want %v running over max", kept(), want)
+	}
+
+	// once done they drop down to max again, least recently used
+	// first but never the one just kept
+	s.finish("d", http.StatusOK, "", nil)
+	s.finish("e", http.StatusOK, "", nil)
+	if want := []string{"e", "f"}; !reflect.DeepEqual(kept(), want) {
+		t.Errorf("got %v, want %v", kept(), want)
+	}
+	if rp, ok := s.begin("e", sum); ok || !rp.done {
+		t.Error("e not replayed")
+	}
+}
+
+func TestBounds(t *testing.T) {
+	defer func(b bounds) { worldBounds = b }(worldBounds)
+
+	data := []struct {
+		flag string
+		ok   bool
+	}{
+		{"51.2,-0.6,51.7,0.3", true},
+		{" -90, -180, 90, 180 ", true},
+		{"51.2,-0.6,51.7", false},
+		{"51.2,-0.6,51.7,x", false},
+		{"51.7,-0.6,51.2,0.3", false},
+		{"51.2,0.3,51.7,0.3", false},
+		{"-91,-0.6,51.7,0.3", false},
+		{"51.2,-0.6,51.7,181", false},
+	}
+
+	for _, d := range data {
+		var b bounds
+		if err := b.UnmarshalText([]byte(d.flag)); (err == nil) != d.ok {
+			t.Errorf("%q got %v, want ok %v", d.flag, err, d.ok)
+		}
+	}
+
+	if err := worldBounds.UnmarshalText([]byte("51.2,-0.6,51.7,0.3")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newManager()
+	r := newRouter(m)
+
+	if w := do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`); w.Code != http.StatusOK {
+		t.Errorf("ping in London got %d: %s", w.Code, w.Body)
+	}
+	if w := do(r, "POST", "/ping", `{"id":"b","location":{"lat":48.85,"lon":2.35}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("ping in Paris got %d, want 400", w.Code)
+	}
+	if err := m.updateLocation("a", 51.8, -0.1, 0); err != errOutOfBounds {
+		t.Errorf("ping north of the box got %v, want errOutOfBounds", err)
+	}
+
+	befriend(m, "b", "a")
+	contacts := m.nearContacts("b", nearQuery{lat: 51.5, lon: -0.1, distance: nearestDistance, limit: nearestContacts})
+	if len(contacts) != 1 || contacts[0].Id != "a" {
+		t.Errorf("near got %v, want a found in the box", contacts)
+	}
+}
+
+func TestPingNotify(t *testing.T) {
+	r := newRouter(newManager())
+	do(r, "POST", "/contacts", `{"id":"a","contacts":["b","c"]}`)
+	do(r, "POST", "/contacts", `{"id":"b","contacts":["a"]}`)
+	do(r, "POST", "/contacts", `{"id":"c","contacts":["a"]}`)
+	do(r, "POST", "/ping", `{"id":"b","location":{"lat":51.5,"lon":-0.1}}`)
+	do(r, "POST", "/ping", `{"id":"c","location":{"lat":51.5,"lon":-0.1}}`)
+
+	// a walks up to b and c, lingers, leaves and comes back
+	data := []struct {
+		lat   float64
+		near  []string
+		newly []string
+	}{
+		{51.501, []string{}, []string{}},
+		{51.50005, []string{"b", "c"}, []string{"b", "c"}},
+		{51.50002, []string{"b", "c"}, []string{}},
+		{51.501, []string{}, []string{}},
+		{51.5, []string{"b", "c"}, []string{"b", "c"}},
+	}
+
+	for i, d := range data {
+		body := fmt.Sprintf(`{"id":"a","location":{"lat":%v,"lon":-0.1},"notify":true}`, d.lat)
+		w := do(r, "POST", "/ping", body)
+
+		var got struct {
+			Ok    bool     `json:"ok"`
+			Near  []string `json:"near"`
+			Newly []string `json:"newly_near"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("step %d: %v: %s", i, err, w.Body)
+		}
+
+		sort.Strings(got.Near)
+		sort.Strings(got.Newly)
+		if !got.Ok || !reflect.DeepEqual(got.Near, d.near) || !reflect.DeepEqual(got.Newly, d.newly) {
+			t.Errorf("step %d: got %s, want near %v newly %v", i, w.Body, d.near, d.newly)
+		}
+	}
+
+	// without notify a ping is only acknowledged
+	w := do(r, "POST", "/ping", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+	if strings.Contains(w.Body.String(), "near") {
+		t.Errorf("plain ping got %s", w.Body)
+	}
+}
+
+func TestNearDoesNotMove(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "b")
+	m.updateLocation("a", 51.5, -0.1, 0)
+	m.updateLocation("b", 51.6, -0.1, 0)
+
+	r := newRouter(m)
+	before := m.users["a"].location
+
+	for _, req := range []struct{ method, path, body string }{
+		{"POST", "/near", `{"id":"a","location":{"lat":51.6,"lon":-0.1}}`},
+		{"GET", "/near?id=a&lat=51.6&lon=-0.1&update=true", ""},
+	} {
+		if w := do(r, req.method, req.path, req.body); w.Body.String() != `{"contacts":["b"]}` {
+			t.Errorf("%s %s got %s", req.method, req.path, w.Body)
+		}
+		if m.users["a"].location != before {
+			t.Errorf("%s %s moved the user", req.method, req.path)
+		}
+		if ids := pointsNear(m, 51.5, -0.1, 10); !reflect.DeepEqual(ids, []string{"a"}) {
+			t.Errorf("%s %s changed the world to %v", req.method, req.path, ids)
+		}
+	}
+
+	// a bad request is refused before the update, not after
+	for _, extra := range []string{
+		`,"distance":-1`,
+		`,"num_points":0`,
+		`,"altitude":true`,
+		`,"group":"nope"`,
+	} {
+		body := `{"id":"a","location":{"lat":51.7,"lon":-0.1},"update":true` + extra + `}`
+		if w := do(r, "POST", "/near", body); w.Code == 200 {
+			t.Errorf("%s got %d: %s", extra, w.Code, w.Body)
+		}
+		if lat, _ := m.users["a"].location.Coordinates(); lat != 51.5 {
+			t.Errorf("%s moved the user to lat %v", extra, lat)
+		}
+	}
+	if w := do(r, "POST", "/near", `{"id":"new","location":{"lat":51.5,"lon":-0.1},"update":true,"distance":-1}`); w.Code != 400 || m.known("new") {
+		t.Errorf("bad update for a new user got %d, known %v", w.Code, m.known("new"))
+	}
+
+	do(r, "POST", "/near", `{"id":"a","location":{"lat":51.6,"lon":-0.1},"update":true}`)
+	if lat, _ := m.users["a"].location.Coordinates(); lat != 51.6 {
+		t.Errorf("update did not move the user, lat is %v", lat)
+	}
+}
+
+func TestNearHandler(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "b")
+	m.updateLocation("b", 51.5, -0.1, 0)
+
+	r := newRouter(m)
+
+	testData := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		want   []string
+	}{
+		{"post", "POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`, 200, []string{"b"}},
+		{"get", "GET", "/near?id=a&lat=51.5&lon=-0.1", "", 200, []string{"b"}},
+		{"get out of range", "GET", "/near?id=a&lat=51.6&lon=-0.1", "", 200, []string{}},
+		{"get unknown user", "GET", "/near?id=nobody&lat=51.5&lon=-0.1", "", 404, nil},
+		{"get bad lat", "GET", "/near?id=a&lat=north&lon=-0.1", "", 400, nil},
+		{"get missing id", "GET", "/near?lat=51.5&lon=-0.1", "", 400, nil},
+		{"put", "PUT", "/near", "", 405, nil},
+	}
+
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			w := do(r, d.method, d.path, d.body)
+			if w.Code != d.code {
+				t.Fatalf("got %d, want %d: %s", w.Code, d.code, w.Body)
+			}
+			if d.code != 200 {
+				return
+			}
+
+			var rsp struct {
+				Contacts []string `json:"contacts"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rsp.Contacts, d.want) {
+				t.Errorf("got %v, want %v", rsp.Contacts, d.want)
+			}
+		})
+	}
+
+	if w := do(r, "PUT", "/near", ""); w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("405 Allow header is %q", w.Header().Get("Allow"))
+	}
+}
+
+func TestValidation(t *testing.T) {
+	data := []struct {
+		path   string
+		body   string
+		fields map[string]string
+	}{
+		{"/ping", `{"id":"a","location":{"lon":0}}`, map[string]string{"location.lat": "required"}},
+		{"/ping", `{"location":{"lat":91,"lon":181},"accuracy":-1}`, map[string]string{
+			"id":           "required",
+			"location.lat": "must be between -90 and 90",
+			"location.lon": "must be between -180 and 180",
+			"accuracy":     "must not be negative",
+		}},
+		{"/ping", `{"id":"a","location":{"lat":"north","lon":0}}`, map[string]string{"location.lat": "expected number"}},
+		{"/ping", `{"id":"a"}`, map[string]string{"location": "required"}},
+		{"/ping/bulk", `{}`, map[string]string{"updates": "required"}},
+		{"/contacts", `{"id":"a","contacts":["b"," "]}`, map[string]string{"contacts[1]": "required"}},
+		{"/contacts/set", `{"id":""}`, map[string]string{"id": "required", "contacts": "required"}},
+		{"/contacts/remove", `{"id":"a"}`, map[string]string{"contacts": "required"}},
+		{"/contacts/request", `{"id":"a","contact":"a"}`, map[string]string{"contact": "must differ from id"}},
+		{"/contacts/confirm", `{"contact":"a"}`, map[string]string{"id": "required"}},
+		{"/visibility", `{"id":"a"}`, map[string]string{"visible": "required"}},
+		{"/block", `{"id":"a","target":""}`, map[string]string{"target": "required"}},
+		{"/user/delete", `{"id":5}`, map[string]string{"id": "expected string"}},
+		{"/go-dark", `{}`, map[string]string{"id": "required"}},
+		{"/go-live", `{}`, map[string]string{"id": "required"}},
+		{"/geofence", `{"id":"a","label":"home","location":{"lat":0,"lon":0},"radius":0}`, map[string]string{"radius": "must be positive"}},
+	}
+
+	r := newRouter(newManager())
+
+	for _, d := range data {
+		t.Run(d.path, func(t *testing.T) {
+			w := do(r, "POST", d.path, d.body)
+			if w.Code != 422 {
+				t.Fatalf("got %d, want 422: %s", w.Code, w.Body)
+			}
+
+			var got struct {
+				Error  string            `json:"error"`
+				Fields map[string]string `json:"fields"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Error != "validation_failed" {
+				t.Errorf("error got %q", got.Error)
+			}
+			if !reflect.DeepEqual(got.Fields, d.fields) {
+				t.Errorf("fields got %v, want %v", got.Fields, d.fields)
+			}
+		})
+	}
+
+	// a body which is not JSON at all is still a 400
+	if w := do(r, "POST", "/ping", `{"id":`); w.Code != 400 {
+		t.Errorf("malformed body got %d, want 400", w.Code)
+	}
+}
+
+func BenchmarkNearContacts(b *testing.B) {
+	defer func(c int) { quadtree.Capacity = c }(quadtree.Capacity)
+
+	const users = 10000
+
+	for _, capacity := range []int{4, 8, 16, 32, 64} {
+		b.Run(fmt.Sprintf("capacity=%d", capacity), func(b *testing.B) {
+			quadtree.Capacity = capacity
+
+			m := newManager()
+			contacts := make([]string, 0, users/10)
+
+			// a city sized spread so queries hit dense nodes
+			for i := 0; i < users; i++ {
+				id := fmt.Sprintf("u%d", i)
+				m.updateLocation(id, 51.4+float64(i%100)*0.002, -0.2+float64(i/100)*0.002, 0)
+				if i%10 == 0 {
+					contacts = append(contacts, id)
+				}
+			}
+			m.addContacts(context.Background(), "me", contacts)
+
+			q := nearQuery{lat: 51.5, lon: -0.1, distance: 500, limit: maxContacts}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.nearContacts("me", q)
+			}
+		})
+	}
+}
+
+// BenchmarkNearContactsParallel runs queries from every proc while a
+// writer keeps pinging, showing readers no longer queue behind each
+// other.
+func BenchmarkNearContactsParallel(b *testing.B) {
+	m := newManager()
+	contacts := make([]string, 0, 100)
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("u%d", i)
+		m.updateLocation(id, 51.5+float64(i%30)*0.0001, -0.1+float64(i/30)*0.0001, 0)
+		if i%10 == 0 {
+			contacts = append(contacts, id)
+		}
+	}
+	m.addContacts(context.Background(), "me", contacts)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m.updateLocation("u0", 51.5, -0.1+float64(i%100)*0.00001, 0)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	q := nearQuery{lat: 51.5, lon: -0.1, distance: 200, limit: maxContacts}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.nearContacts("me", q)
+		}
+	})
+}
+
+func TestPingTimestamp(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newManager()
+	m.now = func() time.Time { return now }
+	r := newRouter(m)
+
+	ping := func(lon float64, at time.Time) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"id":"a","location":{"lat":51.5,"lon":%v},"timestamp":%q}`, lon, at.Format(time.RFC3339))
+		return do(r, "POST", "/ping", body)
+	}
+
+	data := []struct {
+		lon     float64
+		at      time.Time
+		code    int
+		wantLon float64
+		taken   time.Time
+	}{
+		{0, now.Add(-time.Minute), 200, 0, now.Add(-time.Minute)},
+		// late, it joins the history but doesn't move a back
+		{1, now.Add(-5 * time.Minute), 200, 0, now.Add(-time.Minute)},
+		// a little ahead is taken as now
+		{2, now.Add(30 * time.Second), 200, 2, now},
+		{3, now.Add(time.Hour), 422, 2, now},
+		{4, now.Add(-48 * time.Hour), 422, 2, now},
+	}
+
+	for i, d := range data {
+		w := ping(d.lon, d.at)
+		if w.Code != d.code {
+			t.Errorf("step %d: got %d %s, want %d", i, w.Code, w.Body, d.code)
+		}
+		if d.code == 422 && !strings.Contains(w.Body.String(), `"timestamp"`) {
+			t.Errorf("step %d: got %s, want a timestamp error", i, w.Body)
+		}
+
+		u := m.users["a"]
+		if _, lon := u.location.Coordinates(); lon != d.wantLon || !u.taken.Equal(d.taken) {
+			t.Errorf("step %d: at lon %v taken %v, want lon %v taken %v", i, lon, u.taken, d.wantLon, d.taken)
+		}
+		// seen by our clock whatever the timestamp
+		if !u.lastSeen.Equal(now) {
+			t.Errorf("step %d: seen %v, want %v", i, u.lastSeen, now)
+		}
+	}
+
+	fixes, _ := m.history("a")
+	var lons []float64
+	for _, f := range fixes {
+		lons = append(lons, f.lon)
+	}
+	if want := []float64{1, 0, 2}; !reflect.DeepEqual(lons, want) {
+		t.Errorf("history got %v, want %v in time order", lons, want)
+	}
+
+	// a ping taken 20 minutes ago, say buffered offline, is online
+	// now and still there 15 minutes later with a 30 minute TTL
+	body := fmt.Sprintf(`{"id":"c","location":{"lat":51.5,"lon":0},"timestamp":%q}`, now.Add(-20*time.Minute).Format(time.RFC3339))
+	if w := do(r, "POST", "/ping", body); w.Code != 200 {
+		t.Fatalf("old ping got %d %s", w.Code, w.Body)
+	}
+	if got := presence(m.users["c"].lastSeen, now); got != "online" {
+		t.Errorf("old ping presence got %s, want online", got)
+	}
+	now = now.Add(15 * time.Minute)
+	m.expireLocations(context.Background(), 30*time.Minute)
+	if m.users["c"].location == nil {
+		t.Error("old ping expired early")
+	}
+
+	// bulk pings report a bad timestamp in their result
+	body = fmt.Sprintf(`{"updates":[{"id":"b","location":{"lat":51.5,"lon":0},"timestamp":%q}]}`, now.Add(time.Hour).Format(time.RFC3339))
+	w := do(r, "POST", "/ping/bulk", body)
+	if !strings.Contains(w.Body.String(), errFutureTimestamp.Error()) {
+		t.Errorf("bulk got %s", w.Body)
+	}
+}
+
+func TestTrailAdd(t *testing.T) {
+	at := func(min int) fix {
+		return fix{lon: float64(min), time: time.Date(2024, 1, 1, 12, min, 0, 0, time.UTC)}
+	}
+
+	var tr trail
+	for _, min := range []int{1, 3, 5, 2, 0, 4} {
+		tr.add(at(min), 4)
+	}
+	tr.add(at(6), 4)
+
+	var got []float64
+	for _, f := range tr.list() {
+		got = append(got, f.lon)
+	}
+	if want := []float64{3, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInject(t *testing.T) {
+	m := newManager()
+	m.updateLocation("real", 51.5, -0.1, 0)
+	r := newRouter(m)
+
+	// a 3x3 grid about 11m apart north to south around real
+	var users []string
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			users = append(users, fmt.Sprintf(`{"id":"g%d%d","lat":%.4f,"lon":%.4f}`, i, j, 51.4999+float64(i)*0.0001, -0.1001+float64(j)*0.0001))
+		}
+	}
+	body := `{"users":[` + strings.Join(users, ",") + `,{"id":"real","lat":0,"lon":0}]}`
+
+	w := do(r, "POST", "/_inject", body)
+	var rsp struct {
+		Results []bulkPingResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	for i, res := range rsp.Results {
+		if ok := i < 9; res.Ok != ok {
+			t.Errorf("result %d got %+v, want ok %v", i, res, ok)
+		}
+	}
+	if res := rsp.Results[9]; res.Error != errRealUser.Error() {
+		t.Errorf("real user got %+v", res)
+	}
+
+	var all []allUser
+	w = do(r, "GET", "/_all?id=real&lat=51.5&lon=-0.1&distance=100&num_points=20", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(all) != 10 || all[0].Id != "g11" || all[1].Id != "real" {
+		t.Errorf("/_all got %s, want the grid with g11 and real in the middle", w.Body)
+	}
+
+	if w := do(r, "POST", "/_inject", `{"users":[{"id":"g00"}]}`); w.Code != 422 {
+		t.Errorf("no location got %d, want 422", w.Code)
+	}
+
+	w = do(r, "POST", "/_clear", "")
+	if want := `{"removed":["g00","g01","g02","g10","g11","g12","g20","g21","g22"]}`; strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("/_clear got %s, want %s", w.Body, want)
+	}
+	if len(m.users) != 1 || m.users["real"].location == nil {
+		t.Errorf("real user was not kept")
+	}
+}
+
+func TestBulkPingLimit(t *testing.T) {
+	ping := func(id string) string {
+		return fmt.Sprintf(`{"id":%q,"location":{"lat":51.5,"lon":-0.1}}`, id)
+	}
+
+	for _, path := range []string{"/ping/bulk", "/_inject"} {
+		m := newManager()
+		m.pings = newLimiter(1, 2)
+		m.pings.now = func() time.Time { return time.Unix(0, 0) }
+		r := newRouter(m)
+
+		// a burst of three for a, after one for b
+		body := `{"updates":[` + strings.Join([]string{ping("b"), ping("a"), ping("a"), ping("a")}, ",") + `]}`
+		if path == "/_inject" {
+			body = `{"users":[{"id":"b","lat":51.5,"lon":-0.1},{"id":"a","lat":51.5,"lon":-0.1},{"id":"a","lat":51.5,"lon":-0.1},{"id":"a","lat":51.5,"lon":-0.1}]}`
+		}
+
+		w := do(r, "POST", path, body)
+		var rsp struct {
+			Results []bulkPingResult `json:"results"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, w.Body)
+		}
+
+		want := []bulkPingResult{
+			{Id: "b", Ok: true},
+			{Id: "a", Ok: true},
+			{Id: "a", Ok: true},
+			{Id: "a", Error: errTooManyPings.Error()},
+		}
+		if !reflect.DeepEqual(rsp.Results, want) {
+			t.Errorf("%s got %+v, want %+v", path, rsp.Results, want)
+		}
+
+		// b still has pings left where a is out
+		if w := do(r, "POST", "/ping", ping("b")); w.Code != http.StatusOK {
+			t.Errorf("%s then b got %d, want 200", path, w.Code)
+		}
+		if w := do(r, "POST", "/ping", ping("a")); w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s then a got %d, want 429", path, w.Code)
+		}
+	}
+}
+
+func TestNearBearing(t *testing.T) {
+	m := newManager()
+	befriend(m, "a", "n", "e", "s", "w")
+	m.updateLocation("n", 51.501, -0.1, 0)
+	m.updateLocation("e", 51.5, -0.099, 0)
+	m.updateLocation("s", 51.499, -0.1, 0)
+	m.updateLocation("w", 51.5, -0.101, 0)
+
+	w := do(newRouter(m), "POST", "/near", `{"id":"a","location":{"lat":51.5,"lon":-0.1},"distance":200,"num_points":4,"verbose":true}`)
+	var rsp struct {
+		Contacts []nearContact `json:"contacts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+
+	want := map[string]float64{"n": 0, "e": 90, "s": 180, "w": 270}
+	if len(rsp.Contacts) != len(want) {
+		t.Fatalf("got %s", w.Body)
+	}
+	for _, c := range rsp.Contacts {
+		if math.Abs(c.Bearing-want[c.Id]) > 0.01 {
+			t.Errorf("%s got bearing %v, want %v", c.Id, c.Bearing, want[c.Id])
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	m := newManager()
+	m.addContacts(context.Background(), "a", []string{"b"})
+	m.updateLocation("a", 51.5, -0.1, 0)
+	m.updateLocation("b", 51.5, -0.1, 0)
+	r := withEnvelope(2, newRouter(m))
+
+	paths := []string{
+		"/health", "/ready", "/contacts", "/contacts/set", "/contacts/list", "/contacts/mutual",
+		"/contacts/count", "/followers", "/contacts/request", "/contacts/confirm", "/contacts/remove", "/contacts/ops",
+		"/groups", "/ping", "/ping/bulk", "/near", "/sync", "/presence", "/nearby", "/visibility",
+		"/block", "/go-dark", "/go-live", "/arriving", "/history", "/last-known", "/geofence",
+		"/geofence/events", "/_all", "/_users", "/_stats", "/_inject", "/validate/ping", "/nowhere",
+	}
+
+	// every endpoint, by GET with a query and by POST with a body, is
+	// either data or an error carrying the response's status
+	for _, path := range paths {
+		for _, method := range []string{"GET", "POST"} {
+			w := do(r, method, path+"?id=a&contact=b&lat=51.5&lon=-0.1", `{"id":"a","location":{"lat":51.5,"lon":-0.1}}`)
+
+			var env struct {
+				Data  json.RawMessage `json:"data"`
+				Error *struct {
+					Status  int    `json:"status"`
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			var keys map[string]json.RawMessage
+			json.Unmarshal(w.Body.Bytes(), &keys)
+			_, hasData := keys["data"]
+			_, hasError := keys["error"]
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || len(keys) != 2 || !hasData || !hasError {
+				t.Errorf("%s %s: %v: %s", method, path, err, w.Body)
+				continue
+			}
+
+			switch {
+			case w.Header().Get("Content-Type") != "application/json":
+				t.Errorf("%s %s: content type %q", method, path, w.Header().Get("Content-Type"))
+			case w.Code >= 400 && (env.Error == nil || env.Error.Status != w.Code || len(env.Error.Code) == 0 || len(env.Error.Message) == 0):
+				t.Errorf("%s %s: %d got error %+v", method, path, w.Code, env.Error)
+			case w.Code >= 400 && string(env.Data) != "null":
+				t.Errorf("%s %s: %d got data %s", method, path, w.Code, env.Data)
+			case w.Code < 400 && (env.Error != nil || string(env.Data) == "null"):
+				t.Errorf("%s %s: %d got error %+v and data %s", method, path, w.Code, env.Error, env.Data)
+			}
+		}
+	}
+
+	data := []struct {
+		method, path, body string
+		code               int
+		want               string
+	}{
+		{"GET", "/contacts/list?id=a", "", 200, `{"data":{"contacts":["b"]},"error":null}`},
+		{"GET", "/contacts/list?id=x", "", 404, `{"data":null,"error":{"code":"not_found","message":"Unknown user.","status":404}}`},
+		{"POST", "/ping", `{"location":{"lat":51.5,"lon":-0.1}}`, 422, `{"data":null,"error":{"code":"validation_failed","fields":{"id":"required"},"message":"Unprocessable Entity","status":422}}`},
+		{"POST", "/go-live", `{"id":"a"}`, 200, `{"data":{"ok":true},"error":null}`},
+	}
+
+	for _, d := range data {
+		w := do(r, d.method, d.path, d.body)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != d.code || got != d.want {
+			t.Errorf("%s %s got %d %s, want %d %s", d.method, d.path, w.Code, got, d.code, d.want)
+		}
+	}
+
+	// metrics are for Prometheus, not clients
+	if w := do(r, "GET", "/metrics", ""); strings.HasPrefix(w.Body.String(), "{") {
+		t.Errorf("/metrics got %s", w.Body)
+	}
+
+	// version 1 is untouched
+	if w := do(withEnvelope(1, newRouter(m)), "GET", "/contacts/list?id=a", ""); strings.Contains(w.Body.String(), "data") {
+		t.Errorf("version 1 got %s", w.Body)
+	}
+}
+
+func TestContactCount(t *testing.T) {
+	r := newRouter(newManager())
+
+	if w := do(r, "GET", "/contacts/count?id=a", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown user got %d, want 404", w.Code)
+	}
+
+	data := []struct {
+		path, body string
+		want       string
+	}{
+		{"/contacts", `{"id":"a","contacts":["b","c"]}`, `{"count":2}`},
+		{"/contacts", `{"id":"a","contacts":["c","d"]}`, `{"count":3}`},
+		{"/contacts/remove", `{"id":"a","contacts":["b","x"]}`, `{"count":2}`},
+		{"/contacts/set", `{"id":"a","contacts":[]}`, `{"count":0}`},
+	}
+
+	for _, d := range data {
+		do(r, "POST", d.path, d.body)
+
+		w := do(r, "GET", "/contacts/count?id=a", "")
+		if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || got != d.want {
+			t.Errorf("after %s %s got %d %s, want %s", d.path, d.body, w.Code, got, d.want)
+		}
+	}
+}
+
+func TestContactConsent(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		m.updateLocation(id, 51.5, -0.1, 0)
+	}
+
+	near := func(id string) string {
+		return strings.TrimSpace(do(r, "GET", "/near?id="+id+"&lat=51.5&lon=-0.1", "").Body.String())
+	}
+
+	data := []struct {
+		name         string
+		path, body   string
+		code         int
+		nearA, nearB string
+	}{
+		{"one sided add", "/contacts", `{"id":"a","contacts":["b"]}`, 200, `{"contacts":[]}`, `{"contacts":[]}`},
+		{"pending request", "/contacts/request", `{"id":"b","contact":"a"}`, 200, `{"contacts":[]}`, `{"contacts":[]}`},
+		{"confirmed", "/contacts/confirm", `{"id":"a","contact":"b"}`, 200, `{"contacts":["b"]}`, `{"contacts":["a"]}`},
+		{"confirmed twice", "/contacts/confirm", `{"id":"a","contact":"b"}`, 404, `{"contacts":["b"]}`, `{"contacts":["a"]}`},
+	}
+
+	for _, d := range data {
+		if w := do(r, "POST", d.path, d.body); w.Code != d.code {
+			t.Fatalf("%s: got %d %s, want %d", d.name, w.Code, w.Body, d.code)
+		}
+		if got := near("a"); got != d.nearA {
+			t.Errorf("%s: a finds %s, want %s", d.name, got, d.nearA)
+		}
+		if got := near("b"); got != d.nearB {
+			t.Errorf("%s: b finds %s, want %s", d.name, got, d.nearB)
+		}
+	}
+
+	// a rejected request leaves both unseen and nothing to confirm later
+	do(r, "POST", "/contacts/request", `{"id":"c","contact":"d"}`)
+	if w := do(r, "POST", "/contacts/confirm", `{"id":"d","contact":"c","reject":true}`); w.Code != 200 {
+		t.Fatalf("reject got %d: %s", w.Code, w.Body)
+	}
+	if got := near("c"); got != `{"contacts":[]}` {
+		t.Errorf("after rejection c finds %s", got)
+	}
+	if w := do(r, "POST", "/contacts/confirm", `{"id":"d","contact":"c"}`); w.Code != 404 {
+		t.Errorf("confirming a rejected request got %d, want 404", w.Code)
+	}
+
+	// one sided contacts see nothing of each other's presence either
+	do(r, "POST", "/contacts", `{"id":"c","contacts":["d"]}`)
+	if status, _ := m.contactPresence("c"); status["d"] != "offline" {
+		t.Errorf("c sees d as %s before d adds them back", status["d"])
+	}
+}
+
+func TestRemoveContacts(t *testing.T) {
+	m := newManager()
+	r := newRouter(m)
+	befriend(m, "a", "b", "c", "d")
+	for _, id := range []string{"b", "c", "d"} {
+		m.updateLocation(id, 51.5, -0.1, 0)
+	}
+
+	data := []struct {
+		body string
+		code int
+		want []string
+	}{
+		// padded and repeated ids are the ids they name
+		{`{"id":"a","contacts":[" b","b ","b"]}`, 200, []string{"c", "d"}},
+		// a contact a doesn't have is no error
+		{`{"id":"a","contacts":["x"]}`, 200, []string{"c", "d"}},
+		{`{"id":"a","contacts":["c"," "]}`, 422, []string{"c", "d"}},
+		{`{"id":"nobody","contacts":["c"]}`, 404, nil},
+	}
+
+	for _, d := range data {
+		w := do(r, "POST", "/contacts/remove", d.body)
+		if w.Code != d.code {
+			t.Errorf("%s got %d %s, want %d", d.body, w.Code, w.Body, d.code)
+		}
+		if d.want == nil {
+			continue
+		}
+
+		if got, _ := m.contactsFor("a"); !reflect.DeepEqual(got, d.want) {
+			t.Errorf("%s left %v, want %v", d.body, got, d.want)
+		}
+
+		var near []string
+		for _, c := range m.nearContacts("a", nearQuery{lat: 51.5, lon: -0.1, distance: 10, limit: 10}) {
+			near = append(near, c.Id)
+		}
+		sort.Strings(near)
+		if !reflect.DeepEqual(near, d.want) {
+			t.Errorf("%s near got %v, want %v", d.body, near, d.want)
+		}
+	}
+}
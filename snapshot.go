@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/asim/quadtree"
+)
+
+// snapshot is the on disk form of the manager's users
+type snapshot struct {
+	Users []snapshotUser `json:"users"`
+}
+
+type snapshotUser struct {
+	Id        string       `json:"id"`
+	Contacts  []string     `json:"contacts"`
+	Pending   []string     `json:"pending,omitempty"`
+	Blocks    []string     `json:"blocks,omitempty"`
+	Location  *snapshotFix `json:"location,omitempty"`
+	LastKnown *snapshotFix `json:"last_known,omitempty"`
+	Dark      bool         `json:"dark,omitempty"`
+	Invisible bool         `json:"invisible,omitempty"`
+
+	// group name to its members
+	Groups map[string][]string `json:"groups,omitempty"`
+
+	Fences  []snapshotFence `json:"fences,omitempty"`
+	History []snapshotFix   `json:"history,omitempty"`
+}
+
+type snapshotFix struct {
+	Lat      float64   `json:"lat"`
+	Lon      float64   `json:"lon"`
+	Alt      float64   `json:"alt"`
+	Accuracy float64   `json:"accuracy,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+func newSnapshotFix(f fix) snapshotFix {
+	return snapshotFix{Lat: f.lat, Lon: f.lon, Alt: f.alt, Accuracy: f.accuracy, Time: f.time}
+}
+
+func (f snapshotFix) fix() fix {
+	return fix{lat: f.Lat, lon: f.Lon, alt: f.Alt, accuracy: f.Accuracy, time: f.Time}
+}
+
+// snapshotFence is a circle when Polygon is empty. Inside is kept so a
+// user in a fence is not told they entered it again after a restart.
+type snapshotFence struct {
+	Label   string       `json:"label"`
+	Lat     float64      `json:"lat"`
+	Lon     float64      `json:"lon"`
+	Radius  float64      `json:"radius,omitempty"`
+	Polygon [][2]float64 `json:"polygon,omitempty"`
+	Inside  bool         `json:"inside,omitempty"`
+}
+
+// Save writes every user, their contacts, locations, fences and history
+// to path as JSON.
+// The file is replaced atomically.
+func (m *manager) Save(path string) error {
+	m.RLock()
+
+	var snap snapshot
+
+	for _, u := range m.users {
+		su := snapshotUser{
+			Id:        u.id,
+			Dark:      u.dark,
+			Invisible: u.invisible,
+		}
+
+		for contact := range u.contacts {
+			su.Contacts = append(su.Contacts, contact)
+		}
+
+		for contact := range u.pending {
+			su.Pending = append(su.Pending, contact)
+		}
+
+		for target := range u.blocks {
+			su.Blocks = append(su.Blocks, target)
+		}
+
+		if len(u.groups) > 0 {
+			su.Groups = make(map[string][]string, len(u.groups))
+		}
+
+		for name, members := range u.groups {
+			list := []string{}
+			for member := range members {
+				list = append(list, member)
+			}
+			su.Groups[name] = list
+		}
+
+		if u.location != nil {
+			lat, lon := u.location.Coordinates()
+			data := u.location.Data().(*point)
+			su.Location = &snapshotFix{Lat: lat, Lon: lon, Alt: data.alt, Accuracy: data.accuracy, Time: data.lastSeen}
+		}
+
+		if u.lastKnown != nil {
+			f := newSnapshotFix(*u.lastKnown)
+			su.LastKnown = &f
+		}
+
+		for _, f := range u.fences {
+			su.Fences = append(su.Fences, snapshotFence{
+				Label:   f.label,
+				Lat:     f.lat,
+				Lon:     f.lon,
+				Radius:  f.radius,
+				Polygon: f.polygon,
+				Inside:  f.inside,
+			})
+		}
+
+		for _, f := range u.trail.list() {
+			su.History = append(su.History, newSnapshotFix(f))
+		}
+
+		snap.Users = append(snap.Users, su)
+	}
+
+	m.RUnlock()
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load replaces the manager's users with those saved at path and
+// rebuilds the world from their locations. A missing file leaves the
+// manager empty.
+func (m *manager) Load(path string) error {
+	m.holdRemote()
+	defer m.releaseRemote()
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+
+	world := newWorld(m.bounds)
+	users := make(map[string]*user)
+
+	for _, su := range snap.Users {
+		u := newUser(su.Id)
+		u.dark = su.Dark
+		u.invisible = su.Invisible
+
+		for _, contact := range su.Contacts {
+			u.contacts[contact] = true
+		}
+
+		for _, contact := range su.Pending {
+			u.pending[contact] = true
+		}
+
+		for _, target := range su.Blocks {
+			u.blocks[target] = true
+		}
+
+		for name, members := range su.Groups {
+			u.groups[name] = make(map[string]bool)
+			for _, member := range members {
+				u.groups[name][member] = true
+			}
+		}
+
+		// a location outside -bounds, changed since the save, is dropped
+		if f := su.Location; f != nil && m.bounds.contains(f.Lat, f.Lon) {
+			u.location = quadtree.NewPoint(f.Lat, f.Lon, &point{id: u.id, alt: f.Alt, accuracy: f.Accuracy, lastSeen: f.Time})
+			u.lastSeen, u.taken = f.Time, f.Time
+			if !u.invisible {
+				world.Insert(u.location)
+			}
+		}
+
+		if su.LastKnown != nil {
+			f := su.LastKnown.fix()
+			u.lastKnown = &f
+		}
+
+		for _, f := range su.Fences {
+			u.fences = append(u.fences, &geofence{
+				label:   f.Label,
+				lat:     f.Lat,
+				lon:     f.Lon,
+				radius:  f.Radius,
+				polygon: f.Polygon,
+				inside:  f.Inside,
+			})
+		}
+
+		// oldest first, so the newest are kept if -history shrank
+		for _, f := range su.History {
+			u.trail.push(f.fix(), historySize)
+		}
+
+		users[u.id] = u
+	}
+
+	m.Lock()
+	m.world = world
+	m.users = users
+	m.Unlock()
+
+	return nil
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asim/quadtree"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store keeps users, their contacts, locations and everything else
+// about them. The manager writes through it on every change while
+// holding its own lock, and rebuilds from it on startup with restore.
+type Store interface {
+	// SaveContacts creates the user if need be and replaces their
+	// contacts.
+	SaveContacts(id string, contacts []string) error
+
+	// SaveState creates the user if need be and replaces their pending
+	// requests, blocks, groups and whether they are dark or invisible.
+	SaveState(id string, st userState) error
+
+	// SaveLocation creates the user if need be and sets their location.
+	SaveLocation(id string, f fix) error
+
+	// SaveLastKnown creates the user if need be and sets where they
+	// were last seen, kept when their location is cleared.
+	SaveLastKnown(id string, f fix) error
+
+	// ClearLocation forgets where the user is, keeping their contacts.
+	ClearLocation(id string) error
+
+	// DeleteUser forgets the user and drops them from all contacts.
+	DeleteUser(id string) error
+
+	// Batch runs fn with a store whose writes apply together.
+	Batch(fn func(tx Store) error) error
+
+	// Load returns every user sorted by id.
+	Load() ([]storedUser, error)
+
+	Close() error
+}
+
+// storedUser is one user as read back from a store.
+type storedUser struct {
+	id        string
+	contacts  []string
+	location  *fix
+	lastKnown *fix
+	userState
+}
+
+// userState is what a store keeps of a user besides contacts and
+// locations.
+type userState struct {
+	pending   []string
+	blocks    []string
+	groups    map[string][]string
+	dark      bool
+	invisible bool
+}
+
+// saveContacts writes the user's current contacts to s.
+func saveContacts(s Store, u *user) error {
+	contacts := make([]string, 0, len(u.contacts))
+	for contact := range u.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Strings(contacts)
+
+	return s.SaveContacts(u.id, contacts)
+}
+
+// saveState writes the user's pending requests, blocks, groups and
+// dark and invisible flags to s.
+func saveState(s Store, u *user) error {
+	st := userState{
+		pending:   sortedKeys(u.pending),
+		blocks:    sortedKeys(u.blocks),
+		groups:    make(map[string][]string, len(u.groups)),
+		dark:      u.dark,
+		invisible: u.invisible,
+	}
+	for name, members := range u.groups {
+		st.groups[name] = sortedKeys(members)
+	}
+
+	return s.SaveState(u.id, st)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveLocation writes the user's current and last known locations to
+// s, clearing the current one when they have none. Where invisible
+// users are is not written so a restart can't put them back in the
+// world.
+func saveLocation(s Store, u *user) error {
+	return s.Batch(func(tx Store) error {
+		if u.lastKnown != nil {
+			if err := tx.SaveLastKnown(u.id, *u.lastKnown); err != nil {
+				return err
+			}
+		}
+
+		if u.location == nil || u.invisible {
+			return tx.ClearLocation(u.id)
+		}
+
+		lat, lon := u.location.Coordinates()
+		data := u.location.Data().(*point)
+
+		return tx.SaveLocation(u.id, fix{lat: lat, lon: lon, alt: data.alt, accuracy: data.accuracy, time: data.lastSeen})
+	})
+}
+
+// persist logs a failed store write. Memory stays the source of truth
+// while running so the change itself still stands.
+func persist(ctx context.Context, err error) {
+	if err != nil {
+		logger.ErrorContext(ctx, "could not write to store", "event", "store_error", "error", err)
+	}
+}
+
+// restore replaces the manager's users with those in its store and
+// rebuilds the world from their locations.
+func (m *manager) restore() error {
+	m.holdRemote()
+	defer m.releaseRemote()
+
+	stored, err := m.store.Load()
+	if err != nil {
+		return err
+	}
+
+	world := newWorld(m.bounds)
+	users := make(map[string]*user, len(stored))
+
+	for _, su := range stored {
+		u := newUser(su.id)
+		u.dark = su.dark
+		u.invisible = su.invisible
+		u.lastKnown = su.lastKnown
+
+		for _, contact := range su.contacts {
+			u.contacts[contact] = true
+		}
+
+		for _, contact := range su.pending {
+			u.pending[contact] = true
+		}
+
+		for _, target := range su.blocks {
+			u.blocks[target] = true
+		}
+
+		for name, members := range su.groups {
+			u.groups[name] = make(map[string]bool)
+			for _, member := range members {
+				u.groups[name][member] = true
+			}
+		}
+
+		// a location outside -bounds, changed since it was written, is
+		// not restored
+		if f := su.location; f != nil && m.bounds.contains(f.lat, f.lon) {
+			u.location = quadtree.NewPoint(f.lat, f.lon, &point{id: u.id, alt: f.alt, accuracy: f.accuracy, lastSeen: f.time})
+			u.lastSeen, u.taken = f.time, f.time
+			if u.lastKnown == nil {
+				u.lastKnown = f
+			}
+			if !u.invisible && !u.dark {
+				world.Insert(u.location)
+			}
+		}
+
+		users[u.id] = u
+	}
+
+	m.Lock()
+	m.world = world
+	m.users = users
+	m.Unlock()
+
+	return nil
+}
+
+// memStore is the default store, kept in memory alongside the users.
+// Writes apply as they come, the manager's lock already orders them.
+type memStore struct {
+	mu    *sync.Mutex
+	users map[string]*storedUser
+
+	// in a batch, each user as it was before the batch first wrote to
+	// it, nil for one the batch made
+	undo map[string]*storedUser
+}
+
+func newMemStore() *memStore {
+	return &memStore{mu: new(sync.Mutex), users: make(map[string]*storedUser)}
+}
+
+// write calls fn with the user under the lock, making them first if
+// create is set and doing nothing for an unknown one otherwise. fn
+// must replace fields, never change their slices or maps, so undo can
+// keep a shallow copy.
+func (s *memStore) write(id string, create bool, fn func(su *storedUser)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	su, ok := s.users[id]
+	if !ok && !create {
+		return
+	}
+
+	s.keep(id, su)
+	if !ok {
+		su = &storedUser{id: id}
+		s.users[id] = su
+	}
+
+	fn(su)
+}
+
+// keep remembers su as it is before the batch's first write to id.
+// Callers must hold the lock.
+func (s *memStore) keep(id string, su *storedUser) {
+	if s.undo == nil {
+		return
+	}
+	if _, ok := s.undo[id]; ok {
+		return
+	}
+	if su == nil {
+		s.undo[id] = nil
+		return
+	}
+	before := *su
+	s.undo[id] = &before
+}
+
+func (s *memStore) SaveContacts(id string, contacts []string) error {
+	s.write(id, true, func(su *storedUser) {
+		su.contacts = append([]string(nil), contacts...)
+	})
+	return nil
+}
+
+func (s *memStore) SaveState(id string, st userState) error {
+	s.write(id, true, func(su *storedUser) {
+		su.userState = userState{
+			pending:   append([]string(nil), st.pending...),
+			blocks:    append([]string(nil), st.blocks...),
+			groups:    make(map[string][]string, len(st.groups)),
+			dark:      st.dark,
+			invisible: st.invisible,
+		}
+		for name, members := range st.groups {
+			su.groups[name] = append([]string{}, members...)
+		}
+	})
+	return nil
+}
+
+func (s *memStore) SaveLocation(id string, f fix) error {
+	s.write(id, true, func(su *storedUser) {
+		su.location = &f
+	})
+	return nil
+}
+
+func (s *memStore) SaveLastKnown(id string, f fix) error {
+	s.write(id, true, func(su *storedUser) {
+		su.lastKnown = &f
+	})
+	return nil
+}
+
+func (s *memStore) ClearLocation(id string) error {
+	s.write(id, false, func(su *storedUser) {
+		su.location = nil
+	})
+	return nil
+}
+
+func (s *memStore) DeleteUser(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if su, ok := s.users[id]; ok {
+		s.keep(id, su)
+		delete(s.users, id)
+	}
+
+	// as the SQLite store, nobody else keeps them in any list
+	for other, su := range s.users {
+		contacts, c := without(su.contacts, id)
+		pending, p := without(su.pending, id)
+		blocks, b := without(su.blocks, id)
+
+		groups := su.groups
+		g := false
+		for _, members := range su.groups {
+			if _, ok := without(members, id); ok {
+				g = true
+				break
+			}
+		}
+		if g {
+			groups = make(map[string][]string, len(su.groups))
+			for name, members := range su.groups {
+				groups[name], _ = without(members, id)
+			}
+		}
+
+		if !c && !p && !b && !g {
+			continue
+		}
+
+		s.keep(other, su)
+		su.contacts, su.pending, su.blocks, su.groups = contacts, pending, blocks, groups
+	}
+
+	return nil
+}
+
+// without returns ids less id in a new slice, and whether it was there.
+func without(ids []string, id string) ([]string, bool) {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i:i], ids[i+1:]...), true
+		}
+	}
+	return ids, false
+}
+
+// Batch runs fn with a store that writes straight through, putting back
+// every user it wrote to if fn fails. Batches inside one join it.
+func (s *memStore) Batch(fn func(tx Store) error) error {
+	if s.undo != nil {
+		return fn(s)
+	}
+
+	tx := &memStore{mu: s.mu, users: s.users, undo: make(map[string]*storedUser)}
+	if err := fn(tx); err != nil {
+		s.mu.Lock()
+		for id, su := range tx.undo {
+			if su == nil {
+				delete(s.users, id)
+			} else {
+				s.users[id] = su
+			}
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (s *memStore) Load() ([]storedUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]storedUser, 0, len(s.users))
+	for _, su := range s.users {
+		users = append(users, *su)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].id < users[j].id
+	})
+
+	return users, nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	lat REAL,
+	lon REAL,
+	alt REAL,
+	accuracy REAL,
+	seen INTEGER
+);
+CREATE TABLE IF NOT EXISTS contacts (
+	user_id TEXT NOT NULL,
+	contact_id TEXT NOT NULL,
+	PRIMARY KEY (user_id, contact_id)
+);
+CREATE TABLE IF NOT EXISTS pending (
+	user_id TEXT NOT NULL,
+	contact_id TEXT NOT NULL,
+	PRIMARY KEY (user_id, contact_id)
+);
+CREATE TABLE IF NOT EXISTS blocks (
+	user_id TEXT NOT NULL,
+	target_id TEXT NOT NULL,
+	PRIMARY KEY (user_id, target_id)
+);
+CREATE TABLE IF NOT EXISTS group_members (
+	user_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	member_id TEXT NOT NULL,
+	PRIMARY KEY (user_id, name, member_id)
+);
+`
+
+// userColumns are added to the users table since it was first made,
+// and to an older database's when it is opened. known_* is the last
+// known location.
+var userColumns = []string{
+	"known_lat REAL",
+	"known_lon REAL",
+	"known_alt REAL",
+	"known_accuracy REAL",
+	"known_seen INTEGER",
+	"dark INTEGER NOT NULL DEFAULT 0",
+	"invisible INTEGER NOT NULL DEFAULT 0",
+}
+
+// addUserColumns adds any of userColumns the users table lacks.
+func addUserColumns(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('users')`)
+	if err != nil {
+		return err
+	}
+
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range userColumns {
+		if have[strings.Fields(column)[0]] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN ` + column); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execer is what sqlStore writes through, the database or a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// sqlStore keeps users in a SQLite database. A location is a user row
+// with lat set.
+type sqlStore struct {
+	db *sql.DB
+	ex execer
+}
+
+func openSQLStore(path string) (*sqlStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// one writer at a time, as SQLite wants
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := addUserColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db, ex: db}, nil
+}
+
+func (s *sqlStore) SaveContacts(id string, contacts []string) error {
+	return s.Batch(func(tx Store) error {
+		ex := tx.(*sqlStore).ex
+
+		if _, err := ex.Exec(`INSERT INTO users (id) VALUES (?) ON CONFLICT (id) DO NOTHING`, id); err != nil {
+			return err
+		}
+
+		if _, err := ex.Exec(`DELETE FROM contacts WHERE user_id = ?`, id); err != nil {
+			return err
+		}
+
+		for _, contact := range contacts {
+			if _, err := ex.Exec(`INSERT INTO contacts (user_id, contact_id) VALUES (?, ?)`, id, contact); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *sqlStore) SaveState(id string, st userState) error {
+	return s.Batch(func(tx Store) error {
+		ex := tx.(*sqlStore).ex
+
+		if _, err := ex.Exec(`INSERT INTO users (id, dark, invisible) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET dark = excluded.dark, invisible = excluded.invisible`,
+			id, st.dark, st.invisible); err != nil {
+			return err
+		}
+
+		for _, q := range []string{
+			`DELETE FROM pending WHERE user_id = ?`,
+			`DELETE FROM blocks WHERE user_id = ?`,
+			`DELETE FROM group_members WHERE user_id = ?`,
+		} {
+			if _, err := ex.Exec(q, id); err != nil {
+				return err
+			}
+		}
+
+		for _, contact := range st.pending {
+			if _, err := ex.Exec(`INSERT INTO pending (user_id, contact_id) VALUES (?, ?)`, id, contact); err != nil {
+				return err
+			}
+		}
+
+		for _, target := range st.blocks {
+			if _, err := ex.Exec(`INSERT INTO blocks (user_id, target_id) VALUES (?, ?)`, id, target); err != nil {
+				return err
+			}
+		}
+
+		// a row with no member keeps a group that has none, ids are
+		// never empty
+		for name, members := range st.groups {
+			for _, member := range append([]string{""}, members...) {
+				if _, err := ex.Exec(`INSERT INTO group_members (user_id, name, member_id) VALUES (?, ?, ?)`, id, name, member); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *sqlStore) SaveLastKnown(id string, f fix) error {
+	_, err := s.ex.Exec(`INSERT INTO users (id, known_lat, known_lon, known_alt, known_accuracy, known_seen) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET known_lat = excluded.known_lat, known_lon = excluded.known_lon,
+		known_alt = excluded.known_alt, known_accuracy = excluded.known_accuracy, known_seen = excluded.known_seen`,
+		id, f.lat, f.lon, f.alt, f.accuracy, f.time.UnixNano())
+	return err
+}
+
+func (s *sqlStore) SaveLocation(id string, f fix) error {
+	_, err := s.ex.Exec(`INSERT INTO users (id, lat, lon, alt, accuracy, seen) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET lat = excluded.lat, lon = excluded.lon, alt = excluded.alt,
+		accuracy = excluded.accuracy, seen = excluded.seen`,
+		id, f.lat, f.lon, f.alt, f.accuracy, f.time.UnixNano())
+	return err
+}
+
+func (s *sqlStore) ClearLocation(id string) error {
+	_, err := s.ex.Exec(`UPDATE users SET lat = NULL, lon = NULL, alt = NULL, accuracy = NULL, seen = NULL WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqlStore) DeleteUser(id string) error {
+	return s.Batch(func(tx Store) error {
+		ex := tx.(*sqlStore).ex
+
+		for _, q := range []string{
+			`DELETE FROM contacts WHERE user_id = ? OR contact_id = ?`,
+			`DELETE FROM pending WHERE user_id = ? OR contact_id = ?`,
+			`DELETE FROM blocks WHERE user_id = ? OR target_id = ?`,
+			`DELETE FROM group_members WHERE user_id = ? OR member_id = ?`,
+		} {
+			if _, err := ex.Exec(q, id, id); err != nil {
+				return err
+			}
+		}
+
+		_, err := ex.Exec(`DELETE FROM users WHERE id = ?`, id)
+		return err
+	})
+}
+
+// Batch runs fn in a transaction, committed if fn returns nil. Batches
+// inside one join it.
+func (s *sqlStore) Batch(fn func(tx Store) error) error {
+	if _, ok := s.ex.(*sql.Tx); ok {
+		return fn(s)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&sqlStore{db: s.db, ex: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) Load() ([]storedUser, error) {
+	rows, err := s.db.Query(`SELECT id, lat, lon, alt, accuracy, seen,
+		known_lat, known_lon, known_alt, known_accuracy, known_seen, dark, invisible FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []storedUser
+	index := make(map[string]int)
+
+	for rows.Next() {
+		var id string
+		var at, known sqlFix
+		var dark, invisible bool
+
+		if err := rows.Scan(&id, &at.lat, &at.lon, &at.alt, &at.accuracy, &at.seen,
+			&known.lat, &known.lon, &known.alt, &known.accuracy, &known.seen, &dark, &invisible); err != nil {
+			return nil, err
+		}
+
+		su := storedUser{id: id, location: at.fix(), lastKnown: known.fix()}
+		su.dark, su.invisible = dark, invisible
+
+		index[id] = len(users)
+		users = append(users, su)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// each table's rows are added to the user of their first column
+	for _, t := range []struct {
+		query string
+		add   func(su *storedUser, name, id string)
+	}{
+		{`SELECT user_id, '', contact_id FROM contacts ORDER BY user_id, contact_id`, func(su *storedUser, _, id string) {
+			su.contacts = append(su.contacts, id)
+		}},
+		{`SELECT user_id, '', contact_id FROM pending ORDER BY user_id, contact_id`, func(su *storedUser, _, id string) {
+			su.pending = append(su.pending, id)
+		}},
+		{`SELECT user_id, '', target_id FROM blocks ORDER BY user_id, target_id`, func(su *storedUser, _, id string) {
+			su.blocks = append(su.blocks, id)
+		}},
+		{`SELECT user_id, name, member_id FROM group_members ORDER BY user_id, name, member_id`, func(su *storedUser, name, id string) {
+			if su.groups == nil {
+				su.groups = make(map[string][]string)
+			}
+			// the memberless row comes first, making the group
+			if len(id) == 0 {
+				su.groups[name] = []string{}
+				return
+			}
+			su.groups[name] = append(su.groups[name], id)
+		}},
+	} {
+		if err := s.each(t.query, func(user, name, id string) {
+			if i, ok := index[user]; ok {
+				t.add(&users[i], name, id)
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+// each calls fn with the three columns of every row query returns.
+func (s *sqlStore) each(query string, fn func(a, b, c string)) error {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a, b, c string
+		if err := rows.Scan(&a, &b, &c); err != nil {
+			return err
+		}
+		fn(a, b, c)
+	}
+
+	return rows.Err()
+}
+
+// sqlFix is a location as scanned from nullable columns.
+type sqlFix struct {
+	lat, lon, alt, accuracy sql.NullFloat64
+	seen                    sql.NullInt64
+}
+
+// fix is nil when no location was written.
+func (f sqlFix) fix() *fix {
+	if !f.lat.Valid || !f.lon.Valid {
+		return nil
+	}
+	return &fix{
+		lat:      f.lat.Float64,
+		lon:      f.lon.Float64,
+		alt:      f.alt.Float64,
+		accuracy: f.accuracy.Float64,
+		time:     time.Unix(0, f.seen.Int64).UTC(),
+	}
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/asim/quadtree"
+	"github.com/gorilla/websocket"
+)
+
+// event is pushed to subscribers as a JSON websocket message
+type event struct {
+	Type     string  `json:"type"`
+	Id       string  `json:"id,omitempty"`
+	Fence    string  `json:"fence,omitempty"`
+	Distance float64 `json:"distance_m"`
+}
+
+// nearBatch is pushed instead of near events when a subscriber asks
+// for them to be debounced, every contact found near in the window.
+type nearBatch struct {
+	Type     string  `json:"type"`
+	Contacts []event `json:"contacts"`
+}
+
+var (
+	// events buffered per subscriber before dropping
+	subscriberBuffer = 16
+
+	// longest debounce window a subscriber may ask for
+	maxDebounce = time.Minute
+
+	upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+)
+
+// subscribe registers a channel receiving events for id.
+func (m *manager) subscribe(id string) chan []byte {
+	ch := make(chan []byte, subscriberBuffer)
+
+	m.Lock()
+	defer m.Unlock()
+
+	subs, ok := m.subscribers[id]
+	if !ok {
+		subs = make(map[chan []byte]bool)
+		m.subscribers[id] = subs
+	}
+	subs[ch] = true
+
+	return ch
+}
+
+func (m *manager) unsubscribe(id string, ch chan []byte) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.subscribers[id], ch)
+	if len(m.subscribers[id]) == 0 {
+		delete(m.subscribers, id)
+	}
+}
+
+// notifyNear tells subscribers who have u as a contact that u has just
+// moved within nearestDistance of them. Once told, u stays near until
+// they move beyond nearestDistance by nearMargin, so jitter at the edge
+// doesn't alert again. Without that recorded u counts as near if they
+// were at prev (nil if u had no location). Slow subscribers miss events
+// rather than hold up the ping. Callers must hold the write lock.
+func (m *manager) notifyNear(u *user, prev *quadtree.Point) {
+	if len(m.subscribers) == 0 || u.location == nil || u.invisible {
+		return
+	}
+
+	lat, lon := u.location.Coordinates()
+
+	for id, subs := range m.subscribers {
+		s, ok := m.users[id]
+		if !ok || s.location == nil || id == u.id || !s.contacts[u.id] || !m.shares(u.id, id) {
+			continue
+		}
+
+		sLat, sLon := s.location.Coordinates()
+
+		distance := haversine(sLat, sLon, lat, lon)
+
+		wasNear := s.alerted[u.id]
+		if !wasNear && prev != nil {
+			pLat, pLon := prev.Coordinates()
+			wasNear = haversine(sLat, sLon, pLat, pLon) <= nearestDistance
+		}
+
+		switch {
+		case wasNear && distance > nearestDistance*(1+nearMargin):
+			delete(s.alerted, u.id)
+		case wasNear:
+			s.alerted[u.id] = true
+		case distance <= nearestDistance:
+			s.alerted[u.id] = true
+			publish(subs, event{Type: "near", Id: u.id, Distance: distance})
+		}
+	}
+}
+
+// publish sends e to each of subs, skipping any that are full.
+func publish(subs map[chan []byte]bool, e event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	for ch := range subs {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+func (m *manager) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		http.Error(w, "Bad Request. Could not find id.", http.StatusBadRequest)
+		return
+	}
+
+	window := nearDebounce
+	if v := r.URL.Query().Get("debounce"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxDebounce {
+			http.Error(w, fmt.Sprintf("Bad Request. debounce must be a duration up to %v.", maxDebounce), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+
+	// Upgrade writes its own error response
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ch := m.subscribe(id)
+	defer m.unsubscribe(id, ch)
+
+	// read until the client goes away
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	relay(ch, done, window, func(b []byte) error {
+		return conn.WriteMessage(websocket.TextMessage, b)
+	})
+}
+
+// relay sends each event from ch until done is closed or a send fails.
+// With a window near events are held from the first until it has
+// passed then sent as one near_batch, a contact found near again in the
+// window listed once at their latest distance. Other events go at once.
+func relay(ch <-chan []byte, done <-chan struct{}, window time.Duration, send func([]byte) error) {
+	var held []event
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case <-done:
+			return
+		case b := <-ch:
+			var e event
+			if window <= 0 || json.Unmarshal(b, &e) != nil || e.Type != "near" {
+				if err := send(b); err != nil {
+					return
+				}
+				continue
+			}
+
+			held = holdNear(held, e)
+			if flush == nil {
+				flush = time.After(window)
+			}
+		case <-flush:
+			b, err := json.Marshal(nearBatch{Type: "near_batch", Contacts: held})
+			held, flush = nil, nil
+			if err != nil {
+				continue
+			}
+			if err := send(b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// holdNear adds e to held, replacing an earlier event for the same
+// contact in place.
+func holdNear(held []event, e event) []event {
+	for i := range held {
+		if held[i].Id == e.Id {
+			held[i] = e
+			return held
+		}
+	}
+	return append(held, e)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// header naming the app a request belongs to, none is the default app
+const tenantHeader = "X-Tenant-ID"
+
+// longest tenant id accepted, each new one costs a manager
+const maxTenantID = 64
+
+var (
+	errUnknownTenant  = errors.New("unknown tenant")
+	errTooManyTenants = errors.New("too many tenants")
+)
+
+// tenants keeps a separate manager, and so a separate world, for each
+// app so users of one never see users of another.
+type tenants struct {
+	sync.Mutex
+	managers map[string]*manager
+	routers  map[string]http.Handler
+
+	// the only tenants served, nil for any, as when api keys name them
+	allowed map[string]bool
+
+	// most tenants created besides the default, 0 for no limit
+	limit int
+
+	// set when pings are shared with other instances
+	fanout *fanout
+}
+
+// newTenants serves requests without a tenant from def.
+func newTenants(def *manager) *tenants {
+	return &tenants{
+		managers: map[string]*manager{"": def},
+		routers:  map[string]http.Handler{"": newRouter(def)},
+		limit:    maxTenants,
+	}
+}
+
+// get returns the tenant's manager and router, creating them on first
+// use unless the tenant isn't allowed or the limit is reached. Only the
+// default manager waits on startup to be ready.
+func (t *tenants) get(id string) (*manager, http.Handler, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if m, ok := t.managers[id]; ok {
+		return m, t.routers[id], nil
+	}
+
+	if t.allowed != nil && !t.allowed[id] {
+		return nil, nil, errUnknownTenant
+	}
+
+	// the default is always there and never counts
+	if t.limit > 0 && len(t.managers)-1 >= t.limit {
+		return nil, nil, errTooManyTenants
+	}
+
+	logger.Info("new tenant", "event", "new_tenant", "tenant", id)
+
+	m := newManager()
+	m.fanout = t.fanoutFor(id)
+	m.setReady()
+
+	t.managers[id] = m
+	t.routers[id] = newRouter(m)
+
+	return m, t.routers[id], nil
+}
+
+// each calls fn with every tenant's manager.
+func (t *tenants) each(fn func(m *manager)) {
+	t.Lock()
+	managers := make([]*manager, 0, len(t.managers))
+	for _, m := range t.managers {
+		managers = append(managers, m)
+	}
+	t.Unlock()
+
+	for _, m := range managers {
+		fn(m)
+	}
+}
+
+// expireEvery runs expireLocations for every tenant on each tick of
+// interval, forever.
+func (t *tenants) expireEvery(ttl, interval time.Duration) {
+	for range time.Tick(interval) {
+		t.each(func(m *manager) {
+			m.expireLocations(context.Background(), ttl)
+		})
+	}
+}
+
+// sweepEvery drops idle ping limits and expired idempotent responses
+// for every tenant on each tick of interval, forever.
+func (t *tenants) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.each(func(m *manager) {
+			m.pings.sweep()
+			m.replays.sweep()
+		})
+	}
+}
+
+func (t *tenants) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(tenantHeader)
+	if len(id) > maxTenantID {
+		http.Error(w, "Bad Request. Tenant id too long.", http.StatusBadRequest)
+		return
+	}
+
+	_, h, err := t.get(id)
+	switch err {
+	case nil:
+		h.ServeHTTP(w, r)
+	case errUnknownTenant:
+		http.Error(w, "Not Found. Unknown tenant.", http.StatusNotFound)
+	default:
+		http.Error(w, "Service Unavailable. Too many tenants.", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// fieldErrors maps a request field, dotted for nested fields, to what is
+// wrong with it.
+type fieldErrors map[string]string
+
+// validator is a write request which can check its own fields.
+type validator interface {
+	validate() fieldErrors
+}
+
+// normalizer is a valid request which can put itself in the form the
+// manager sees, e.g. contacts trimmed and deduplicated.
+type normalizer interface {
+	normalize()
+}
+
+// dryRuns are the write endpoints /validate/ can check, by path.
+var dryRuns = map[string]func() validator{
+	"/contacts":         func() validator { return new(contactRequest) },
+	"/contacts/set":     func() validator { return new(contactRequest) },
+	"/contacts/remove":  func() validator { return new(contactRequest) },
+	"/contacts/request": func() validator { return new(contactPairRequest) },
+	"/contacts/confirm": func() validator { return new(contactConfirmRequest) },
+	"/groups":           func() validator { return new(groupRequest) },
+	"/ping":             func() validator { return new(pingRequest) },
+	"/ping/bulk":        func() validator { return new(bulkPingRequest) },
+	"/sync":             func() validator { return new(syncRequest) },
+	"/visibility":       func() validator { return new(visibilityRequest) },
+	"/block":            func() validator { return new(blockRequest) },
+	"/user/delete":      func() validator { return new(idRequest) },
+	"/go-dark":          func() validator { return new(idRequest) },
+	"/go-live":          func() validator { return new(idRequest) },
+	"/offline":          func() validator { return new(idRequest) },
+	"/geofence":         func() validator { return new(geofenceRequest) },
+}
+
+// validateHandler decodes and validates a body the way the endpoint
+// named after /validate would, answering with the normalized request
+// instead of applying it.
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	newRequest, ok := dryRuns[strings.TrimPrefix(r.URL.Path, "/validate")]
+	if !ok {
+		http.Error(w, "Not Found. Unknown endpoint.", http.StatusNotFound)
+		return
+	}
+
+	req := newRequest()
+	if !decodeValid(w, r, req) {
+		return
+	}
+
+	if n, ok := req.(normalizer); ok {
+		n.normalize()
+	}
+
+	writeJSON(w, map[string]interface{}{"valid": true, "request": req})
+}
+
+// decodeValid reads a POST body into v then validates it. A body which
+// is not JSON is a 400, a body which is JSON but not a valid request is
+// a 422 naming each bad field.
+func decodeValid(w http.ResponseWriter, r *http.Request, v validator) bool {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return false
+	}
+
+	dec := json.NewDecoder(r.Body)
+	if strictJSON {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(v)
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && len(typeErr.Field) > 0:
+		validationFailed(w, fieldErrors{typeErr.Field: "expected " + jsonType(typeErr.Type.Kind())})
+		return false
+	case err != nil:
+		badBody(w, err)
+		return false
+	}
+
+	if errs := v.validate(); len(errs) > 0 {
+		validationFailed(w, errs)
+		return false
+	}
+
+	return true
+}
+
+// jsonType names a Go kind the way a JSON client would know it.
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return kind.String()
+}
+
+// validationFailed writes a 422 listing the bad fields.
+func validationFailed(w http.ResponseWriter, errs fieldErrors) {
+	writeJSONStatus(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":  "validation_failed",
+		"fields": errs,
+	})
+}
+
+func (errs fieldErrors) required(field, value string) {
+	if len(strings.TrimSpace(value)) == 0 {
+		errs[field] = "required"
+	}
+}
+
+// location checks a required location under field.
+func (errs fieldErrors) location(field string, l *location) {
+	if l == nil {
+		errs[field] = "required"
+		return
+	}
+
+	if l.Lat == nil {
+		errs[field+".lat"] = "required"
+	} else if *l.Lat < -90 || *l.Lat > 90 {
+		errs[field+".lat"] = "must be between -90 and 90"
+	}
+
+	if l.Lon == nil {
+		errs[field+".lon"] = "required"
+	} else if *l.Lon < -180 || *l.Lon > 180 {
+		errs[field+".lon"] = "must be between -180 and 180"
+	}
+}
+
+// ids checks a required list of ids, none of which may be blank.
+func (errs fieldErrors) ids(field string, ids []string) {
+	if ids == nil {
+		errs[field] = "required"
+		return
+	}
+
+	for i, id := range ids {
+		errs.required(fmt.Sprintf("%s[%d]", field, i), id)
+	}
+}
+
+func (req *contactRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.ids("contacts", req.Contacts)
+	return errs
+}
+
+func (req *contactRequest) normalize() {
+	req.Contacts, _ = normalizeIDs(req.Contacts)
+}
+
+func (req *contactPairRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.required("contact", req.Contact)
+	if len(errs) == 0 && req.Contact == req.Id {
+		errs["contact"] = "must differ from id"
+	}
+	return errs
+}
+
+func (req *contactConfirmRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.required("contact", req.Contact)
+	return errs
+}
+
+func (req *pingRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.location("location", req.Location)
+	if req.Accuracy != nil && *req.Accuracy < 0 {
+		errs["accuracy"] = "must not be negative"
+	}
+	return errs
+}
+
+func (req *pingRequest) normalize() {
+	*req.Location.Lat, *req.Location.Lon = snap(*req.Location.Lat), snap(*req.Location.Lon)
+}
+
+// validate only checks the batch is there, each update is checked on
+// its own and reported in its result.
+func (req *bulkPingRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	if req.Updates == nil {
+		errs["updates"] = "required"
+	}
+	return errs
+}
+
+// normalize leaves updates which fail validation as they came, they
+// would only be reported in their result.
+func (req *bulkPingRequest) normalize() {
+	for i := range req.Updates {
+		if up := &req.Updates[i]; len(up.validate()) == 0 {
+			up.normalize()
+		}
+	}
+}
+
+func (req *syncRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.location("location", req.Location)
+	errs.ids("contacts", req.Contacts)
+	return errs
+}
+
+func (req *syncRequest) normalize() {
+	*req.Location.Lat, *req.Location.Lon = snap(*req.Location.Lat), snap(*req.Location.Lon)
+	req.Contacts, _ = normalizeIDs(req.Contacts)
+}
+
+func (req *visibilityRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	if req.Visible == nil {
+		errs["visible"] = "required"
+	}
+	return errs
+}
+
+func (req *blockRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.required("target", req.Target)
+	return errs
+}
+
+func (req *idRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	return errs
+}
+
+func (req *geofenceRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.required("id", req.Id)
+	errs.required("label", req.Label)
+
+	if req.Polygon != nil {
+		if req.Location != nil || req.Radius != nil {
+			errs["polygon"] = "not allowed with location and radius"
+			return errs
+		}
+		for i := range req.Polygon {
+			errs.location(fmt.Sprintf("polygon[%d]", i), &req.Polygon[i])
+		}
+		if len(errs) == 0 {
+			if _, err := checkPolygon(req.vertices()); err != nil {
+				errs["polygon"] = err.Error()
+			}
+		}
+		return errs
+	}
+
+	errs.location("location", req.Location)
+	if req.Radius == nil {
+		errs["radius"] = "required"
+	} else if *req.Radius <= 0 {
+		errs["radius"] = "must be positive"
+	}
+	return errs
+}